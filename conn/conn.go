@@ -11,12 +11,18 @@ import (
 var ErrConnectionClosed = errors.New("connection is closed")
 var ErrKeyframeNeeded = errors.New("keyframe needed")
 
+// AbsCaptureTimeURI is the URI of the RTP header extension that carries
+// the NTP time at which a frame was captured.
+const AbsCaptureTimeURI = "http://www.webrtc.org/experiments/rtp-hdrext/abs-capture-time"
+
 // Type Up represents a connection in the client to server direction.
 type Up interface {
 	AddLocal(Down) error
 	DelLocal(Down) bool
 	Id() string
 	Label() string
+	// the id and username of the client that owns the connection
+	User() (string, string)
 	Codecs() []webrtc.RTPCodecCapability
 }
 
@@ -29,6 +35,10 @@ type UpTrack interface {
 	// get a recent packet.  Returns 0 if the packet is not in cache.
 	GetRTP(seqno uint16, result []byte) uint16
 	Nack(conn Up, seqnos []uint16) error
+	// the id of a negotiated RTP header extension, 0 if none
+	HeaderExtensionID(uri string) uint8
+	// the estimated bitrate in bits per second, 0 if not known
+	Bitrate() uint64
 }
 
 // Type Down represents a connection in the server to client direction.
@@ -36,6 +46,13 @@ type Down interface {
 	GetMaxBitrate(now uint64) uint64
 }
 
+// Type DataDown is implemented by the Down connections that receive the
+// messages sent on the data channels of an Up connection.
+type DataDown interface {
+	// the label of the channel, and whether the message is text
+	WriteData(channel string, data []byte, text bool) error
+}
+
 // Type DownTrack represents a track in the server to client direction.
 type DownTrack interface {
 	WriteRTP(packat *rtp.Packet) error
@@ -0,0 +1,217 @@
+package diskwriter
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BrokenRecordings determines what is done at startup with the
+// recordings that contain no media, typically because the server crashed
+// while writing them: "move" moves them to a subdirectory named
+// ".broken", "delete" deletes them, and "" leaves them alone.
+var BrokenRecordings = "move"
+
+// BrokenSize is the size in bytes below which a recording is considered
+// to be broken.
+var BrokenSize int64 = 1024
+
+const brokenDirectory = ".broken"
+
+// the amount of data examined by hasCluster, which is enough for the
+// headers that precede the first cluster
+const brokenScanSize = 64 * 1024
+
+var errBadWebm = errors.New("bad webm file")
+
+// hasCluster returns true if a webm file contains at least one cluster.
+// Since clusters follow the headers, only the beginning of the file is
+// examined.  Truncated files are not an error.
+func hasCluster(r io.Reader) (bool, error) {
+	data := make([]byte, brokenScanSize)
+	n, err := io.ReadFull(r, data)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	data = data[:n]
+	// true if the whole file was read
+	complete := n < brokenScanSize
+
+	// the EBML header and the segment, whose contents are scanned
+	for i, expected := range []uint64{idEBML, idSegment} {
+		id, l1, _ := readVint(data, true)
+		if l1 == 0 && complete {
+			return false, nil
+		} else if l1 <= 0 || id != expected {
+			return false, errBadWebm
+		}
+		size, l2, unknown := readVint(data[l1:], false)
+		if l2 == 0 && complete {
+			return false, nil
+		} else if l2 <= 0 || (i == 0 && unknown) {
+			return false, errBadWebm
+		}
+		data = data[l1+l2:]
+		if i == 0 {
+			if uint64(len(data)) < size {
+				if complete {
+					return false, nil
+				}
+				return false, errBadWebm
+			}
+			data = data[size:]
+		}
+	}
+
+	for len(data) > 0 {
+		id, l1, _ := readVint(data, true)
+		if l1 < 0 {
+			return false, errBadWebm
+		} else if l1 == 0 {
+			break
+		}
+		if id == idCluster {
+			return true, nil
+		}
+		size, l2, unknown := readVint(data[l1:], false)
+		if l2 < 0 || unknown {
+			return false, errBadWebm
+		} else if l2 == 0 || uint64(len(data)-l1-l2) < size {
+			break
+		}
+		data = data[l1+l2+int(size):]
+	}
+	if !complete {
+		// the headers are unexpectedly large
+		return false, errBadWebm
+	}
+	return false, nil
+}
+
+// isBroken returns true if the recording in path, whose size is given,
+// contains no media.  The contents of encrypted recordings are not
+// examined.
+func isBroken(path string, size int64) (bool, error) {
+	if size < BrokenSize {
+		return true, nil
+	}
+	if filepath.Ext(strings.TrimSuffix(path, ".part")) != ".webm" {
+		return false, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(encryptionMagic))
+	_, err = io.ReadFull(f, magic)
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(magic, []byte(encryptionMagic)) {
+		return false, nil
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return false, err
+	}
+	ok, err := hasCluster(f)
+	if err != nil {
+		return false, err
+	}
+	return !ok, nil
+}
+
+// disposeBroken moves or deletes a broken recording, together with the
+// files written next to it.
+func disposeBroken(path string) error {
+	names := []string{path}
+	if !strings.HasSuffix(path, ".part") {
+		for _, name := range sidecarNames(path) {
+			_, err := os.Stat(name)
+			if err == nil {
+				names = append(names, name)
+			}
+		}
+	}
+
+	switch BrokenRecordings {
+	case "delete":
+		for _, name := range names {
+			err := os.Remove(name)
+			if err != nil {
+				return err
+			}
+		}
+		log.Printf("Deleted broken recording %v", path)
+	case "move":
+		dir := filepath.Join(filepath.Dir(path), brokenDirectory)
+		err := os.MkdirAll(dir, DirMode)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			err := os.Rename(
+				name, filepath.Join(dir, filepath.Base(name)),
+			)
+			if err != nil {
+				return err
+			}
+		}
+		log.Printf("Moved broken recording %v to %v", path, dir)
+	default:
+		return errors.New("unknown action " + BrokenRecordings)
+	}
+	cleanLatestAbove(path)
+	return nil
+}
+
+// CleanBroken moves or deletes the broken recordings, as determined by
+// BrokenRecordings.  Only the recording directories of the known groups
+// are scanned.  It is meant to be called at startup, before any
+// recording is started, since a file being written may look broken.
+func CleanBroken() {
+	if BrokenRecordings == "" || Directory == "" {
+		return
+	}
+
+	walk := func(name, path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Clean broken recordings: %v", err)
+			}
+			return nil
+		}
+		if fi.IsDir() {
+			if fi.Name() == brokenDirectory {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isSymlink(fi) ||
+			!isRecording(strings.TrimSuffix(path, ".part")) ||
+			isOpenFile(path) {
+			return nil
+		}
+		broken, err := isBroken(path, fi.Size())
+		if err != nil {
+			log.Printf("Check recording %v: %v", path, err)
+			return nil
+		}
+		if broken {
+			err = disposeBroken(path)
+			if err != nil {
+				log.Printf("Clean broken recording %v: %v",
+					path, err)
+			}
+		}
+		return nil
+	}
+	walkGroups(walk)
+}
@@ -0,0 +1,163 @@
+package diskwriter
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// the time during which a chat message is displayed
+const chatCueDuration = 5 * time.Second
+
+// chatMessage is a public chat message received during a recording.
+type chatMessage struct {
+	time     time.Time
+	username string
+	action   bool
+	text     string
+}
+
+// transcriptName returns the name of the chat transcript of a recording.
+func transcriptName(recording string) string {
+	return strings.TrimSuffix(recording, filepath.Ext(recording)) + ".vtt"
+}
+
+// vttTime formats a duration as a WebVTT timestamp.
+func vttTime(d time.Duration) string {
+	ms := int64(d / time.Millisecond)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d",
+		ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+var vttReplacer = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// vttEscape escapes a string for inclusion in a WebVTT cue.  Since a
+// blank line terminates a cue, blank lines are removed.
+func vttEscape(s string) string {
+	s = vttReplacer.Replace(strings.ToValidUTF8(s, "\uFFFD"))
+	lines := strings.FieldsFunc(s, func(r rune) bool {
+		return r == '\n' || r == '\r'
+	})
+	out := lines[:0]
+	for _, l := range lines {
+		if strings.TrimSpace(l) != "" {
+			out = append(out, l)
+		}
+	}
+	return strings.Join(out, "\n")
+}
+
+// formatTranscript formats chat messages as WebVTT, with timestamps
+// relative to start.  Messages received before start are displayed at
+// the beginning, and messages received after the end of the recording
+// are displayed at its end, so that they are not lost.
+func formatTranscript(start time.Time, duration time.Duration, messages []chatMessage) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("WEBVTT\n\n")
+	for _, m := range messages {
+		text := vttEscape(m.text)
+		if text == "" {
+			continue
+		}
+		d := m.time.Sub(start)
+		if duration > 0 && d > duration {
+			d = duration - chatCueDuration
+		}
+		if d < 0 {
+			d = 0
+		}
+		username := vttEscape(sanitizeTrackName(m.username))
+		if m.action {
+			text = "<i>" + username + " " + text + "</i>"
+		}
+		fmt.Fprintf(&buf, "%v --> %v\n",
+			vttTime(d), vttTime(d+chatCueDuration))
+		if username != "" {
+			fmt.Fprintf(&buf, "<v %v>", username)
+		}
+		buf.WriteString(text)
+		buf.WriteString("\n\n")
+	}
+	return buf.Bytes()
+}
+
+// writeTranscript writes the chat transcript of a recording.
+func writeTranscript(recording string, data []byte) error {
+	return writeSidecar(transcriptName(recording), data)
+}
+
+// writeSidecar writes a file next to a recording.  It is written to
+// a temporary file which is then renamed, and it is encrypted if
+// recordings are.
+func writeSidecar(filename string, data []byte) error {
+	f, err := os.OpenFile(filename+".part",
+		os.O_RDWR|os.O_CREATE|os.O_TRUNC, FileMode)
+	if err != nil {
+		return err
+	}
+	var w diskFile = f
+	if EncryptionKey != nil {
+		w, err = newEncryptedFile(f, EncryptionKey)
+		if err != nil {
+			f.Close()
+			os.Remove(filename + ".part")
+			return err
+		}
+	}
+	_, err = w.Write(data)
+	err2 := w.Close()
+	if err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(filename+".part", filename)
+	}
+	if err != nil {
+		os.Remove(filename + ".part")
+		return err
+	}
+	return nil
+}
+
+// addChat records a chat message, which is written out when the current
+// file is closed.  Messages received before the first keyframe are kept
+// until a file is opened.
+func (conn *diskConn) addChat(m chatMessage) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if conn.stopped {
+		return
+	}
+	conn.chat = append(conn.chat, m)
+}
+
+// finishTranscript writes the chat transcript of the current files next
+// to file, which is the first of them.  Called locked.
+func (conn *diskConn) finishTranscript(file *webmFile) {
+	if len(conn.chat) == 0 {
+		return
+	}
+	messages := conn.chat
+	conn.chat = nil
+	recording := recordingName(file)
+	if file.Err() != nil || recording == "" {
+		return
+	}
+
+	var duration int64
+	for _, f := range conn.files {
+		if f.lastTime > duration {
+			duration = f.lastTime
+		}
+	}
+	err := writeTranscript(recording, formatTranscript(
+		conn.start, time.Duration(duration)*time.Millisecond, messages,
+	))
+	if err != nil {
+		conn.warn("Write chat transcript: " + err.Error())
+	}
+}
@@ -0,0 +1,106 @@
+package diskwriter
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/jech/galene/group"
+)
+
+// the codecs, as named in group descriptions, that can be recorded
+var recordableCodecs = map[string]bool{
+	"vp8": true, "vp9": true, "h264": true,
+	"opus": true, "g722": true, "pcmu": true, "pcma": true,
+}
+
+// Check verifies, without recording anything, that the recordings of the
+// named group can be written.  It creates the group's directory if
+// necessary, creates and removes a test file, and checks the free disk
+// space and the group's codecs.  It returns the directory where the
+// recordings are stored, which is empty if recordings are sent to Sink,
+// and the problems found.
+func Check(name string) (string, []error) {
+	var problems []error
+
+	desc, err := group.GetDescription(name)
+	if err != nil {
+		return "", []error{fmt.Errorf("group %v: %w", name, err)}
+	}
+	if !desc.AllowRecording {
+		problems = append(problems,
+			errors.New("recording is not allowed in this group"))
+	}
+	for _, codec := range desc.Codecs {
+		if !recordableCodecs[strings.ToLower(codec)] {
+			problems = append(problems,
+				fmt.Errorf("codec %v cannot be recorded", codec))
+		}
+	}
+
+	if Sink != nil {
+		if EncryptionKey != nil {
+			problems = append(problems, errors.New(
+				"cannot encrypt recordings sent to a sink",
+			))
+		}
+		return "", problems
+	}
+	if Directory == "" {
+		return "", append(problems,
+			errors.New("no recordings directory configured"))
+	}
+
+	directory, err := GroupDirectory(name)
+	if err != nil {
+		return "", append(problems, err)
+	}
+	err = os.MkdirAll(directory, DirMode)
+	if err != nil {
+		return directory, append(problems, err)
+	}
+
+	err = checkWrite(directory)
+	if err != nil {
+		problems = append(problems, err)
+	}
+
+	err = checkFreeSpace(directory)
+	if err != nil {
+		problems = append(problems, err)
+	}
+
+	return directory, problems
+}
+
+// checkWrite creates a file in directory, writes to it, and removes it.
+// The file is hidden and ends in ".part", so that it is not taken for
+// a recording if it cannot be removed.
+func checkWrite(directory string) error {
+	f, err := ioutil.TempFile(directory, ".check-*.part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	var file diskFile = f
+	if EncryptionKey != nil {
+		ef, err := newEncryptedFile(f, EncryptionKey)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		file = ef
+	}
+	_, err = file.Write(make([]byte, 4096))
+	if err == nil {
+		err = file.Sync()
+	}
+	err2 := file.Close()
+	if err == nil {
+		err = err2
+	}
+	return err
+}
@@ -0,0 +1,64 @@
+package diskwriter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jech/galene/group"
+)
+
+func TestCheck(t *testing.T) {
+	groups := testDirectory(t)
+	defer os.RemoveAll(groups)
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	saved := group.Directory
+	group.Directory = groups
+	defer func() {
+		group.Directory = saved
+	}()
+	Directory = dir
+	defer func() {
+		Directory = ""
+	}()
+
+	for name, desc := range map[string]string{
+		"good":   `{"allow-recording": true, "codecs": ["vp8", "opus"]}`,
+		"bad":    `{"codecs": ["av1"]}`,
+		"escape": `{"allow-recording": true, "recording-directory": "../x"}`,
+	} {
+		err := ioutil.WriteFile(
+			filepath.Join(groups, name+".json"), []byte(desc), 0600,
+		)
+		if err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	directory, problems := Check("good")
+	if len(problems) != 0 || directory != filepath.Join(dir, "good") {
+		t.Errorf("good: got %v %v", directory, problems)
+	}
+	fis, err := ioutil.ReadDir(directory)
+	if err != nil || len(fis) != 0 {
+		t.Errorf("good: unexpected files %v (%v)", fis, err)
+	}
+
+	_, problems = Check("bad")
+	if len(problems) != 2 {
+		t.Errorf("bad: expected 2 problems, got %v", problems)
+	}
+
+	_, problems = Check("escape")
+	if len(problems) != 1 {
+		t.Errorf("escape: expected 1 problem, got %v", problems)
+	}
+
+	_, problems = Check("missing")
+	if len(problems) != 1 {
+		t.Errorf("missing: expected 1 problem, got %v", problems)
+	}
+}
@@ -0,0 +1,148 @@
+package diskwriter
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// MaxDataMessageSize is the maximum size in bytes of a recorded data
+// channel message.  Larger messages are dropped.
+var MaxDataMessageSize = 16 * 1024
+
+// MaxDataRate is the maximum number of data channel messages recorded per
+// second for each connection, 0 means unlimited.
+var MaxDataRate = 20
+
+// the maximum total size of the data channel messages of a single file,
+// which are kept in memory until it is closed
+const maxDataBytes = 16 * 1024 * 1024
+
+// dataMessage is a data channel message received during a recording.
+type dataMessage struct {
+	time    time.Time
+	channel string
+	data    []byte
+	text    bool
+}
+
+// dataRecord is a line of the data channel log of a recording.  Binary
+// messages are encoded in base64.
+type dataRecord struct {
+	Time    float64 `json:"time"`
+	Channel string  `json:"channel"`
+	Data    string  `json:"data"`
+	Binary  bool    `json:"binary,omitempty"`
+}
+
+// dataName returns the name of the data channel log of a recording.
+func dataName(recording string) string {
+	return strings.TrimSuffix(recording, filepath.Ext(recording)) +
+		".data.jsonl"
+}
+
+// formatData formats data channel messages as JSON lines, with times in
+// seconds relative to start.  Messages received outside the recording are
+// moved to its beginning or its end.
+func formatData(start time.Time, duration time.Duration, messages []dataMessage) []byte {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, m := range messages {
+		d := m.time.Sub(start)
+		if duration > 0 && d > duration {
+			d = duration
+		}
+		if d < 0 {
+			d = 0
+		}
+		r := dataRecord{
+			Time:    d.Seconds(),
+			Channel: m.channel,
+		}
+		if m.text {
+			r.Data = string(m.data)
+		} else {
+			r.Data = base64.StdEncoding.EncodeToString(m.data)
+			r.Binary = true
+		}
+		// this cannot fail, and terminates each record with a newline
+		encoder.Encode(r)
+	}
+	return buf.Bytes()
+}
+
+// WriteData records a data channel message of the remote connection if
+// the group's data channels are recorded.  The messages are written out
+// when the current file is closed.
+func (conn *diskConn) WriteData(channel string, data []byte, text bool) error {
+	if !conn.client.group.RecordDataChannels() {
+		return nil
+	}
+	conn.addData(dataMessage{
+		time:    time.Now(),
+		channel: channel,
+		data:    append([]byte(nil), data...),
+		text:    text,
+	})
+	return nil
+}
+
+// addData records a data channel message, subject to MaxDataMessageSize
+// and MaxDataRate.  Messages received before the first keyframe are kept
+// until a file is opened.
+func (conn *diskConn) addData(m dataMessage) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if conn.stopped || conn.paused {
+		return
+	}
+
+	if m.time.Sub(conn.dataWindow) >= time.Second {
+		conn.dataWindow = m.time
+		conn.dataCount = 0
+	}
+	if len(m.data) > MaxDataMessageSize {
+		conn.warn("Data channel message too large, not recorded")
+		return
+	}
+	if (MaxDataRate > 0 && conn.dataCount >= MaxDataRate) ||
+		conn.dataBytes+len(m.data) > maxDataBytes {
+		conn.warn("Too many data channel messages, not recorded")
+		return
+	}
+	conn.dataCount++
+	conn.dataBytes += len(m.data)
+	conn.data = append(conn.data, m)
+}
+
+// finishData writes the data channel log of the current files next to
+// file, which is the first of them.  Called locked.
+func (conn *diskConn) finishData(file *webmFile) {
+	if len(conn.data) == 0 {
+		return
+	}
+	messages := conn.data
+	conn.data = nil
+	conn.dataBytes = 0
+	recording := recordingName(file)
+	if file.Err() != nil || recording == "" {
+		return
+	}
+
+	var duration int64
+	for _, f := range conn.files {
+		if f.lastTime > duration {
+			duration = f.lastTime
+		}
+	}
+	err := writeSidecar(dataName(recording), formatData(
+		conn.start, time.Duration(duration)*time.Millisecond, messages,
+	))
+	if err != nil {
+		conn.warn("Write data channel log: " + err.Error())
+	}
+}
@@ -0,0 +1,157 @@
+package diskwriter
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jech/galene/group"
+)
+
+// AllowedDirectories are the directories, in addition to Directory,
+// below which a group's description may place its recordings.
+var AllowedDirectories []string
+
+// relativePath returns the path of file relative to dir, and false if
+// file is not dir or below it.
+func relativePath(dir, file string) (string, bool) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+	file, err = filepath.Abs(file)
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(dir, file)
+	if err != nil || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// belowRoots returns true if path is strictly below Directory or one of
+// AllowedDirectories.
+func belowRoots(path string) bool {
+	roots := append([]string{Directory}, AllowedDirectories...)
+	for _, root := range roots {
+		if root == "" {
+			continue
+		}
+		rel, ok := relativePath(root, path)
+		if ok && rel != "." {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveDirectory resolves the recording directory specified in a
+// group's description, which is either absolute or relative to
+// Directory.  Directories that are not below Directory or one of
+// AllowedDirectories are rejected.
+func resolveDirectory(directory string) (string, error) {
+	d := filepath.FromSlash(directory)
+	if !filepath.IsAbs(d) {
+		d = filepath.Join(Directory, d)
+	}
+	d = filepath.Clean(d)
+	if !belowRoots(d) {
+		return "", fmt.Errorf(
+			"recording directory %v is not allowed", directory,
+		)
+	}
+	return d, nil
+}
+
+// GroupDirectory returns the directory where the recordings of a group
+// are stored.  This is below Directory, unless the group's description
+// specifies a different directory.
+func GroupDirectory(name string) (string, error) {
+	directory, err := groupDirectory(name)
+	if err != nil {
+		return "", err
+	}
+	var override string
+	if g := group.Get(name); g != nil {
+		override = g.RecordingDirectory()
+	} else if desc, err := group.GetDescription(name); err == nil {
+		override = desc.RecordingDirectory
+	}
+	if override == "" {
+		return directory, nil
+	}
+	return resolveDirectory(override)
+}
+
+// groupDirectories returns a map from the recording directories of the
+// running groups and of the groups that have a description file to the
+// names of the groups.
+func groupDirectories() map[string]string {
+	names := group.GetNames()
+	descs, err := group.GetDescriptionNames()
+	if err != nil {
+		log.Printf("Get group names: %v", err)
+	}
+	names = append(names, descs...)
+	// a directory shared by multiple groups belongs to the first one
+	sort.Strings(names)
+
+	dirs := make(map[string]string)
+	for _, name := range names {
+		dir, err := GroupDirectory(name)
+		if err != nil {
+			continue
+		}
+		if _, ok := dirs[dir]; !ok {
+			dirs[dir] = name
+		}
+	}
+	return dirs
+}
+
+// walkGroups walks the recording directories of the known groups and
+// calls walk with the name of the group each file belongs to.  A
+// subdirectory that is the recording directory of a different group is
+// only walked on behalf of that group.
+func walkGroups(walk func(name, path string, fi os.FileInfo, err error) error) {
+	dirs := groupDirectories()
+	for dir, name := range dirs {
+		dir, name := dir, name
+		filepath.Walk(dir,
+			func(path string, fi os.FileInfo, err error) error {
+				if err == nil && fi.IsDir() && path != dir {
+					if _, ok := dirs[path]; ok {
+						return filepath.SkipDir
+					}
+				}
+				return walk(name, path, fi, err)
+			},
+		)
+	}
+}
+
+// relativeName returns the name of a recording of the named group
+// relative to Directory, with slashes as separators.  A recording stored
+// outside Directory is named as if it were stored in the group's default
+// directory.
+func relativeName(name, filename string) (string, error) {
+	rel, ok := relativePath(Directory, filename)
+	if ok {
+		return filepath.ToSlash(rel), nil
+	}
+	dir, err := GroupDirectory(name)
+	if err != nil {
+		return "", err
+	}
+	rel, ok = relativePath(dir, filename)
+	if !ok {
+		return "", errors.New("file is not in the recordings directory")
+	}
+	return name + "/" + filepath.ToSlash(rel), nil
+}
@@ -1,7 +1,9 @@
 package diskwriter
 
 import (
+	"context"
 	crand "crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -9,28 +11,217 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
+	"unicode"
 
 	"github.com/at-wat/ebml-go/webm"
 	"github.com/pion/rtp"
 	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
 	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
 
 	"github.com/jech/galene/conn"
 	"github.com/jech/galene/group"
+	"github.com/jech/galene/jitter"
+	"github.com/jech/galene/rtptime"
+	"github.com/jech/galene/stats"
 )
 
 var Directory string
 
+// DirMode and FileMode are the permissions of the directories and files
+// created for recordings.  The process's umask still applies.
+var DirMode os.FileMode = 0700
+var FileMode os.FileMode = 0600
+
+// SyncInterval, if not zero, is the interval at which recordings are
+// flushed to stable storage.
+var SyncInterval time.Duration
+
+// BufferSize is the size of the buffer used when writing recordings.
+// Zero disables buffering.
+var BufferSize = 64 * 1024
+
+// MaxBitrate is the maximum bitrate of the video recorded, in bits per
+// second, unless overridden with SetMaxBitrate.  Zero means unlimited.
+// It is only used to select among the video tracks of a connection, such
+// as the layers of a simulcast sender, and never lowers the bitrate
+// requested from senders, which would degrade the video received by the
+// other participants.
+var MaxBitrate uint64
+
+// VideoLabel, if not empty, selects the video track to record when
+// a connection carries multiple video tracks, such as the layers of
+// a simulcast sender.  If no track has this label, the track with the
+// highest bitrate is recorded.
+var VideoLabel string
+
+// selectDelay is the time after which the video track of a connection
+// is selected again if the bitrates of its tracks were not known when
+// the connection was pushed.
+var selectDelay = 2 * time.Second
+
+// Subdirectory, if not empty, causes recordings to be stored in
+// a subdirectory of the group's directory.  It is either "user", for one
+// subdirectory per username, or "connection", for one subdirectory per
+// connection.
+var Subdirectory string
+
+// FilenameTemplate, if not empty, is a text/template that is used to
+// build the names of recordings, relative to the group's directory and
+// without the extension.  It may refer to the fields .Group, .Label,
+// .Id, .Time and .Counter.
+var FilenameTemplate string
+
+// UTCFilenames, if true, causes the times in the names of recordings to
+// be expressed in UTC rather than local time, so that they sort
+// consistently across timezones and daylight saving time changes.
+var UTCFilenames bool
+
+// FilenameAttempts is the number of values of the counter that are tried
+// when the name of a new recording is already taken, even with the
+// connection's id appended.  Once they are exhausted, a random suffix is
+// appended to the name instead.
+var FilenameAttempts = 100
+
+// KeyframeInterval is the interval at which keyframes are requested
+// from the video tracks being recorded.  Zero disables periodic requests.
+var KeyframeInterval = 10 * time.Second
+
+// MaxFileSize is the size above which a new recording file is started
+// at the next keyframe.  Zero means no limit.
+var MaxFileSize int64
+
+// SegmentDuration is the duration after which a new recording file is
+// started at the next keyframe.  Zero means no limit.
+var SegmentDuration time.Duration
+
+// DTXThreshold is the length above which a gap in a recorded Opus track,
+// typically caused by discontinuous transmission, is filled with
+// silence, so that players that ignore timestamps remain synchronised
+// with video.  Shorter gaps are assumed to be packet loss, which the
+// decoder conceals.  Zero disables filling.
+var DTXThreshold = 100 * time.Millisecond
+
+// WarnInterval is the minimum interval between two identical warnings
+// about a recording sent to the operators.  Distinct warnings are always
+// sent.  Zero disables throttling.
+var WarnInterval = 10 * time.Second
+
+// SeparateTracks, if true, causes each track to be recorded in its own
+// file.  The files of a recording share the same name followed by the
+// name of the track, and the same time origin, so that they can be
+// remuxed later.
+var SeparateTracks bool
+
+// Username is the username of the recording clients created by Start.
+var Username = "RECORDING"
+
+// MaxRecordings is the maximum number of connections that may be recorded
+// simultaneously across all groups.  Zero means unlimited.
+var MaxRecordings int
+
+// AlignStart, if true, causes a recording with video to start at the
+// first video keyframe, so that all tracks start together; the audio
+// received until then is buffered, and the audio that precedes the
+// keyframe is dropped.  Otherwise, the recording starts with the first
+// audio sample, and the video starts later.  Audio-only recordings are
+// not affected.
+var AlignStart = true
+
+// AudioDepth and VideoDepth are the number of packets held by the sample
+// builders of audio and video tracks respectively.  A deeper builder
+// tolerates more reordering and later retransmissions, which reduces
+// gaps on lossy networks, at the cost of memory and of the delay before
+// samples are written.  Values are clamped to between 1 and 65535.
+var AudioDepth = 16
+var VideoDepth = 128
+
+// builderDepth returns the depth of a sample builder, clamped to the
+// range of the sample builder.
+func builderDepth(depth int) uint16 {
+	if depth < 1 {
+		return 1
+	}
+	if depth > 0xFFFF {
+		return 0xFFFF
+	}
+	return uint16(depth)
+}
+
+var errTooManyRecordings = errors.New("too many simultaneous recordings")
+
+// recordings is the number of connections being recorded, in total and
+// in each group.
+var recordings struct {
+	mu     sync.Mutex
+	count  int
+	groups map[string]int
+}
+
+// Recordings returns the number of connections being recorded.
+func Recordings() int {
+	recordings.mu.Lock()
+	defer recordings.mu.Unlock()
+	return recordings.count
+}
+
+// acquireRecording increments the number of recorded connections, and
+// returns false if MaxRecordings or the group's limit has been reached.
+// The group's limit applies to all of its recording clients.
+func acquireRecording(g *group.Group) bool {
+	limit := g.MaxRecordings()
+
+	recordings.mu.Lock()
+	defer recordings.mu.Unlock()
+	if MaxRecordings > 0 && recordings.count >= MaxRecordings {
+		return false
+	}
+	if limit > 0 && recordings.groups[g.Name()] >= limit {
+		return false
+	}
+	recordings.count++
+	if recordings.groups == nil {
+		recordings.groups = make(map[string]int)
+	}
+	recordings.groups[g.Name()]++
+	return true
+}
+
+func releaseRecording(g *group.Group) {
+	recordings.mu.Lock()
+	defer recordings.mu.Unlock()
+	recordings.count--
+	recordings.groups[g.Name()]--
+	if recordings.groups[g.Name()] <= 0 {
+		delete(recordings.groups, g.Name())
+	}
+}
+
 type Client struct {
-	group *group.Group
-	id    string
+	// the maximum bitrate, accessed atomically.  This must come first
+	// in order to ensure 64-bit alignment.
+	maxBitrate uint64
+
+	group     *group.Group
+	id        string
+	name      string
+	username  string
+	audioOnly bool
 
 	mu     sync.Mutex
 	down   map[string]*diskConn
 	closed bool
+	paused bool
+
+	// the value of isRecording last reported to the group
+	recording bool
 }
 
 func newId() string {
@@ -39,8 +230,225 @@ func newId() string {
 	return hex.EncodeToString(b)
 }
 
-func New(g *group.Group) *Client {
-	return &Client{group: g, id: newId()}
+// New creates a new recording client with the given username.  If
+// audioOnly is true, video tracks are not recorded.
+func New(g *group.Group, username string, audioOnly bool) *Client {
+	return &Client{
+		maxBitrate: MaxBitrate,
+		group:      g,
+		id:         newId(),
+		username:   username,
+		audioOnly:  audioOnly,
+	}
+}
+
+// SetMaxBitrate sets the maximum bitrate of the video recorded by the
+// client, in bits per second, which defaults to MaxBitrate.  Zero means
+// unlimited.  It applies to the connections pushed afterwards.
+func (client *Client) SetMaxBitrate(rate uint64) {
+	atomic.StoreUint64(&client.maxBitrate, rate)
+}
+
+// Options are the settings of a recorder.
+type Options struct {
+	// Name identifies the recorder within its group.  The recorder
+	// started by Start has an empty name.
+	Name string
+	// MaxBitrate is the maximum bitrate of the video recorded, in bits
+	// per second.  Zero means unlimited.
+	MaxBitrate uint64
+	// AudioOnly, if true, causes video tracks not to be recorded.
+	AudioOnly bool
+}
+
+// Start starts recording a group with the default recorder, whose
+// settings are taken from MaxBitrate and from the group's description.
+func Start(g *group.Group) (*Client, error) {
+	return StartRecorder(g, Options{
+		MaxBitrate: MaxBitrate,
+		AudioOnly:  g.RecordAudioOnly(),
+	})
+}
+
+// findRecorder returns the recorder of a group with the given name, or
+// nil if there is none.
+func findRecorder(g *group.Group, name string) *Client {
+	for _, c := range g.GetClients(nil) {
+		client, ok := c.(*Client)
+		if ok && client.name == name {
+			return client
+		}
+	}
+	return nil
+}
+
+// recorderMessage returns a message announcing a change in the state of
+// the named recorder.
+func recorderMessage(name, message string) string {
+	if name == "" {
+		return message
+	}
+	return fmt.Sprintf("%v (%v)", message, name)
+}
+
+// StartRecorder starts recording a group with a recorder with the given
+// options.  Multiple recorders may record a group simultaneously, each
+// to its own files and with its own settings, as long as their names
+// are distinct.
+func StartRecorder(g *group.Group, options Options) (*Client, error) {
+	if findRecorder(g, options.Name) != nil {
+		return nil, group.UserError("already recording")
+	}
+
+	client := New(g, Username, options.AudioOnly)
+	client.name = options.Name
+	client.SetMaxBitrate(options.MaxBitrate)
+	_, err := group.AddClient(g.Name(), client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	notify(g, recorderMessage(options.Name, "Recording started"))
+
+	go func() {
+		for _, c := range g.GetClients(client) {
+			r, ok := c.(group.ConnRequester)
+			if ok {
+				r.RequestConns(client, g)
+			}
+		}
+	}()
+	return client, nil
+}
+
+// Shutdown stops all recordings and finalises their files, and is meant
+// to be called when the server terminates.  It returns ctx.Err() if ctx
+// is done before all files are finalised; files that are not finalised
+// keep their ".part" suffix.
+func Shutdown(ctx context.Context) error {
+	var clients []*Client
+	for _, name := range group.GetNames() {
+		g := group.Get(name)
+		if g == nil {
+			continue
+		}
+		for _, c := range g.GetClients(nil) {
+			client, ok := c.(*Client)
+			if ok {
+				clients = append(clients, client)
+			}
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, client := range clients {
+			wg.Add(1)
+			go func(client *Client) {
+				defer wg.Done()
+				client.Close()
+				group.DelClient(client)
+			}(client)
+		}
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stop stops the recorder of a group with the given name, which is
+// empty for the recorder started by Start.  The other recorders are not
+// affected.  It returns the number of connections that were being
+// recorded.
+func Stop(g *group.Group, name string) int {
+	client := findRecorder(g, name)
+	if client == nil {
+		return 0
+	}
+	client.mu.Lock()
+	count := len(client.down)
+	client.mu.Unlock()
+	client.Close()
+	group.DelClient(client)
+	notify(g, recorderMessage(name, "Recording stopped"))
+	return count
+}
+
+// notify informs the users of a group of a change in recording state,
+// unless the group is configured for silent recording.
+func notify(g *group.Group, message string) {
+	if g.SilentRecording() {
+		return
+	}
+	g.Wall(message)
+}
+
+// SetPaused pauses or resumes the recording of a group.
+func SetPaused(g *group.Group, paused bool) error {
+	found := false
+	for _, c := range g.GetClients(nil) {
+		client, ok := c.(*Client)
+		if ok {
+			client.SetPaused(paused)
+			found = true
+		}
+	}
+	if !found {
+		return group.UserError("not recording")
+	}
+	return nil
+}
+
+// SetPaused pauses or resumes recording.  Samples received while paused
+// are dropped, and the pause appears as a gap in the recording, so that
+// its timestamps keep matching wall-clock time.
+func (client *Client) SetPaused(paused bool) {
+	client.mu.Lock()
+	client.paused = paused
+	conns := make([]*diskConn, 0, len(client.down))
+	for _, down := range client.down {
+		conns = append(conns, down)
+	}
+	client.mu.Unlock()
+
+	for _, down := range conns {
+		down.setPaused(paused)
+	}
+	client.updateRecording()
+}
+
+// IsRecording returns true if some connections are being recorded.
+func (client *Client) IsRecording() bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.isRecording()
+}
+
+// called locked
+func (client *Client) isRecording() bool {
+	return !client.closed && !client.paused && len(client.down) > 0
+}
+
+// updateRecording notifies the group's clients if the value of
+// IsRecording has changed.  The notification is asynchronous, since
+// clients call IsRecording in response.
+func (client *Client) updateRecording() {
+	client.mu.Lock()
+	recording := client.isRecording()
+	changed := recording != client.recording
+	client.recording = recording
+	client.mu.Unlock()
+
+	if changed {
+		go client.group.RecordingChanged()
+	}
 }
 
 func (client *Client) Group() *group.Group {
@@ -52,15 +460,25 @@ func (client *Client) Id() string {
 }
 
 func (client *Client) Username() string {
-	return "RECORDING"
+	return client.username
+}
+
+// Name returns the name of the recorder, which is empty for the recorder
+// started by Start.
+func (client *Client) Name() string {
+	return client.name
 }
 
+// Challenge always fails: a recording client has no credentials, it is
+// admitted by OverridePermissions or not at all.
 func (client *Client) Challenge(group string, cred group.ClientCredentials) bool {
-	return true
+	return false
 }
 
+// OverridePermissions admits the client into groups that allow
+// recording.  In other groups, the permission check rejects it.
 func (client *Client) OverridePermissions(g *group.Group) bool {
-	return true
+	return g.AllowRecording()
 }
 
 func (client *Client) SetPermissions(perms group.ClientPermissions) {
@@ -71,12 +489,61 @@ func (client *Client) PushClient(id, username string, add bool) error {
 	return nil
 }
 
+// PushChat records a public chat message if the group's chat is
+// recorded.
+func (client *Client) PushChat(id, username string, tm int64, kind string, value interface{}) error {
+	if !client.group.RecordChat() {
+		return nil
+	}
+	text, ok := value.(string)
+	if !ok || (kind != "" && kind != "me") {
+		return nil
+	}
+	m := chatMessage{
+		time:     group.FromJSTime(tm),
+		username: username,
+		action:   kind == "me",
+		text:     text,
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	for _, down := range client.down {
+		down.addChat(m)
+	}
+	return nil
+}
+
+// GetStats returns the connections being recorded and their reception
+// statistics.
+func (client *Client) GetStats() *stats.Client {
+	cs := &stats.Client{Id: client.id}
+	for _, s := range client.Stats() {
+		conns := stats.Conn{Id: s.Id}
+		for _, t := range s.Tracks {
+			expected := t.Packets
+			if expected == 0 {
+				expected = 1
+			}
+			conns.Tracks = append(conns.Tracks, stats.Track{
+				Loss:   uint8(t.Lost * 100 / expected),
+				Jitter: t.Jitter,
+			})
+		}
+		cs.Down = append(cs.Down, conns)
+	}
+	return cs
+}
+
 func (client *Client) Close() error {
+	defer client.updateRecording()
+
 	client.mu.Lock()
 	defer client.mu.Unlock()
 
 	for _, down := range client.down {
 		down.Close()
+		releaseRecording(client.group)
 	}
 	client.down = nil
 	client.closed = true
@@ -86,6 +553,7 @@ func (client *Client) Close() error {
 func (client *Client) Kick(id, user, message string) error {
 	err := client.Close()
 	group.DelClient(client)
+	notify(client.group, recorderMessage(client.name, "Recording stopped"))
 	return err
 }
 
@@ -94,25 +562,74 @@ func (client *Client) PushConn(g *group.Group, id string, up conn.Up, tracks []c
 		return nil
 	}
 
+	// this runs after the lock is released
+	defer client.updateRecording()
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	return client.pushConn(g, id, up, tracks, label)
+}
+
+// reselect selects the video track of down again once the bitrates of
+// its tracks are known, and restarts its recording if a different track
+// is selected.
+func (client *Client) reselect(g *group.Group, down *diskConn, tracks []conn.UpTrack, label string) {
+	defer client.updateRecording()
+
 	client.mu.Lock()
 	defer client.mu.Unlock()
 
+	id := down.remote.Id()
+	if client.closed || client.down[id] != down {
+		return
+	}
+	video, _ := selectVideo(tracks, atomic.LoadUint64(&client.maxBitrate))
+	if video == down.video {
+		return
+	}
+	client.pushConn(g, id, down.remote, tracks, label)
+}
+
+// called locked
+func (client *Client) pushConn(g *group.Group, id string, up conn.Up, tracks []conn.UpTrack, label string) error {
 	if client.closed {
 		return errors.New("disk client is closed")
 	}
 
+	// the connection may have been renegotiated with different tracks
+	// or codecs, so the old recording is finalised and a new one is
+	// started in a new file
 	old := client.down[id]
 	if old != nil {
 		old.Close()
 		delete(client.down, id)
+		releaseRecording(client.group)
 	}
 
 	if up == nil {
+		if old != nil {
+			client.addChapter(old.remote, "left")
+		}
 		return nil
 	}
 
-	directory := filepath.Join(Directory, client.group.Name())
-	err := os.MkdirAll(directory, 0700)
+	directory, err := GroupDirectory(client.group.Name())
+	if err != nil {
+		g.WallOps("Write to disk: " + err.Error())
+		return err
+	}
+	switch Subdirectory {
+	case "user":
+		_, username := up.User()
+		if username == "" {
+			username = up.Id()
+		}
+		directory = filepath.Join(directory, sanitizeFilename(username))
+	case "connection":
+		directory = filepath.Join(directory, sanitizeFilename(up.Id()))
+	}
+	err = os.MkdirAll(directory, DirMode)
 	if err != nil {
 		g.WallOps("Write to disk: " + err.Error())
 		return err
@@ -122,154 +639,817 @@ func (client *Client) PushConn(g *group.Group, id string, up conn.Up, tracks []c
 		client.down = make(map[string]*diskConn)
 	}
 
-	down, err := newDiskConn(client, directory, label, up, tracks)
+	_, username := up.User()
+	name := username
+	if name == "" {
+		name = up.Id()
+	}
+	// a recording that starts with little space left is bound to fail
+	// partway through
+	err = checkFreeSpace(directory)
+	if err != nil {
+		g.WallOps("Not enough disk space, not recording " + name)
+		return err
+	}
+	if !acquireRecording(client.group) {
+		g.WallOps("Too many recordings, not recording " + name)
+		return errTooManyRecordings
+	}
+	down, err := newDiskConn(client, directory, label, username, up, tracks)
 	if err != nil {
+		releaseRecording(client.group)
 		g.WallOps("Write to disk: " + err.Error())
 		return err
 	}
+	down.setPaused(client.paused)
 
 	client.down[up.Id()] = down
+	if old == nil {
+		client.addChapter(up, "joined")
+	}
+	if down.provisional {
+		time.AfterFunc(selectDelay, func() {
+			client.reselect(g, down, tracks, label)
+		})
+	}
 	return nil
 }
 
+// addChapter marks an event concerning the sender of up in the
+// recordings of the other connections.  Called locked.
+func (client *Client) addChapter(up conn.Up, event string) {
+	_, username := up.User()
+	if username == "" {
+		username = up.Id()
+	}
+	title := username + " " + event
+	for id, down := range client.down {
+		if id != up.Id() {
+			down.addChapter(title)
+		}
+	}
+}
+
+// groupDirectory returns the default directory where the recordings of
+// a group are stored.  Subgroups are stored in nested directories, but names
+// that could escape Directory are rejected.
+func groupDirectory(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, "\\\x00") ||
+		filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", errors.New("bad group name")
+	}
+	for _, c := range strings.Split(name, "/") {
+		if c == "" || c == "." || c == ".." {
+			return "", errors.New("bad group name")
+		}
+	}
+	return filepath.Join(Directory, filepath.FromSlash(name)), nil
+}
+
+// Locking: each track has a mutex that protects the state of its sample
+// builder and its timing.  The connection's mutex protects the file and
+// the state that is needed to open one, and is only taken once a sample
+// is complete.  A track's mutex is always taken before the connection's
+// mutex, and no goroutine ever holds the mutexes of two tracks.
 type diskConn struct {
 	client    *Client
 	directory string
 	label     string
-	hasVideo  bool
+	remote    conn.Up
+	tracks    []*diskTrack
+	// the number of video tracks that are not disabled
+	videoCount int
+	// the sender's username, used to name the tracks
+	username string
+	// the video track being recorded, nil if none
+	video conn.UpTrack
+	// true if video was selected before the bitrates were known
+	provisional bool
+
+	mu          sync.Mutex
+	file        *webmFile
+	fileStart   time.Time
+	lastWarning map[string]time.Time
+	// the files of the current recording, one per track if
+	// SeparateTracks is set; file is the first one
+	files []*webmFile
+	// the tracks recorded in the current files, which are all the
+	// tracks except those that cannot be described yet
+	recorded []*diskTrack
+	// the tracks of the current file, as described in its manifest
+	fileTracks []manifestTrack
+	// incremented whenever a new file is opened
+	generation uint64
+	// the generation of the last file for which a thumbnail was made
+	thumbnailGeneration uint64
+	// the estimated time of the first keyframe of the current file
+	start time.Time
+	// set when recording was stopped due to a full disk
+	stopped bool
+	// closed to stop the sync goroutine
+	syncDone chan struct{}
+	// samples waiting to be written
+	queue  *writeQueue
+	paused bool
+	// the NTP time of the start of the current file, 0 if unknown
+	originNTP uint64
+	// true if originNTP was derived from capture times
+	originCapture bool
+	// chat messages received since the current file was opened
+	chat []chatMessage
+	// data channel messages received since the current file was
+	// opened, and their total size
+	data      []dataMessage
+	dataBytes int
+	// the start of the current second, and the number of data channel
+	// messages received during it
+	dataWindow time.Time
+	dataCount  int
+}
 
-	mu            sync.Mutex
-	file          *os.File
-	remote        conn.Up
-	tracks        []*diskTrack
-	width, height uint32
-	lastWarning   time.Time
+func (conn *diskConn) setPaused(paused bool) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if conn.paused == paused {
+		return
+	}
+	conn.paused = paused
+	if !paused {
+		// resume with a keyframe
+		for _, t := range conn.tracks {
+			if strings.HasPrefix(
+				strings.ToLower(t.remote.Codec().MimeType),
+				"video/",
+			) {
+				atomic.StoreUint32(&t.kfNeeded, 1)
+			}
+		}
+	}
 }
 
-// called locked
+// warn sends a warning to the operators, unless the same warning was
+// sent less than WarnInterval ago.  Called locked.
 func (conn *diskConn) warn(message string) {
 	now := time.Now()
-	if now.Sub(conn.lastWarning) < 10*time.Second {
-		return
+	if WarnInterval > 0 {
+		last, ok := conn.lastWarning[message]
+		if ok && now.Sub(last) < WarnInterval {
+			return
+		}
+		if conn.lastWarning == nil {
+			conn.lastWarning = make(map[string]time.Time)
+		}
+		for m, t := range conn.lastWarning {
+			if now.Sub(t) >= WarnInterval {
+				delete(conn.lastWarning, m)
+			}
+		}
+		conn.lastWarning[message] = now
 	}
 	log.Println(message)
 	conn.client.group.WallOps(message)
-	conn.lastWarning = now
 }
 
-// called locked
-func (conn *diskConn) reopen() error {
+// closeWriters closes the writers of all tracks, and waits for the file
+// to be finalised.  Called locked.
+func (conn *diskConn) closeWriters() {
+	conn.queue.drain()
 	for _, t := range conn.tracks {
 		if t.writer != nil {
 			t.writer.Close()
 			t.writer = nil
 		}
 	}
+	for _, f := range conn.files {
+		<-f.done
+	}
+	for i, t := range conn.recorded {
+		if i < len(conn.fileTracks) {
+			conn.fileTracks[i].setReception(t)
+		}
+	}
+	if conn.file != nil {
+		conn.finishTranscript(conn.file)
+		conn.finishData(conn.file)
+		conn.finishLatest(conn.file)
+	}
+	for i, f := range conn.files {
+		tracks := conn.fileTracks
+		if len(conn.files) > 1 {
+			tracks = conn.fileTracks[i : i+1]
+		}
+		conn.finishFile(f, tracks)
+	}
 	conn.file = nil
+	conn.files = nil
+	conn.recorded = nil
+	conn.fileTracks = nil
+}
 
-	file, err := openDiskFile(conn.directory, conn.label)
+// finishLatest makes the group's pointer to the latest recording point at
+// file, which has just been finalised.  Recordings stored outside the
+// group's directory are ignored.  Called locked.
+func (conn *diskConn) finishLatest(file *webmFile) {
+	recording := recordingName(file)
+	if file.Err() != nil || recording == "" {
+		return
+	}
+	directory, err := GroupDirectory(conn.client.group.Name())
 	if err != nil {
-		return err
+		return
+	}
+	if _, ok := relativePath(directory, recording); !ok {
+		return
+	}
+	err = updateLatest(directory, recording)
+	if err != nil {
+		log.Printf("Update latest recording: %v", err)
 	}
-
-	conn.file = file
-	return nil
 }
 
-func (conn *diskConn) Close() error {
-	conn.remote.DelLocal(conn)
-
+// addChapter adds a chapter starting now to the current files.
+func (conn *diskConn) addChapter(title string) {
 	conn.mu.Lock()
-	tracks := make([]*diskTrack, 0, len(conn.tracks))
-	for _, t := range conn.tracks {
-		if t.writer != nil {
-			t.writer.Close()
-			t.writer = nil
-		}
-		tracks = append(tracks, t)
-	}
-	conn.mu.Unlock()
+	defer conn.mu.Unlock()
 
-	for _, t := range tracks {
-		t.remote.DelLocal(t)
+	if conn.file == nil {
+		return
+	}
+	d := time.Since(conn.fileStart)
+	if d < 0 {
+		d = 0
+	}
+	for _, f := range conn.files {
+		f.addChapter(uint64(d/time.Millisecond), title)
 	}
-	return nil
 }
 
-func openDiskFile(directory, label string) (*os.File, error) {
-	filenameFormat := "2006-01-02T15:04:05.000"
-	if runtime.GOOS == "windows" {
-		filenameFormat = "2006-01-02T15-04-05-000"
+// stopOnError stops recording if err indicates that the disk is full, and
+// returns true in that case.  Called locked.
+func (conn *diskConn) stopOnError(err error) bool {
+	if !errors.Is(err, syscall.ENOSPC) {
+		return false
 	}
+	conn.closeWriters()
+	conn.stopped = true
+	message := "Disk full, recording stopped"
+	log.Println(message)
+	conn.client.group.WallOps(message)
+	return true
+}
 
-	filename := time.Now().Format(filenameFormat)
-	if label != "" {
-		filename = filename + "-" + label
+// shouldSplit returns true if one of the current files has reached
+// MaxFileSize, or SegmentDuration has elapsed.  Called locked.
+func (conn *diskConn) shouldSplit() bool {
+	if conn.file == nil {
+		return false
 	}
-	for counter := 0; counter < 100; counter++ {
-		var fn string
-		if counter == 0 {
-			fn = fmt.Sprintf("%v.webm", filename)
-		} else {
-			fn = fmt.Sprintf("%v-%02d.webm", filename, counter)
+	for _, f := range conn.files {
+		if MaxFileSize > 0 && f.Size()+f.Queued() >= MaxFileSize {
+			return true
 		}
+	}
+	return SegmentDuration > 0 &&
+		time.Since(conn.fileStart) >= SegmentDuration
+}
 
-		fn = filepath.Join(directory, fn)
-		f, err := os.OpenFile(
-			fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600,
-		)
-		if err == nil {
-			return f, nil
-		} else if !os.IsExist(err) {
-			return nil, err
+// syncLoop periodically flushes the current file to stable storage.
+// The lock is only held while fetching the file, so that WriteRTP is
+// not blocked during the sync.
+func (conn *diskConn) syncLoop(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			conn.mu.Lock()
+			files := conn.files
+			conn.mu.Unlock()
+			for _, file := range files {
+				// this fails harmlessly if the file was
+				// closed in the meantime
+				file.Sync()
+			}
+		case <-done:
+			return
 		}
 	}
-	return nil, errors.New("couldn't create file")
 }
 
-type diskTrack struct {
-	remote conn.UpTrack
-	conn   *diskConn
-
-	writer  webm.BlockWriteCloser
-	builder *samplebuilder.SampleBuilder
+// reopen opens the files for the tracks in conn.recorded, once the
+// writers of the previous files have been closed.  Called locked.
+func (conn *diskConn) reopen() error {
+	if Sink == nil {
+		checkQuota(conn.client.group)
+	}
 
-	// bit 32 is a boolean indicating that the origin is valid
-	origin uint64
+	suffixes := []string{".webm"}
+	if conn.perTrack() {
+		suffixes = make([]string, len(conn.recorded))
+		for i, t := range conn.recorded {
+			suffixes[i] = t.extension()
+			if separateTracks() {
+				suffixes[i] = "-" + sanitizeFilename(t.name) +
+					suffixes[i]
+			}
+		}
+	}
 
-	lastKf uint32
-}
+	var fs []diskFile
+	if Sink != nil {
+		var err error
+		fs, err = openSinks(
+			conn.client.group.Name(), conn.label, suffixes,
+		)
+		if err != nil {
+			return err
+		}
+	} else {
+		files, err := openDiskFiles(conn.directory, filenameData{
+			Group: conn.client.group.Name(),
+			Label: conn.label,
+			Id:    conn.remote.Id(),
+		}, suffixes)
+		if err != nil {
+			return err
+		}
 
-func newDiskConn(client *Client, directory, label string, up conn.Up, remoteTracks []conn.UpTrack) (*diskConn, error) {
-	conn := diskConn{
-		client:    client,
-		directory: directory,
-		label:     label,
-		tracks:    make([]*diskTrack, 0, len(remoteTracks)),
-		remote:    up,
+		fs = make([]diskFile, len(files))
+		for i, file := range files {
+			fs[i] = file
+			if EncryptionKey != nil {
+				fs[i], err = newEncryptedFile(file, EncryptionKey)
+				if err != nil {
+					for _, file := range files {
+						file.Close()
+						os.Remove(file.Name())
+						delOpenFile(file.Name())
+					}
+					return err
+				}
+			}
+		}
 	}
-	for _, remote := range remoteTracks {
+
+	conn.files = make([]*webmFile, len(fs))
+	if conn.perTrack() {
+		// each file contains a single track, numbered 1
+		for i, t := range conn.recorded {
+			if t.extension() != ".webm" {
+				conn.files[i] = newRawFile(fs[i])
+			} else {
+				conn.files[i] = newWebmFile(
+					fs[i], map[uint64]bool{1: true},
+				)
+			}
+			t.file = conn.files[i]
+		}
+	} else {
+		// cue points are generated for video tracks, or for all
+		// tracks if there is no video
+		video := false
+		for _, t := range conn.recorded {
+			if isVideo(t.remote) &&
+				atomic.LoadUint32(&t.disabled) == 0 {
+				video = true
+			}
+		}
+		cueTracks := make(map[uint64]bool)
+		for i, t := range conn.recorded {
+			if !video || isVideo(t.remote) {
+				cueTracks[uint64(i+1)] = true
+			}
+		}
+		conn.files[0] = newWebmFile(fs[0], cueTracks)
+		for _, t := range conn.recorded {
+			t.file = conn.files[0]
+		}
+	}
+	conn.file = conn.files[0]
+	conn.fileStart = time.Now()
+	return nil
+}
+
+// perTrack returns true if each track is recorded in its own file, which
+// is always the case if there is a single track.
+func (conn *diskConn) perTrack() bool {
+	return separateTracks() || len(conn.recorded) == 1
+}
+
+// isRecorded returns true if t is recorded in the current files.  Called
+// locked.
+func (conn *diskConn) isRecorded(t *diskTrack) bool {
+	for _, r := range conn.recorded {
+		if r == t {
+			return true
+		}
+	}
+	return false
+}
+
+// extension returns the extension of the file in which a track is
+// recorded, which determines its container.
+func (t *diskTrack) extension() string {
+	if t.isIVF() {
+		return ".ivf"
+	}
+	if t.isOgg() {
+		return ".ogg"
+	}
+	return ".webm"
+}
+
+// closeFiles closes the files of a recording that couldn't be
+// initialised.  When each track has its own file, writers are the
+// writers of the first files, which close them.  Called locked.
+func (conn *diskConn) closeFiles(writers []webm.BlockWriteCloser) {
+	for _, w := range writers {
+		w.Close()
+	}
+	for _, f := range conn.files[len(writers):] {
+		f.Close()
+	}
+	conn.file = nil
+	conn.files = nil
+	conn.recorded = nil
+}
+
+func (conn *diskConn) Close() error {
+	conn.remote.DelLocal(conn)
+
+	for _, t := range conn.tracks {
+		t.mu.Lock()
+		t.flush()
+		t.mu.Unlock()
+	}
+
+	conn.mu.Lock()
+	conn.closeWriters()
+	conn.queue.close()
+	if conn.syncDone != nil {
+		close(conn.syncDone)
+		conn.syncDone = nil
+	}
+	tracks := make([]*diskTrack, 0, len(conn.tracks))
+	for _, t := range conn.tracks {
+		tracks = append(tracks, t)
+	}
+	conn.mu.Unlock()
+
+	for _, t := range tracks {
+		t.remote.DelLocal(t)
+	}
+	return nil
+}
+
+// filenameData is passed to FilenameTemplate.
+type filenameData struct {
+	Group   string
+	Label   string
+	Id      string
+	Time    time.Time
+	Counter int
+}
+
+// sanitizeFilename makes a user-controlled string safe for use as
+// a single component of a filename.
+func sanitizeFilename(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == filepath.Separator ||
+			r == 0 {
+			return '_'
+		}
+		return r
+	}, s)
+	if s == "." || s == ".." {
+		return "_"
+	}
+	return s
+}
+
+// sanitizeTrackName makes a user-controlled string suitable as the name
+// of a track, which must be valid UTF-8 and shouldn't contain control
+// characters.
+func sanitizeTrackName(s string) string {
+	s = strings.ToValidUTF8(s, "\uFFFD")
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+	return strings.TrimSpace(s)
+}
+
+// recordingFilename returns the name of a recording, relative to the
+// group's directory and without the extension.
+func recordingFilename(tmpl *template.Template, data filenameData) (string, error) {
+	if UTCFilenames {
+		data.Time = data.Time.UTC()
+	}
+	if tmpl == nil {
+		filenameFormat := "2006-01-02T15:04:05.000"
+		if runtime.GOOS == "windows" {
+			filenameFormat = "2006-01-02T15-04-05-000"
+		}
+		if UTCFilenames {
+			filenameFormat += "Z"
+		}
+		filename := data.Time.Format(filenameFormat)
+		if data.Label != "" {
+			filename = filename + "-" + data.Label
+		}
+		if data.Counter > 0 {
+			filename = fmt.Sprintf("%v-%02d", filename, data.Counter)
+		}
+		return filename, nil
+	}
+
+	var b strings.Builder
+	err := tmpl.Execute(&b, data)
+	if err != nil {
+		return "", err
+	}
+	return filepath.FromSlash(b.String()), nil
+}
+
+// openDiskFile creates a new recording file.  The file has a ".part"
+// suffix, which is removed when it is closed.
+func openDiskFile(directory string, data filenameData) (*os.File, error) {
+	files, err := openDiskFiles(directory, data, []string{".webm"})
+	if err != nil {
+		return nil, err
+	}
+	return files[0], nil
+}
+
+// openDiskFiles creates the files of a recording, one for each suffix,
+// which is appended to the common name of the files and includes the
+// extension.  If the name is taken, for example by another connection
+// with the same label, the id of the connection is appended to it.
+func openDiskFiles(directory string, data filenameData, suffixes []string) ([]*os.File, error) {
+	var tmpl *template.Template
+	if FilenameTemplate != "" {
+		var err error
+		tmpl, err = template.New("filename").Parse(FilenameTemplate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	data.Label = sanitizeFilename(data.Label)
+	data.Time = time.Now()
+	id := sanitizeFilename(data.Id)
+
+	create := func(filename string) ([]*os.File, error) {
+		fn := filepath.Join(directory, filename+".webm")
+		rel, err := filepath.Rel(directory, fn)
+		if err != nil || rel == ".." ||
+			strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, errors.New("bad recording filename")
+		}
+		err = os.MkdirAll(filepath.Dir(fn), DirMode)
+		if err != nil {
+			return nil, err
+		}
+		return createFiles(filepath.Join(directory, filename), suffixes)
+	}
+
+	first := ""
+	for counter := 0; counter < FilenameAttempts || counter == 0; counter++ {
+		data.Counter = counter
+		filename, err := recordingFilename(tmpl, data)
+		if err != nil {
+			return nil, err
+		}
+		if counter == 0 {
+			first = filename
+		} else if filename == first {
+			// the template doesn't use the counter
+			filename = fmt.Sprintf("%v-%02d", filename, counter)
+		}
+
+		files, err := create(filename)
+		if err == nil {
+			return files, nil
+		} else if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if counter == 0 && id != "" && !strings.Contains(first, id) {
+			// another connection, typically with the same label,
+			// started at the same time; the id makes the name
+			// distinct and tells the recordings apart
+			files, err := create(first + "-" + id)
+			if err == nil {
+				return files, nil
+			} else if !os.IsExist(err) {
+				return nil, err
+			}
+		}
+	}
+
+	// the name keeps the timestamp, so that recordings still sort
+	// chronologically
+	for i := 0; i < 10; i++ {
+		b := make([]byte, 4)
+		_, err := crand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		files, err := create(first + "-" + hex.EncodeToString(b))
+		if err == nil {
+			return files, nil
+		} else if !os.IsExist(err) {
+			return nil, err
+		}
+	}
+	return nil, errors.New("couldn't create file")
+}
+
+// createFiles creates the files of a recording with the given base name.
+// It fails with an error satisfying os.IsExist if any of the files
+// already exists, in which case no file is created.
+func createFiles(base string, suffixes []string) ([]*os.File, error) {
+	for _, suffix := range suffixes {
+		_, err := os.Stat(base + suffix)
+		if err == nil {
+			return nil, os.ErrExist
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	files := make([]*os.File, 0, len(suffixes))
+	for _, suffix := range suffixes {
+		f, err := os.OpenFile(
+			base+suffix+".part",
+			os.O_RDWR|os.O_CREATE|os.O_EXCL, FileMode,
+		)
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+				os.Remove(f.Name())
+			}
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	for _, f := range files {
+		addOpenFile(f.Name())
+	}
+	return files, nil
+}
+
+type diskTrack struct {
+	// bytes received, accessed atomically.  This must come first in
+	// order to ensure 64-bit alignment.
+	bytes uint64
+	// samples written, keyframes seen, samples dropped because the
+	// disk couldn't keep up and empty samples, accessed atomically
+	samples, keyframes, dropped, empty uint64
+	// packets expected and received, as in RFC 3550 Appendix A.3,
+	// accessed atomically
+	expected, received uint64
+	// the maximum jitter since the current file was opened, in units
+	// of the clock rate, accessed atomically
+	maxJitter uint32
+	// non-zero if the track was disabled after an error, accessed
+	// atomically
+	disabled uint32
+
+	remote conn.UpTrack
+	conn   *diskConn
+	name   string
+	// the depth of the sample builder
+	depth uint16
+
+	// mu protects the fields up to the next comment
+	mu      sync.Mutex
+	builder *samplebuilder.SampleBuilder
+	alloc   packetAllocator
+
+	// the last packet pushed into the sample builder
+	last      rtp.Header
+	lastValid bool
+
+	// audio received before the file was opened
+	preroll []prerollSample
+
+	// the value of conn.generation when origin was set
+	generation uint64
+	// bit 32 is a boolean indicating that the origin is valid
+	origin uint64
+	// the timestamp of the last sample written, and its distance
+	// from the origin, which doesn't wrap around
+	lastTs  uint32
+	elapsed int64
+	// the duration of the last Opus sample written, 0 if unknown
+	lastDuration uint32
+
+	// the mapping between RTP and NTP time from the last sender
+	// report or capture time, remoteNTP is 0 if unknown
+	remoteNTP uint64
+	remoteRTP uint32
+	// true if the mapping was derived from capture times, in which
+	// case sender reports are ignored
+	capture bool
+
+	lastKf uint32
+	// the time of the last keyframe request, zero if no keyframe was
+	// requested since the last keyframe
+	kfRequested time.Time
+
+	// for RED tracks, the last sequence number seen
+	redSeqno uint16
+	redValid bool
+
+	// the highest sequence number received, for loss statistics
+	seqno      uint16
+	seqnoValid bool
+	jitter     *jitter.Estimator
+
+	// the fields below are protected by conn.mu, since they are
+	// needed when a file is opened
+
+	writer webm.BlockWriteCloser
+	// the file that writer writes to
+	file *webmFile
+
+	// H.264 parameter sets, needed to build the CodecPrivate element
+	sps, pps []byte
+
+	// number of channels of an audio track, as seen in the data
+	channels uint16
+
+	// dimensions of a video track, 0 if not known yet
+	width, height uint32
+	// non-zero if the file was reopened or a sample was dropped
+	// since the last keyframe, accessed atomically since the write
+	// queue sets it
+	kfNeeded uint32
+	// the values of expected and received when the file was opened
+	fileExpected, fileReceived uint64
+}
+
+func newDiskConn(client *Client, directory, label, username string, up conn.Up, remoteTracks []conn.UpTrack) (*diskConn, error) {
+	conn := diskConn{
+		client:    client,
+		directory: directory,
+		label:     label,
+		username:  sanitizeTrackName(username),
+		tracks:    make([]*diskTrack, 0, len(remoteTracks)),
+		remote:    up,
+	}
+	if !client.audioOnly {
+		conn.video, conn.provisional = selectVideo(
+			remoteTracks, atomic.LoadUint64(&client.maxBitrate),
+		)
+	}
+	for _, remote := range remoteTracks {
 		var builder *samplebuilder.SampleBuilder
 		codec := remote.Codec()
+		depth := builderDepth(AudioDepth)
+		if isVideo(remote) {
+			if remote != conn.video {
+				continue
+			}
+			depth = builderDepth(VideoDepth)
+		}
 		switch strings.ToLower(codec.MimeType) {
-		case "audio/opus":
+		case "audio/opus", "audio/red":
 			builder = samplebuilder.New(
-				16, &codecs.OpusPacket{}, codec.ClockRate,
+				depth, &codecs.OpusPacket{}, codec.ClockRate,
 				samplebuilder.WithPartitionHeadChecker(
 					&codecs.OpusPartitionHeadChecker{},
 				),
 			)
+		case "audio/pcmu", "audio/pcma", "audio/g722":
+			builder = samplebuilder.New(
+				depth, rawDepacketizer{}, codec.ClockRate,
+			)
 		case "video/vp8":
-			if conn.hasVideo {
-				return nil, errors.New("multiple video tracks not supported")
-			}
 			builder = samplebuilder.New(
-				128, &codecs.VP8Packet{}, codec.ClockRate,
+				depth, &codecs.VP8Packet{}, codec.ClockRate,
 				samplebuilder.WithPartitionHeadChecker(
 					&codecs.VP8PartitionHeadChecker{},
 				),
 			)
-			conn.hasVideo = true
+			conn.videoCount++
+		case "video/vp9":
+			builder = samplebuilder.New(
+				depth, &codecs.VP9Packet{}, codec.ClockRate,
+				samplebuilder.WithPartitionHeadChecker(
+					&codecs.VP9PartitionHeadChecker{},
+				),
+			)
+			conn.videoCount++
+		case "video/h264":
+			builder = samplebuilder.New(
+				depth, &codecs.H264Packet{}, codec.ClockRate,
+			)
+			conn.videoCount++
 		default:
 			client.group.WallOps(
 				"Cannot record codec " + codec.MimeType,
@@ -279,184 +1459,1099 @@ func newDiskConn(client *Client, directory, label string, up conn.Up, remoteTrac
 		track := &diskTrack{
 			remote:  remote,
 			builder: builder,
+			depth:   depth,
 			conn:    &conn,
+			name:    conn.trackName(remote),
+			jitter:  jitter.New(codec.ClockRate),
+		}
+		conn.tracks = append(conn.tracks, track)
+		remote.AddLocal(track)
+	}
+
+	err := up.AddLocal(&conn)
+	if err != nil {
+		for _, t := range conn.tracks {
+			t.remote.DelLocal(t)
+		}
+		return nil, err
+	}
+
+	conn.queue = newWriteQueue()
+
+	if SyncInterval > 0 {
+		conn.syncDone = make(chan struct{})
+		go conn.syncLoop(SyncInterval, conn.syncDone)
+	}
+
+	return &conn, nil
+}
+
+func isVideo(t conn.UpTrack) bool {
+	return strings.HasPrefix(strings.ToLower(t.Codec().MimeType), "video/")
+}
+
+// selectVideo returns the single video track to record among tracks,
+// which is the track labelled VideoLabel if there is one, and otherwise
+// the track with the highest bitrate, the highest layer of a simulcast
+// sender, that does not exceed maxBitrate if it is not zero.  The
+// boolean is true if the selection is provisional, since the bitrates of
+// the tracks are not known yet.  The selection is made each time
+// a connection is pushed, so that another track is selected when the
+// selected one goes away.
+func selectVideo(tracks []conn.UpTrack, maxBitrate uint64) (conn.UpTrack, bool) {
+	var candidates []conn.UpTrack
+	for _, t := range tracks {
+		if isVideo(t) {
+			candidates = append(candidates, t)
+		}
+	}
+	if VideoLabel != "" {
+		for _, t := range candidates {
+			if t.Label() == VideoLabel {
+				return t, false
+			}
+		}
+	}
+
+	var best conn.UpTrack
+	var bestRate uint64
+	known := false
+	for _, t := range candidates {
+		rate := t.Bitrate()
+		if rate > 0 {
+			known = true
+		}
+		if best == nil || betterRate(rate, bestRate, maxBitrate) {
+			best = t
+			bestRate = rate
+		}
+	}
+	return best, len(candidates) > 1 && !known
+}
+
+// betterRate returns true if a track with bitrate rate should be recorded
+// rather than one with bitrate other: the highest bitrate that does not
+// exceed maxBitrate is preferred, or the lowest if both exceed it.
+func betterRate(rate, other, maxBitrate uint64) bool {
+	if maxBitrate == 0 {
+		return rate > other
+	}
+	fits, otherFits := rate <= maxBitrate, other <= maxBitrate
+	if fits != otherFits {
+		return fits
+	}
+	if fits {
+		return rate > other
+	}
+	return rate < other
+}
+
+// rawDepacketizer is used for codecs where each RTP packet carries
+// a sample that can be written to disk as-is.
+type rawDepacketizer struct{}
+
+func (rawDepacketizer) Unmarshal(packet []byte) ([]byte, error) {
+	return packet, nil
+}
+
+// trackName returns a name for a track that is distinct from the names
+// of the tracks already in conn.
+func (conn *diskConn) trackName(remote conn.UpTrack) string {
+	name := remote.Label()
+	if name == "" {
+		if strings.HasPrefix(
+			strings.ToLower(remote.Codec().MimeType), "video/",
+		) {
+			name = "Video"
+		} else {
+			name = "Audio"
+		}
+	}
+
+	unique := func(n string) bool {
+		for _, t := range conn.tracks {
+			if t.name == n {
+				return false
+			}
+		}
+		return true
+	}
+
+	if unique(name) {
+		return name
+	}
+	for i := 2; ; i++ {
+		n := fmt.Sprintf("%v-%v", name, i)
+		if unique(n) {
+			return n
+		}
+	}
+}
+
+func (t *diskTrack) SetTimeOffset(ntp uint64, rtp uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conn.mu.Lock()
+	defer t.conn.mu.Unlock()
+
+	if t.capture {
+		return
+	}
+	t.remoteNTP = ntp
+	t.remoteRTP = rtp
+	t.syncOrigin()
+}
+
+// absCaptureTime parses the payload of an abs-capture-time header
+// extension, and returns the capture time in the sender's NTP clock.
+func absCaptureTime(ext []byte) (uint64, bool) {
+	if len(ext) < 8 {
+		return 0, false
+	}
+	ntp := binary.BigEndian.Uint64(ext)
+	if ntp == 0 {
+		return 0, false
+	}
+	if len(ext) >= 16 {
+		// the estimated offset between the capture clock and the
+		// sender's clock, a signed fixed-point value
+		ntp += binary.BigEndian.Uint64(ext[8:])
+	}
+	return ntp, true
+}
+
+// captureTime uses the capture time carried by a packet, if any, to map
+// RTP time to NTP time.  Unlike sender reports, which are sent by the
+// last hop, capture times refer to a single clock for all the tracks of a
+// sender, and remain meaningful across participants.  Called with t.mu
+// held.
+func (t *diskTrack) captureTime(p *rtp.Packet) {
+	id := t.remote.HeaderExtensionID(conn.AbsCaptureTimeURI)
+	if id == 0 {
+		return
+	}
+	ntp, ok := absCaptureTime(p.GetExtension(id))
+	if !ok {
+		return
+	}
+
+	t.conn.mu.Lock()
+	defer t.conn.mu.Unlock()
+	t.remoteNTP = ntp
+	t.remoteRTP = p.Timestamp
+	t.capture = true
+	t.syncOrigin()
+}
+
+// rtpToNTP converts an RTP timestamp to NTP time.  Called locked.
+func (t *diskTrack) rtpToNTP(ts uint32) uint64 {
+	clockrate := t.remote.Codec().ClockRate
+	d := time.Duration(int32(ts-t.remoteRTP)) * time.Second /
+		time.Duration(clockrate)
+	ntp := int64(d/time.Second)<<32 +
+		int64(d%time.Second)<<32/int64(time.Second)
+	return t.remoteNTP + uint64(ntp)
+}
+
+// ntpToRTP converts an NTP time to an RTP timestamp.  Called locked.
+func (t *diskTrack) ntpToRTP(ntp uint64) uint32 {
+	clockrate := int64(t.remote.Codec().ClockRate)
+	delta := int64(ntp - t.remoteNTP)
+	// the arithmetic shift rounds the seconds down, so that the
+	// fractional part is positive
+	ts := (delta>>32)*clockrate + (delta&0xFFFFFFFF)*clockrate>>32
+	return t.remoteRTP + uint32(ts)
+}
+
+// syncOrigin anchors the origin of a track to the common NTP origin of
+// the current file, so that tracks with unrelated RTP clocks remain
+// synchronised.  If the common origin is not known yet, it is derived
+// from the track's origin.  Called with both locks held.
+func (t *diskTrack) syncOrigin() {
+	if t.remoteNTP == 0 || t.origin == 0 ||
+		t.generation != t.conn.generation {
+		return
+	}
+	if t.conn.originNTP == 0 {
+		t.conn.originNTP = t.rtpToNTP(uint32(t.origin))
+		t.conn.originCapture = t.capture
+		return
+	}
+	origin := t.ntpToRTP(t.conn.originNTP)
+	t.elapsed -= int64(int32(origin - uint32(t.origin)))
+	t.origin = uint64(origin) | (1 << 32)
+}
+
+func (t *diskTrack) SetCname(string) {
+}
+
+// packetAllocator amortises the allocation of the packets pushed into
+// the sample builder, which keeps them until their sample is complete.
+// Packets are carved out of larger chunks, which are reclaimed by the
+// garbage collector once no packet refers to them.
+type packetAllocator struct {
+	packets []rtp.Packet
+	buf     []byte
+}
+
+const allocatorPackets = 64
+const allocatorBytes = 64 * 1024
+
+// clone returns a copy of packet.  Only the fields used by the sample
+// builder are copied; in particular, CSRCs and header extensions are
+// dropped.
+func (a *packetAllocator) clone(packet *rtp.Packet) *rtp.Packet {
+	if len(a.packets) == 0 {
+		a.packets = make([]rtp.Packet, allocatorPackets)
+	}
+	p := &a.packets[0]
+	a.packets = a.packets[1:]
+
+	p.Header = rtp.Header{
+		Version:        packet.Version,
+		Marker:         packet.Marker,
+		PayloadType:    packet.PayloadType,
+		SequenceNumber: packet.SequenceNumber,
+		Timestamp:      packet.Timestamp,
+		SSRC:           packet.SSRC,
+	}
+
+	n := len(packet.Payload)
+	if n > len(a.buf) {
+		if n > allocatorBytes/4 {
+			p.Payload = append([]byte(nil), packet.Payload...)
+			return p
+		}
+		a.buf = make([]byte, allocatorBytes)
+	}
+	p.Payload = a.buf[:n:n]
+	copy(p.Payload, packet.Payload)
+	a.buf = a.buf[n:]
+	return p
+}
+
+func (t *diskTrack) WriteRTP(packet *rtp.Packet) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.builder == nil || atomic.LoadUint32(&t.disabled) != 0 {
+		return nil
+	}
+
+	t.countPacket(packet)
+	t.captureTime(packet)
+
+	if strings.EqualFold(t.remote.Codec().MimeType, "audio/red") {
+		for _, p := range t.unwrapRED(packet) {
+			t.push(p)
+		}
+	} else {
+		t.push(t.alloc.clone(packet))
+	}
+
+	return t.writeSamples()
+}
+
+// the largest jump in sequence numbers that is counted as loss, larger
+// jumps are assumed to be caused by the sender restarting
+const maxDropout = 3000
+
+// countPacket updates the loss and jitter statistics.  It is called for
+// every packet received, so it only updates a few counters.  Called
+// locked.
+func (t *diskTrack) countPacket(p *rtp.Packet) {
+	atomic.AddUint64(&t.received, 1)
+	delta := p.SequenceNumber - t.seqno
+	if !t.seqnoValid || (delta > maxDropout && delta < 0x8000) {
+		atomic.AddUint64(&t.expected, 1)
+		t.seqno = p.SequenceNumber
+		t.seqnoValid = true
+	} else if delta > 0 && delta < 0x8000 {
+		atomic.AddUint64(&t.expected, uint64(delta))
+		t.seqno = p.SequenceNumber
+	}
+
+	if t.jitter != nil {
+		t.jitter.Accumulate(p.Timestamp)
+		j := t.jitter.Jitter()
+		if j > atomic.LoadUint32(&t.maxJitter) {
+			atomic.StoreUint32(&t.maxJitter, j)
+		}
+	}
+}
+
+// lost returns the number of packets lost, or 0 if more packets were
+// received than expected, which happens when packets are duplicated.
+func lost(expected, received uint64) uint64 {
+	if received >= expected {
+		return 0
+	}
+	return expected - received
+}
+
+// jitterDuration returns the maximum jitter since the current file was
+// opened.
+func (t *diskTrack) jitterDuration() time.Duration {
+	j := atomic.LoadUint32(&t.maxJitter)
+	if j == 0 || t.jitter == nil {
+		return 0
+	}
+	return rtptime.ToDuration(uint64(j), t.jitter.HZ())
+}
+
+// push pushes a packet into the sample builder.  Called with t.mu held.
+func (t *diskTrack) push(p *rtp.Packet) {
+	t.builder.Push(p)
+	delta := p.SequenceNumber - t.last.SequenceNumber
+	if !t.lastValid || delta < 0x8000 {
+		t.last = p.Header
+		t.lastValid = true
+	}
+}
+
+// flush writes out the last sample held by the sample builder, which
+// would otherwise wait for a packet with a different timestamp.  This
+// is only done if the last packet received completes a sample, since
+// the sample builder cannot tell whether a sample is missing its tail.
+// Called with t.mu held.
+func (t *diskTrack) flush() {
+	if t.builder == nil || !t.lastValid {
+		return
+	}
+	video := strings.HasPrefix(
+		strings.ToLower(t.remote.Codec().MimeType), "video/",
+	)
+	if video && !t.last.Marker {
+		return
+	}
+
+	// an empty packet that terminates the last sample; it is never
+	// returned by the sample builder.
+	p := &rtp.Packet{Header: t.last}
+	p.SequenceNumber++
+	p.Timestamp++
+	p.Marker = false
+	t.builder.Push(p)
+
+	err := t.writeSamples()
+	if err != nil && err != conn.ErrKeyframeNeeded {
+		log.Printf("Flush recording: %v", err)
+	}
+}
+
+// prerollDuration and maxPrerollSamples bound the amount of audio that
+// is buffered while waiting for the first video keyframe.
+const prerollDuration = 2 * time.Second
+const maxPrerollSamples = 256
+
+type prerollSample struct {
+	ts   uint32
+	tm   time.Time
+	data []byte
+}
+
+// sampleTime estimates the time at which a sample was sent, using the
+// arrival of the latest packet as a reference.  Called with t.mu held.
+func (t *diskTrack) sampleTime(ts uint32) time.Time {
+	delta := t.last.Timestamp - ts
+	if (delta & 0x80000000) != 0 {
+		delta = 0
+	}
+	return time.Now().Add(
+		-rtptime.ToDuration(uint64(delta), t.remote.Codec().ClockRate),
+	)
+}
+
+// addPreroll buffers an audio sample until the file is opened.
+// Called with t.mu held.
+func (t *diskTrack) addPreroll(ts uint32, data []byte) {
+	tm := t.sampleTime(ts)
+	i := 0
+	for i < len(t.preroll) &&
+		(len(t.preroll)-i >= maxPrerollSamples ||
+			tm.Sub(t.preroll[i].tm) > prerollDuration) {
+		i++
+	}
+	t.preroll = append(t.preroll[i:], prerollSample{ts, tm, data})
+}
+
+// drainPreroll writes the audio buffered before the file was opened,
+// omitting any that precedes the first keyframe.  The time of the
+// keyframe is taken from sender reports if possible, and estimated
+// otherwise.  Called with both locks held.
+func (t *diskTrack) drainPreroll() error {
+	preroll := t.preroll
+	t.preroll = nil
+	for _, s := range preroll {
+		if t.remoteNTP != 0 && t.conn.originNTP != 0 {
+			delta := t.rtpToNTP(s.ts) - t.conn.originNTP
+			if (delta & (1 << 63)) != 0 {
+				continue
+			}
+		} else if s.tm.Before(t.conn.start) {
+			continue
+		}
+		err := t.writeSample(true, s.ts, s.data)
+		if err != nil {
+			return err
 		}
-		conn.tracks = append(conn.tracks, track)
-		remote.AddLocal(track)
 	}
+	return nil
+}
 
-	err := up.AddLocal(&conn)
+// writeSample writes a sample to the current file.  Called with both
+// locks held.
+func (t *diskTrack) writeSample(keyframe bool, ts uint32, data []byte) error {
+	if t.generation != t.conn.generation {
+		// each file starts at t=0
+		t.generation = t.conn.generation
+		t.origin = 0
+	}
+	if t.origin == 0 {
+		t.origin = uint64(ts) | (1 << 32)
+		t.lastTs = ts
+		t.elapsed = 0
+		t.lastDuration = 0
+		t.syncOrigin()
+	}
+	err := t.fillDTX(ts)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	return &conn, nil
-}
-
-func (t *diskTrack) SetTimeOffset(ntp uint64, rtp uint32) {
+	return t.writeBlock(keyframe, ts, data)
 }
 
-func (t *diskTrack) SetCname(string) {
-}
+// silence is a 20ms Opus frame that decodes to silence, for mono and
+// stereo.
+var silence = [2][]byte{{0xF8, 0xFF, 0xFE}, {0xFC, 0xFF, 0xFE}}
 
-func clonePacket(packet *rtp.Packet) *rtp.Packet {
-	buf, err := packet.Marshal()
-	if err != nil {
+// fillDTX writes silence into a gap that precedes ts in an Opus track,
+// if it is longer than DTXThreshold.  Called with both locks held.
+func (t *diskTrack) fillDTX(ts uint32) error {
+	if DTXThreshold <= 0 || t.lastDuration == 0 {
 		return nil
 	}
-	var p rtp.Packet
-	err = p.Unmarshal(buf)
-	if err != nil {
+	clockrate := t.remote.Codec().ClockRate
+	end := t.lastTs + t.lastDuration
+	gap := ts - end
+	if (gap&0x80000000) != 0 ||
+		uint64(gap) < rtptime.FromDuration(DTXThreshold, clockrate) {
 		return nil
 	}
-	return &p
-}
 
-func (t *diskTrack) WriteRTP(packet *rtp.Packet) error {
-	// since we call initWriter, we take the connection lock for simplicity.
-	t.conn.mu.Lock()
-	defer t.conn.mu.Unlock()
+	frame := silence[0]
+	if t.channels == 2 {
+		frame = silence[1]
+	}
+	duration := uint32(
+		rtptime.FromDuration(20*time.Millisecond, clockrate),
+	)
+	for ts-end >= duration {
+		err := t.writeBlock(true, end, frame)
+		if err != nil {
+			return err
+		}
+		end += duration
+	}
+	return nil
+}
 
-	if t.builder == nil {
-		return nil
+// writeBlock writes a sample to the current file, without filling gaps.
+// Called with both locks held.
+func (t *diskTrack) writeBlock(keyframe bool, ts uint32, data []byte) error {
+	// accumulate the difference with the last sample, which is
+	// correct across wraparound of the RTP timestamp
+	t.elapsed += int64(int32(ts - t.lastTs))
+	t.lastTs = ts
+	elapsed := t.elapsed
+	if elapsed < 0 {
+		// the sample precedes the common origin
+		elapsed = 0
 	}
 
-	p := clonePacket(packet)
-	if p == nil {
-		return nil
+	tm := elapsed * 1000 / int64(t.remote.Codec().ClockRate)
+	// write errors are reported asynchronously by the file
+	err := t.file.Err()
+	if err != nil {
+		return err
+	}
+	dropped, n := t.conn.queue.push(writeJob{
+		track:    t,
+		writer:   t.writer,
+		file:     t.file,
+		keyframe: keyframe,
+		tm:       tm,
+		data:     data,
+	})
+	atomic.AddUint64(&t.samples, 1)
+	if dropped != nil {
+		atomic.AddUint64(&dropped.samples, -uint64(n))
+		atomic.AddUint64(&dropped.dropped, uint64(n))
+	}
+	codec := t.remote.Codec()
+	if strings.EqualFold(codec.MimeType, "audio/opus") ||
+		strings.EqualFold(codec.MimeType, "audio/red") {
+		t.lastDuration = opusDuration(data, codec.ClockRate)
 	}
+	return nil
+}
 
+// writeSamples writes the samples that are ready to disk.  Called with
+// t.mu held; the connection's lock is only taken for complete samples.
+func (t *diskTrack) writeSamples() error {
 	kfNeeded := false
 
-	t.builder.Push(p)
-
 	for {
 		sample, ts := t.builder.PopWithTimestamp()
 		if sample == nil {
-			if kfNeeded {
+			if kfNeeded && t.requestKeyframe() {
 				return conn.ErrKeyframeNeeded
 			}
 			return nil
 		}
 
+		if len(sample.Data) < 1 {
+			// a malformed stream, which would produce an invalid
+			// block
+			atomic.AddUint64(&t.empty, 1)
+			continue
+		}
+
 		keyframe := true
+		data := sample.Data
+		var sps, pps []byte
 
 		codec := t.remote.Codec()
 		switch strings.ToLower(codec.MimeType) {
-		case "video/vp8":
-			if len(sample.Data) < 1 {
+		case "video/vp8", "video/vp9", "video/h264":
+			if strings.EqualFold(codec.MimeType, "video/h264") {
+				data, sps, pps = convertH264(data)
+			}
+			if len(data) < 1 {
 				continue
 			}
-			keyframe = (sample.Data[0]&0x1 == 0)
+			keyframe = isKeyframe(codec.MimeType, data)
 			if keyframe {
-				err := t.initWriter(sample.Data)
-				if err != nil {
-					t.conn.warn(
-						"Write to disk " + err.Error(),
-					)
-					return err
-				}
-				t.lastKf = ts
-			} else if t.writer != nil {
-				// Request a keyframe every 10s
-				delta := ts - t.lastKf
-				if (delta&0x80000000) == 0 &&
-					delta > 10*90000 {
-					kfNeeded = true
-				}
+				atomic.AddUint64(&t.keyframes, 1)
 			}
-		default:
-			if t.writer == nil {
-				if !t.conn.hasVideo {
-					err := t.conn.initWriter(0, 0)
-					if err != nil {
-						t.conn.warn(
-							"Write to disk " +
-								err.Error(),
-						)
-						return err
-					}
-				}
+		}
+
+		t.conn.mu.Lock()
+		kf, err := t.commit(keyframe, ts, data, sps, pps)
+		t.conn.mu.Unlock()
+		if err == conn.ErrKeyframeNeeded {
+			// the sample is dropped
+			kfNeeded = true
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		kfNeeded = kfNeeded || kf
+	}
+}
+
+// keyframeRequestInterval is the minimum interval between two keyframe
+// requests for a single track.
+var keyframeRequestInterval = time.Second
+
+// requestKeyframe returns true if a keyframe should be requested from the
+// sender.  Requests are coalesced, so that a track waiting for a keyframe
+// doesn't cause a request to be sent for every packet.  Called with t.mu
+// held.
+func (t *diskTrack) requestKeyframe() bool {
+	now := time.Now()
+	if !t.kfRequested.IsZero() &&
+		now.Sub(t.kfRequested) < keyframeRequestInterval {
+		return false
+	}
+	t.kfRequested = now
+	return true
+}
+
+// commit opens or splits the file if necessary, then queues a complete
+// sample for writing.  It returns true if a keyframe should be requested.
+// Called with both locks held.
+func (t *diskTrack) commit(keyframe bool, ts uint32, data, sps, pps []byte) (bool, error) {
+	if t.conn.paused || t.conn.stopped ||
+		atomic.LoadUint32(&t.disabled) != 0 {
+		return false, nil
+	}
+
+	kfNeeded := false
+	// set when this sample opens the file
+	opened := false
+
+	codec := t.remote.Codec()
+	switch strings.ToLower(codec.MimeType) {
+	case "video/vp8", "video/vp9", "video/h264":
+		if sps != nil {
+			t.sps = sps
+		}
+		if pps != nil {
+			t.pps = pps
+		}
+		if keyframe {
+			file := t.conn.file
+			err := t.initWriter(data)
+			if err == nil && t.conn.file == file &&
+				t.conn.shouldSplit() {
+				err = t.conn.initWriter()
+			}
+			if err != nil {
+				return false, t.fail(err)
+			}
+			opened = file == nil && t.conn.file != nil
+			t.lastKf = ts
+			t.kfRequested = time.Time{}
+		} else if t.writer != nil && KeyframeInterval > 0 {
+			interval := rtptime.FromDuration(
+				KeyframeInterval, codec.ClockRate,
+			)
+			delta := ts - t.lastKf
+			if (delta&0x80000000) == 0 && uint64(delta) > interval {
+				kfNeeded = true
+			}
+		}
+		// a new live viewer starts at the next keyframe
+		if !keyframe && t.file != nil && t.file.tap != nil &&
+			t.file.tap.waiting() {
+			kfNeeded = true
+		}
+	default:
+		if t.channels == 0 {
+			t.channels = sampleChannels(codec.MimeType, data)
+		}
+		// keep audio until the first video keyframe
+		if AlignStart && t.conn.videoCount > 0 && t.conn.file == nil {
+			t.addPreroll(ts, data)
+			return false, nil
+		}
+		// audio-only files are started or split at any sample, and
+		// other files are started by audio unless AlignStart is set
+		if t.conn.file == nil ||
+			(t.conn.videoCount == 0 && t.conn.shouldSplit()) {
+			err := t.conn.initWriter()
+			if err != nil {
+				return false, t.fail(err)
 			}
 		}
+	}
 
-		if t.writer == nil {
-			if !keyframe {
-				return conn.ErrKeyframeNeeded
+	if t.writer == nil ||
+		(atomic.LoadUint32(&t.kfNeeded) != 0 && !keyframe) {
+		if !keyframe {
+			return false, conn.ErrKeyframeNeeded
+		}
+		return kfNeeded, nil
+	}
+	atomic.StoreUint32(&t.kfNeeded, 0)
+
+	if opened {
+		t.conn.start = t.sampleTime(ts)
+	}
+
+	var err error
+	if len(t.preroll) > 0 {
+		err = t.drainPreroll()
+	}
+	if err == nil {
+		err = t.writeSample(keyframe, ts, data)
+	}
+	if err != nil {
+		// a write error only affects this track if it has its own
+		// file
+		if t.file.Err() != nil && t.conn.perTrack() &&
+			len(t.conn.recorded) > 1 {
+			err = trackError{err}
+		}
+		return false, t.fail(err)
+	}
+	t.maybeThumbnail(keyframe, data)
+	return kfNeeded, nil
+}
+
+// trackError is an error that only affects a single track, which is
+// disabled while the other tracks keep being recorded.
+type trackError struct {
+	err error
+}
+
+func (err trackError) Error() string {
+	return err.err.Error()
+}
+
+func (err trackError) Unwrap() error {
+	return err.err
+}
+
+// fail handles an error that occurred while recording a sample, and
+// returns the error to report to the caller, if any.  Called with both
+// locks held.
+func (t *diskTrack) fail(err error) error {
+	if t.conn.stopOnError(err) {
+		return nil
+	}
+	var te trackError
+	if errors.As(err, &te) {
+		t.disable(te.err)
+		return nil
+	}
+	t.conn.warn("Write to disk " + err.Error())
+	return err
+}
+
+// disable stops recording a track after an error, while the other
+// tracks keep being recorded.  Since a disabled video track no longer
+// gates the audio, the recording continues with audio only if no other
+// video track remains.  Files opened later still contain the track,
+// without any data.  Called with both locks held.
+func (t *diskTrack) disable(err error) {
+	if !atomic.CompareAndSwapUint32(&t.disabled, 0, 1) {
+		return
+	}
+	// the writer must not be closed while samples are queued for it
+	t.conn.queue.drain()
+	if t.writer != nil {
+		t.writer.Close()
+		t.writer = nil
+	}
+	if strings.HasPrefix(
+		strings.ToLower(t.remote.Codec().MimeType), "video/",
+	) {
+		t.conn.videoCount--
+	}
+	message := "Recording of track " + t.name + " stopped: " + err.Error()
+	log.Println(message)
+	t.conn.client.group.WallOps(message)
+}
+
+// isKeyframe determines if a sample returned by the sample builder
+// is a keyframe.
+func isKeyframe(codec string, data []byte) bool {
+	switch strings.ToLower(codec) {
+	case "video/vp8":
+		if len(data) < 1 {
+			return false
+		}
+		return (data[0] & 0x1) == 0
+	case "video/vp9":
+		if len(data) < 1 {
+			return false
+		}
+		if (data[0] & 0xC0) != 0x80 {
+			return false
+		}
+		profile := (data[0] >> 4) & 0x3
+		if profile != 3 {
+			return (data[0] & 0xC) == 0
+		}
+		return (data[0] & 0x6) == 0
+	case "video/h264":
+		for _, nal := range splitAVCC(data) {
+			if h264NALType(nal) == h264NALIDR {
+				return true
 			}
-			return nil
 		}
+		return false
+	default:
+		return false
+	}
+}
+
+// convertH264 converts a sample from Annex B to AVCC format, and returns
+// copies of any parameter sets that it carries.
+func convertH264(data []byte) ([]byte, []byte, []byte) {
+	var sps, pps []byte
+	nals := splitAnnexB(data)
+	for _, nal := range nals {
+		switch h264NALType(nal) {
+		case h264NALSPS:
+			sps = append([]byte(nil), nal...)
+		case h264NALPPS:
+			pps = append([]byte(nil), nal...)
+		}
+	}
+	return toAVCC(nals), sps, pps
+}
+
+// bitReader reads big-endian bit fields, as used by the VP9
+// uncompressed header.
+type bitReader struct {
+	data   []byte
+	offset int
+}
 
-		if t.origin == 0 {
-			t.origin = uint64(ts) | (1 << 32)
+func (r *bitReader) read(n int) (uint32, bool) {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.offset >= len(r.data)*8 {
+			return 0, false
 		}
-		ts -= uint32(t.origin)
+		bit := (r.data[r.offset/8] >> (7 - uint(r.offset%8))) & 1
+		v = (v << 1) | uint32(bit)
+		r.offset++
+	}
+	return v, true
+}
 
-		tm := ts / (t.remote.Codec().ClockRate / 1000)
-		_, err := t.writer.Write(keyframe, int64(tm), sample.Data)
-		if err != nil {
-			return err
+// keyframeDimensions returns the dimensions of a keyframe, or (0, 0) if
+// they cannot be determined.
+func keyframeDimensions(codec string, data []byte) (uint32, uint32) {
+	switch strings.ToLower(codec) {
+	case "video/vp8":
+		if len(data) < 10 {
+			return 0, 0
+		}
+		raw := uint32(data[6]) | uint32(data[7])<<8 |
+			uint32(data[8])<<16 | uint32(data[9])<<24
+		width := raw & 0x3FFF
+		height := (raw >> 16) & 0x3FFF
+		return width, height
+	case "video/vp9":
+		r := bitReader{data: data}
+		marker, _ := r.read(2)
+		low, _ := r.read(1)
+		high, _ := r.read(1)
+		profile := low | high<<1
+		if profile == 3 {
+			r.read(1)
 		}
+		// show_existing_frame, frame_type, show_frame,
+		// error_resilient_mode
+		flags, ok := r.read(4)
+		if !ok || marker != 2 || (flags&0xC) != 0 {
+			return 0, 0
+		}
+		sync, ok := r.read(24)
+		if !ok || sync != 0x498342 {
+			return 0, 0
+		}
+		if profile >= 2 {
+			// ten_or_twelve_bit
+			r.read(1)
+		}
+		colorSpace, _ := r.read(3)
+		if colorSpace != 7 {
+			// color_range
+			r.read(1)
+			if profile == 1 || profile == 3 {
+				// subsampling_x, subsampling_y, reserved_zero
+				r.read(3)
+			}
+		} else if profile == 1 || profile == 3 {
+			// reserved_zero
+			r.read(1)
+		}
+		w, _ := r.read(16)
+		h, ok := r.read(16)
+		if !ok {
+			return 0, 0
+		}
+		return w + 1, h + 1
+	case "video/h264":
+		for _, nal := range splitAVCC(data) {
+			if h264NALType(nal) == h264NALSPS {
+				w, h, err := spsDimensions(nal)
+				if err != nil {
+					return 0, 0
+				}
+				return w, h
+			}
+		}
+		return 0, 0
+	default:
+		return 0, 0
 	}
 }
 
-// called locked
+// called with both locks held
 func (t *diskTrack) initWriter(data []byte) error {
 	codec := t.remote.Codec()
 	switch strings.ToLower(codec.MimeType) {
-	case "video/vp8":
-		if len(data) < 10 {
+	case "video/vp8", "video/vp9":
+		if !isKeyframe(codec.MimeType, data) {
 			return nil
 		}
-		keyframe := (data[0]&0x1 == 0)
-		if !keyframe {
+		width, height := keyframeDimensions(codec.MimeType, data)
+		if width == 0 || height == 0 {
 			return nil
 		}
-		raw := uint32(data[6]) | uint32(data[7])<<8 |
-			uint32(data[8])<<16 | uint32(data[9])<<24
-		width := raw & 0x3FFF
-		height := (raw >> 16) & 0x3FFF
-		return t.conn.initWriter(width, height)
+		return t.setDimensions(width, height)
+	case "video/h264":
+		if !isKeyframe(codec.MimeType, data) {
+			return nil
+		}
+		if t.sps == nil || t.pps == nil {
+			return nil
+		}
+		width, height, err := spsDimensions(t.sps)
+		if err == nil {
+			_, err = avcConfigurationRecord(t.sps, t.pps)
+		}
+		if err != nil {
+			return trackError{err}
+		}
+		return t.setDimensions(width, height)
 	}
 	return nil
 }
 
+// setDimensions records the dimensions of a video track, and reopens
+// the file if they have changed, or if the track could not be included
+// in it.  Called with both locks held.
+func (t *diskTrack) setDimensions(width, height uint32) error {
+	if t.conn.file != nil && t.conn.isRecorded(t) {
+		if width == t.width && height == t.height {
+			return nil
+		}
+		if t.width == 0 && t.height == 0 {
+			// This is the first keyframe on this track, but the
+			// file has already been opened by another track.
+			// Don't restart the file, just leave the dimensions
+			// unspecified in the header.
+			t.width = width
+			t.height = height
+			return nil
+		}
+		// Matroska cannot express a change of dimensions, so we
+		// start a new file.  Let the operators know, so that they
+		// can correlate the files.
+		t.conn.warn(fmt.Sprintf(
+			"Recording of %v: resolution changed "+
+				"from %vx%v to %vx%v, starting a new file",
+			t.conn.remote.Id(), t.width, t.height, width, height,
+		))
+	}
+	t.width = width
+	t.height = height
+	return t.conn.initWriter()
+}
+
+// pending returns true if a track cannot be described in the header of
+// a file yet, which is the case of an H.264 track whose parameter sets
+// have not been seen.  Such a track is left out of the files that are
+// opened by other tracks, and the files are reopened at its first
+// keyframe.  Called locked.
+func (t *diskTrack) pending() bool {
+	if strings.ToLower(t.remote.Codec().MimeType) != "video/h264" {
+		return false
+	}
+	_, err := avcConfigurationRecord(t.sps, t.pps)
+	return err != nil
+}
+
 // called locked
-func (conn *diskConn) initWriter(width, height uint32) error {
-	if conn.file != nil && width == conn.width && height == conn.height {
+func (conn *diskConn) initWriter() error {
+	conn.closeWriters()
+	var recorded []*diskTrack
+	for _, t := range conn.tracks {
+		if !t.pending() {
+			recorded = append(recorded, t)
+		}
+	}
+	if len(recorded) == 0 {
 		return nil
 	}
+	conn.recorded = recorded
+
 	var entries []webm.TrackEntry
-	for i, t := range conn.tracks {
+	var tracks []manifestTrack
+	for i, t := range conn.recorded {
 		var entry webm.TrackEntry
 		codec := t.remote.Codec()
+		name := t.name
+		if conn.username != "" {
+			name = conn.username
+		}
+		track := newManifestTrack(t.name, codec)
 		switch strings.ToLower(codec.MimeType) {
-		case "audio/opus":
+		case "audio/opus", "audio/red":
+			channels := t.channels
+			if channels == 0 {
+				channels = codec.Channels
+			}
+			if channels == 0 {
+				// RFC 7587 says that Opus is always
+				// signalled as stereo
+				channels = 2
+			}
 			entry = webm.TrackEntry{
-				Name:        "Audio",
-				TrackNumber: uint64(i + 1),
-				CodecID:     "A_OPUS",
-				TrackType:   2,
+				Name:         name,
+				TrackNumber:  uint64(i + 1),
+				CodecID:      "A_OPUS",
+				CodecPrivate: opusHead(channels, codec.ClockRate),
+				TrackType:    2,
 				Audio: &webm.Audio{
 					SamplingFrequency: float64(codec.ClockRate),
-					Channels:          uint64(codec.Channels),
+					Channels:          uint64(channels),
+				},
+			}
+			track.Channels = channels
+		case "audio/pcmu", "audio/pcma", "audio/g722":
+			rate, channels := audioParameters(codec)
+			entry = webm.TrackEntry{
+				Name:         name,
+				TrackNumber:  uint64(i + 1),
+				CodecID:      "A_MS/ACM",
+				CodecPrivate: waveFormat(codec),
+				TrackType:    2,
+				Audio: &webm.Audio{
+					SamplingFrequency: float64(rate),
+					Channels:          uint64(channels),
 				},
 			}
+			track.Channels = channels
 		case "video/vp8":
 			entry = webm.TrackEntry{
-				Name:        "Video",
+				Name:        name,
 				TrackNumber: uint64(i + 1),
 				CodecID:     "V_VP8",
 				TrackType:   1,
 				Video: &webm.Video{
-					PixelWidth:  uint64(width),
-					PixelHeight: uint64(height),
+					PixelWidth:  uint64(t.width),
+					PixelHeight: uint64(t.height),
+				},
+			}
+		case "video/vp9":
+			entry = webm.TrackEntry{
+				Name:        name,
+				TrackNumber: uint64(i + 1),
+				CodecID:     "V_VP9",
+				TrackType:   1,
+				Video: &webm.Video{
+					PixelWidth:  uint64(t.width),
+					PixelHeight: uint64(t.height),
+				},
+			}
+		case "video/h264":
+			record, err := avcConfigurationRecord(t.sps, t.pps)
+			if err != nil {
+				return err
+			}
+			entry = webm.TrackEntry{
+				Name:         name,
+				TrackNumber:  uint64(i + 1),
+				CodecID:      "V_MPEG4/ISO/AVC",
+				CodecPrivate: record,
+				TrackType:    1,
+				Video: &webm.Video{
+					PixelWidth:  uint64(t.width),
+					PixelHeight: uint64(t.height),
 				},
 			}
 		default:
 			return errors.New("unknown track type")
 		}
+		if entry.Video != nil {
+			track.Width = t.width
+			track.Height = t.height
+		}
+		if conn.perTrack() {
+			entry.TrackNumber = 1
+		}
 		entries = append(entries, entry)
+		tracks = append(tracks, track)
 	}
 
 	err := conn.reopen()
@@ -464,32 +2559,265 @@ func (conn *diskConn) initWriter(width, height uint32) error {
 		return err
 	}
 
-	writers, err := webm.NewSimpleBlockWriter(conn.file, entries)
-	if err != nil {
-		conn.file.Close()
-		conn.file = nil
-		return err
+	var writers []webm.BlockWriteCloser
+	if conn.perTrack() {
+		for i, entry := range entries {
+			var w []webm.BlockWriteCloser
+			t := conn.recorded[i]
+			if t.isIVF() {
+				var iw *ivfWriter
+				iw, err = newIVFWriter(
+					conn.files[i], t.remote.Codec().MimeType,
+					t.width, t.height,
+				)
+				w = []webm.BlockWriteCloser{iw}
+			} else if t.isOgg() {
+				var ow *oggWriter
+				ow, err = newOggWriter(
+					conn.files[i], tracks[i].Channels,
+					t.remote.Codec().ClockRate,
+				)
+				w = []webm.BlockWriteCloser{ow}
+			} else {
+				w, err = webm.NewSimpleBlockWriter(
+					conn.files[i], []webm.TrackEntry{entry},
+				)
+			}
+			if err != nil {
+				conn.closeFiles(writers)
+				return err
+			}
+			writers = append(writers, w...)
+		}
+	} else {
+		writers, err = webm.NewSimpleBlockWriter(conn.file, entries)
+		if err != nil {
+			conn.closeFiles(nil)
+			return err
+		}
 	}
 
-	if len(writers) != len(conn.tracks) {
-		conn.file.Close()
-		conn.file = nil
+	if len(writers) != len(conn.recorded) {
+		conn.closeFiles(nil)
 		return errors.New("unexpected number of writers")
 	}
 
-	conn.width = width
-	conn.height = height
+	conn.fileTracks = tracks
 
-	for i, t := range conn.tracks {
+	// each file starts at t=0
+	conn.generation++
+	conn.originNTP = 0
+	conn.originCapture = false
+	for i, t := range conn.recorded {
 		t.writer = writers[i]
+		t.fileExpected = atomic.LoadUint64(&t.expected)
+		t.fileReceived = atomic.LoadUint64(&t.received)
+		atomic.StoreUint32(&t.maxJitter, 0)
+		// video tracks must start with a keyframe
+		if strings.HasPrefix(
+			strings.ToLower(t.remote.Codec().MimeType), "video/",
+		) {
+			atomic.StoreUint32(&t.kfNeeded, 1)
+		} else {
+			atomic.StoreUint32(&t.kfNeeded, 0)
+		}
 	}
 	return nil
 }
 
+// sampleChannels returns the number of channels of an audio sample, or
+// 0 if it cannot be determined.
+func sampleChannels(codec string, data []byte) uint16 {
+	switch strings.ToLower(codec) {
+	case "audio/opus", "audio/red":
+		if len(data) < 1 {
+			return 0
+		}
+		// the stereo flag of the TOC byte, RFC 6716 Section 3.1
+		if (data[0] & 0x4) != 0 {
+			return 2
+		}
+		return 1
+	default:
+		return 0
+	}
+}
+
+// opusDuration returns the duration of an Opus packet in units of
+// clockrate, or 0 if it cannot be determined.  RFC 6716 Section 3.1.
+func opusDuration(data []byte, clockrate uint32) uint32 {
+	if len(data) < 1 {
+		return 0
+	}
+	config := data[0] >> 3
+	var frame time.Duration
+	switch {
+	case config < 12:
+		// SILK
+		frame = [4]time.Duration{10, 20, 40, 60}[config%4] *
+			time.Millisecond
+	case config < 16:
+		// hybrid
+		frame = [2]time.Duration{10, 20}[config%2] * time.Millisecond
+	default:
+		// CELT
+		frame = [4]time.Duration{25, 50, 100, 200}[config%4] *
+			time.Millisecond / 10
+	}
+
+	var count int
+	switch data[0] & 0x3 {
+	case 0:
+		count = 1
+	case 1, 2:
+		count = 2
+	default:
+		if len(data) < 2 {
+			return 0
+		}
+		count = int(data[1] & 0x3F)
+	}
+	return uint32(rtptime.FromDuration(
+		frame*time.Duration(count), clockrate,
+	))
+}
+
+// opusHead returns the identification header of an Opus stream, as
+// required by the CodecPrivate element of an A_OPUS track.
+func opusHead(channels uint16, rate uint32) []byte {
+	b := make([]byte, 19)
+	copy(b, "OpusHead")
+	b[8] = 1
+	b[9] = byte(channels)
+	// pre-skip is 0
+	binary.LittleEndian.PutUint32(b[12:], rate)
+	// output gain and channel mapping family are 0
+	return b
+}
+
+// audioParameters returns the actual sampling rate and number of
+// channels of an audio codec.
+func audioParameters(codec webrtc.RTPCodecCapability) (uint32, uint16) {
+	rate := codec.ClockRate
+	// G.722 is sampled at 16kHz, but its RTP clock runs at 8kHz
+	if strings.EqualFold(codec.MimeType, "audio/g722") {
+		rate = 16000
+	}
+	channels := codec.Channels
+	if channels == 0 {
+		channels = 1
+	}
+	return rate, channels
+}
+
+// waveFormat returns the WAVEFORMATEX structure describing a codec,
+// as required by tracks of type A_MS/ACM.
+func waveFormat(codec webrtc.RTPCodecCapability) []byte {
+	var tag, bits uint16
+	switch strings.ToLower(codec.MimeType) {
+	case "audio/pcma":
+		tag, bits = 0x0006, 8
+	case "audio/pcmu":
+		tag, bits = 0x0007, 8
+	case "audio/g722":
+		tag, bits = 0x028F, 4
+	}
+	rate, channels := audioParameters(codec)
+	bytesPerSec := rate * uint32(bits) * uint32(channels) / 8
+	blockAlign := uint16(1)
+	if bits >= 8 {
+		blockAlign = uint16(bits) / 8 * channels
+	}
+
+	b := make([]byte, 18)
+	binary.LittleEndian.PutUint16(b[0:], tag)
+	binary.LittleEndian.PutUint16(b[2:], channels)
+	binary.LittleEndian.PutUint32(b[4:], rate)
+	binary.LittleEndian.PutUint32(b[8:], bytesPerSec)
+	binary.LittleEndian.PutUint16(b[12:], blockAlign)
+	binary.LittleEndian.PutUint16(b[14:], bits)
+	// cbSize is zero
+	return b
+}
+
+// GetMaxBitrate returns no limit, since the bitrate requested from
+// a sender is the lowest requested by any of its receivers, and limiting
+// the recording would therefore limit the other participants.  The
+// client's maximum bitrate is applied by selectVideo instead.
 func (down *diskConn) GetMaxBitrate(now uint64) uint64 {
 	return ^uint64(0)
 }
 
 func (t *diskTrack) Accumulate(bytes uint32) {
-	return
+	atomic.AddUint64(&t.bytes, uint64(bytes))
+}
+
+// TrackStats contains statistics about a recorded track.
+type TrackStats struct {
+	Name string
+	// bytes received
+	Bytes uint64
+	// samples written to disk
+	Samples uint64
+	// keyframes received, for video tracks
+	Keyframes uint64
+	// samples dropped because the disk couldn't keep up
+	Dropped uint64
+	// empty samples, which are skipped
+	Empty uint64
+	// true if the track is no longer recorded due to an error
+	Disabled bool
+	// packets expected, and packets lost in the network
+	Packets, Lost uint64
+	// the maximum jitter since the current file was opened
+	Jitter time.Duration
+}
+
+// ConnStats contains statistics about a recorded connection.
+type ConnStats struct {
+	Id     string
+	Tracks []TrackStats
+}
+
+func (conn *diskConn) stats() ConnStats {
+	stats := ConnStats{
+		Id:     conn.remote.Id(),
+		Tracks: make([]TrackStats, 0, len(conn.tracks)),
+	}
+	for _, t := range conn.tracks {
+		expected := atomic.LoadUint64(&t.expected)
+		received := atomic.LoadUint64(&t.received)
+		stats.Tracks = append(stats.Tracks, TrackStats{
+			Name:      t.name,
+			Bytes:     atomic.LoadUint64(&t.bytes),
+			Samples:   atomic.LoadUint64(&t.samples),
+			Keyframes: atomic.LoadUint64(&t.keyframes),
+			Dropped:   atomic.LoadUint64(&t.dropped),
+			Empty:     atomic.LoadUint64(&t.empty),
+			Disabled:  atomic.LoadUint32(&t.disabled) != 0,
+			Packets:   expected,
+			Lost:      lost(expected, received),
+			Jitter:    t.jitterDuration(),
+		})
+	}
+	return stats
+}
+
+// Stats returns statistics about the connections being recorded.
+func (client *Client) Stats() []ConnStats {
+	client.mu.Lock()
+	conns := make([]*diskConn, 0, len(client.down))
+	for _, down := range client.down {
+		conns = append(conns, down)
+	}
+	client.mu.Unlock()
+
+	stats := make([]ConnStats, 0, len(conns))
+	for _, down := range conns {
+		stats = append(stats, down.stats())
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Id < stats[j].Id
+	})
+	return stats
 }
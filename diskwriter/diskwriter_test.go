@@ -0,0 +1,3675 @@
+package diskwriter
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/at-wat/ebml-go"
+	"github.com/at-wat/ebml-go/webm"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/conn"
+	"github.com/jech/galene/group"
+	"github.com/jech/galene/rtptime"
+)
+
+type testUpTrack struct {
+	codec      webrtc.RTPCodecCapability
+	label      string
+	extensions map[string]uint8
+	bitrate    uint64
+}
+
+func (t *testUpTrack) AddLocal(conn.DownTrack) error {
+	return nil
+}
+
+func (t *testUpTrack) DelLocal(conn.DownTrack) bool {
+	return true
+}
+
+func (t *testUpTrack) Label() string {
+	return t.label
+}
+
+func (t *testUpTrack) Codec() webrtc.RTPCodecCapability {
+	return t.codec
+}
+
+func (t *testUpTrack) GetRTP(seqno uint16, result []byte) uint16 {
+	return 0
+}
+
+func (t *testUpTrack) Nack(conn conn.Up, seqnos []uint16) error {
+	return nil
+}
+
+func (t *testUpTrack) HeaderExtensionID(uri string) uint8 {
+	return t.extensions[uri]
+}
+
+func (t *testUpTrack) Bitrate() uint64 {
+	return atomic.LoadUint64(&t.bitrate)
+}
+
+type testUp struct {
+	id       string
+	label    string
+	username string
+}
+
+func (up *testUp) AddLocal(conn.Down) error {
+	return nil
+}
+
+func (up *testUp) DelLocal(conn.Down) bool {
+	return true
+}
+
+func (up *testUp) Id() string {
+	return up.id
+}
+
+func (up *testUp) Label() string {
+	return up.label
+}
+
+func (up *testUp) User() (string, string) {
+	return "", up.username
+}
+
+func (up *testUp) Codecs() []webrtc.RTPCodecCapability {
+	return nil
+}
+
+var vp8Codec = webrtc.RTPCodecCapability{
+	MimeType:  "video/VP8",
+	ClockRate: 90000,
+}
+
+var opusCodec = webrtc.RTPCodecCapability{
+	MimeType:  "audio/opus",
+	ClockRate: 48000,
+	Channels:  2,
+}
+
+// newTestConn returns the connection that records the tracks sent by up
+// on behalf of client.  A nil client is a client of a group with an
+// empty description, and a nil up is a connection with id "up".  The tracks are recorded in dir
+// or, if dir is empty, pushed to the client and recorded in the
+// directory of its group.
+func newTestConn(t testing.TB, client *Client, up *testUp, dir string, tracks ...conn.UpTrack) *diskConn {
+	if client == nil {
+		client = &Client{group: testGroup(t, "conn")}
+	}
+	if up == nil {
+		up = &testUp{id: "up"}
+	}
+	if dir != "" {
+		c, err := newDiskConn(
+			client, dir, up.label, up.username, up, tracks,
+		)
+		if err != nil {
+			t.Fatalf("newDiskConn: %v", err)
+		}
+		return c
+	}
+
+	err := client.PushConn(client.group, up.id, up, tracks, up.label)
+	if err != nil {
+		t.Fatalf("PushConn: %v", err)
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.down[up.id]
+}
+
+// testGroup creates a group with an empty description.
+func testGroup(t testing.TB, name string) *group.Group {
+	return testGroupDescription(t, name, "{}")
+}
+
+// testGroupDescription creates a group with the given description.
+func testGroupDescription(t testing.TB, name, desc string) *group.Group {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	err := ioutil.WriteFile(
+		filepath.Join(dir, name+".json"), []byte(desc), 0600,
+	)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	saved := group.Directory
+	group.Directory = dir
+	defer func() {
+		group.Directory = saved
+	}()
+
+	g, err := group.Add(name, nil)
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	return g
+}
+
+func testDirectory(t testing.TB) string {
+	dir, err := ioutil.TempDir("", "galene-diskwriter")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	return dir
+}
+
+// recordingFile returns the name of the single recording in directory.
+func recordingFile(t *testing.T, directory string) string {
+	fis, err := ioutil.ReadDir(directory)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	var files []string
+	for _, fi := range fis {
+		if filepath.Ext(fi.Name()) == ".webm" && !isSymlink(fi) {
+			files = append(files, fi.Name())
+		}
+	}
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 recording, got %v", files)
+	}
+	return filepath.Join(directory, files[0])
+}
+
+// segmentElements are the elements that only appear at the top level
+// of a segment.
+var segmentElements = map[uint64]bool{
+	idSeekHead: true,
+	idInfo:     true,
+	idTracks:   true,
+	idCluster:  true,
+	idCues:     true,
+	idChapters: true,
+}
+
+// readSegmentElement parses the element at the start of the contents of
+// a segment, and returns its ID, its encoding and the data that follows.
+// An element of unknown size, such as a cluster of a recording that was
+// being streamed, extends up to the next top-level element.
+func readSegmentElement(t *testing.T, data []byte) (uint64, []byte, []byte) {
+	id, contents, rest := readElement(t, data)
+	// readElement returns no rest for an element of unknown size
+	if rest == nil {
+		rest = contents
+		for len(rest) > 0 {
+			child, _, next := readElement(t, rest)
+			if segmentElements[child] {
+				break
+			}
+			rest = next
+		}
+	}
+	return id, data[:len(data)-len(rest)], rest
+}
+
+// readWebm parses a WebM file.  ebml-go neither skips Void elements nor
+// knows the elements of the Cues and Chapters, so only the top-level
+// elements that it understands are kept.
+func readWebm(t *testing.T, filename string) *webm.Segment {
+	data := readFile(t, filename)
+	_, _, rest := readElement(t, data)
+	header := data[:len(data)-len(rest)]
+	id, segment, _ := readElement(t, rest)
+	if id != idSegment {
+		t.Fatalf("Expected Segment, got %x", id)
+	}
+	var contents []byte
+	for len(segment) > 0 {
+		var element []byte
+		id, element, segment = readSegmentElement(t, segment)
+		switch id {
+		case idSeekHead, idInfo, idTracks, idCluster:
+			contents = append(contents, element...)
+		}
+	}
+	data = append(append([]byte(nil), header...),
+		appendElement(nil, idSegment, contents)...)
+
+	var ret struct {
+		Header  webm.EBMLHeader `ebml:"EBML"`
+		Segment webm.Segment    `ebml:"Segment"`
+	}
+	err := ebml.Unmarshal(bytes.NewReader(data), &ret)
+	if err != nil {
+		t.Fatalf("Unmarshal %v: %v", filename, err)
+	}
+	return &ret.Segment
+}
+
+// readRecording parses the single recording in directory.
+func readRecording(t *testing.T, directory string) *webm.Segment {
+	return readWebm(t, recordingFile(t, directory))
+}
+
+func TestOpusStereo(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	track := &testUpTrack{
+		codec: webrtc.RTPCodecCapability{
+			MimeType:  "audio/opus",
+			ClockRate: 48000,
+		},
+	}
+	c := newTestConn(t, nil, nil, dir, track)
+
+	for i := 0; i < 10; i++ {
+		p := rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				PayloadType:    111,
+				SequenceNumber: uint16(i),
+				Timestamp:      uint32(i * 960),
+				SSRC:           42,
+			},
+			// config 31, stereo, one frame
+			Payload: []byte{0xFC, 0xFF, 0xFE},
+		}
+		err := c.tracks[0].WriteRTP(&p)
+		if err != nil {
+			t.Fatalf("WriteRTP: %v", err)
+		}
+	}
+	c.Close()
+
+	segment := readRecording(t, dir)
+	if len(segment.Tracks.TrackEntry) != 1 {
+		t.Fatalf("Expected 1 track, got %v",
+			len(segment.Tracks.TrackEntry))
+	}
+	entry := segment.Tracks.TrackEntry[0]
+	if entry.Audio == nil || entry.Audio.Channels != 2 {
+		t.Errorf("Expected 2 channels, got %v", entry.Audio)
+	}
+	if len(entry.CodecPrivate) != 19 || entry.CodecPrivate[9] != 2 {
+		t.Errorf("Bad OpusHead %v", entry.CodecPrivate)
+	}
+}
+
+func TestParseRED(t *testing.T) {
+	payload := []byte{
+		// redundant block, PT 111, offset 960, length 2
+		0x80 | 111, 960 >> 6, (960&0x3F)<<2 | 0, 2,
+		// primary block, PT 111
+		111,
+		0x01, 0x02,
+		0x03, 0x04, 0x05,
+	}
+	blocks, err := parseRED(payload)
+	if err != nil {
+		t.Fatalf("parseRED: %v", err)
+	}
+	if len(blocks) != 2 {
+		t.Fatalf("Expected 2 blocks, got %v", len(blocks))
+	}
+	if blocks[0].offset != 960 ||
+		!bytes.Equal(blocks[0].data, []byte{1, 2}) {
+		t.Errorf("Bad redundant block %v", blocks[0])
+	}
+	if blocks[1].offset != 0 ||
+		!bytes.Equal(blocks[1].data, []byte{3, 4, 5}) {
+		t.Errorf("Bad primary block %v", blocks[1])
+	}
+
+	_, err = parseRED(payload[:6])
+	if err == nil {
+		t.Errorf("Truncated payload parsed successfully")
+	}
+}
+
+// readElement parses the EBML element at the start of data, and returns
+// its ID, its contents and the data that follows.  The contents of an
+// element of unknown size extend to the end of data.
+func readElement(t *testing.T, data []byte) (uint64, []byte, []byte) {
+	id, l1, _ := readVint(data, true)
+	if l1 <= 0 {
+		t.Fatalf("Couldn't parse element ID")
+	}
+	size, l2, unknown := readVint(data[l1:], false)
+	if l2 <= 0 {
+		t.Fatalf("Couldn't parse size of element %x", id)
+	}
+	data = data[l1+l2:]
+	if unknown {
+		return id, data, nil
+	}
+	if uint64(len(data)) < size {
+		t.Fatalf("Element %x is truncated", id)
+	}
+	return id, data[:size], data[size:]
+}
+
+type testElement struct {
+	id   uint64
+	data []byte
+}
+
+// parseElements splits data into EBML elements.
+func parseElements(t *testing.T, data []byte) []testElement {
+	var elements []testElement
+	for len(data) > 0 {
+		var e testElement
+		e.id, e.data, data = readElement(t, data)
+		elements = append(elements, e)
+	}
+	return elements
+}
+func testUint(data []byte) uint64 {
+	var v uint64
+	for _, b := range data {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+// vp8Packet returns the i-th packet of a VP8 stream at 10 frames per
+// second, with one keyframe per second.
+func vp8Packet(i int) *rtp.Packet {
+	frame := []byte{0x01, 0, 0}
+	if i%10 == 0 {
+		// a 320x240 keyframe
+		frame = []byte{
+			0x00, 0, 0, 0x9d, 0x01, 0x2a,
+			0x40, 0x01, 0xF0, 0x00,
+		}
+	}
+	return &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         true,
+			PayloadType:    96,
+			SequenceNumber: uint16(i),
+			Timestamp:      uint32(i * 9000),
+			SSRC:           42,
+		},
+		Payload: append([]byte{0x10}, frame...),
+	}
+}
+
+// recordVP8 records 20s of VP8.
+func recordVP8(t *testing.T, dir string) {
+	c := newTestConn(t, nil, nil, dir, &testUpTrack{codec: vp8Codec})
+	for i := 0; i < 200; i++ {
+		err := c.tracks[0].WriteRTP(vp8Packet(i))
+		if err != nil && err != conn.ErrKeyframeNeeded {
+			t.Fatalf("WriteRTP: %v", err)
+		}
+	}
+	c.Close()
+}
+
+func readFile(t *testing.T, filename string) []byte {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	return data
+}
+
+// readSegment returns the contents of the segment of a recording.
+func readSegment(t *testing.T, data []byte) []byte {
+	id, _, data := readElement(t, data)
+	if id != 0x1A45DFA3 {
+		t.Fatalf("Expected EBML header, got %x", id)
+	}
+	id, segment, _ := readElement(t, data)
+	if id != idSegment {
+		t.Fatalf("Expected Segment, got %x", id)
+	}
+	return segment
+}
+
+func TestCues(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	recordVP8(t, dir)
+	segment := readSegment(t, readFile(t, recordingFile(t, dir)))
+
+	seekHead := parseElements(t, segment[:seekHeadSpace])
+	if len(seekHead) != 2 || seekHead[0].id != idSeekHead {
+		t.Fatalf("Expected SeekHead, got %v", seekHead)
+	}
+	cuesPosition := uint64(0)
+	for _, seek := range parseElements(t, seekHead[0].data) {
+		var id, position uint64
+		for _, e := range parseElements(t, seek.data) {
+			switch e.id {
+			case idSeekID:
+				id = testUint(e.data)
+			case idSeekPosition:
+				position = testUint(e.data)
+			}
+		}
+		if id == idCues {
+			cuesPosition = position
+		}
+	}
+	if cuesPosition == 0 {
+		t.Fatalf("No Cues in SeekHead")
+	}
+
+	cues := parseElements(t, segment[cuesPosition:])
+	if len(cues) != 1 || cues[0].id != idCues {
+		t.Fatalf("Expected Cues at end of file")
+	}
+	points := parseElements(t, cues[0].data)
+	if len(points) < 10 {
+		t.Fatalf("Expected at least 10 cue points, got %v",
+			len(points))
+	}
+
+	// seek to the midpoint
+	var cueTime, clusterPosition, relativePosition uint64
+	for _, e := range parseElements(t, points[len(points)/2].data) {
+		switch e.id {
+		case idCueTime:
+			cueTime = testUint(e.data)
+		case idCueTrackPositions:
+			for _, f := range parseElements(t, e.data) {
+				switch f.id {
+				case idCueClusterPosition:
+					clusterPosition = testUint(f.data)
+				case idCueRelativePosition:
+					relativePosition = testUint(f.data)
+				}
+			}
+		}
+	}
+	if cueTime < 8000 || cueTime > 12000 {
+		t.Errorf("Unexpected midpoint %vms", cueTime)
+	}
+	id, cluster, _ := readElement(t, segment[clusterPosition:])
+	if id != idCluster {
+		t.Fatalf("Expected Cluster at cue point, got %x", id)
+	}
+	id, timecode, _ := readElement(t, cluster)
+	if id != idTimecode || testUint(timecode) > cueTime {
+		t.Errorf("Bad cluster timecode %x %v", id, timecode)
+	}
+
+	// the block at the cue point is the keyframe at the cue time
+	if relativePosition >= uint64(len(cluster)) {
+		t.Fatalf("Relative position %v is outside the cluster",
+			relativePosition)
+	}
+	id, block, _ := readElement(t, cluster[relativePosition:])
+	if id != idSimpleBlock || len(block) < 5 {
+		t.Fatalf("Expected SimpleBlock at cue point, got %x", id)
+	}
+	offset := int64(int16(binary.BigEndian.Uint16(block[1:])))
+	if int64(testUint(timecode))+offset != int64(cueTime) {
+		t.Errorf("Expected block at %vms, got %vms",
+			cueTime, int64(testUint(timecode))+offset)
+	}
+	if block[3]&0x80 == 0 || block[4]&0x01 != 0 {
+		t.Errorf("Block at cue point is not a keyframe")
+	}
+}
+
+func TestDuration(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	recordVP8(t, dir)
+	segment := readSegment(t, readFile(t, recordingFile(t, dir)))
+
+	var info []byte
+	for info == nil && len(segment) > 0 {
+		var id uint64
+		var data []byte
+		id, data, segment = readElement(t, segment)
+		if id == idInfo {
+			info = data
+		}
+	}
+	if info == nil {
+		t.Fatalf("Couldn't find Info")
+	}
+
+	var duration float64
+	hasDate := false
+	for _, e := range parseElements(t, info) {
+		switch e.id {
+		case idDuration:
+			if len(e.data) != 8 {
+				t.Fatalf("Bad Duration %v", e.data)
+			}
+			duration = math.Float64frombits(
+				binary.BigEndian.Uint64(e.data),
+			)
+		case idDateUTC:
+			hasDate = true
+		}
+	}
+	if math.IsNaN(duration) || math.IsInf(duration, 0) ||
+		duration < 19000 || duration > 20000 {
+		t.Errorf("Bad duration %vms", duration)
+	}
+	if !hasDate {
+		t.Errorf("No DateUTC")
+	}
+}
+
+func TestMaxFileSize(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	MaxFileSize = 1000
+	defer func() {
+		MaxFileSize = 0
+	}()
+
+	recordVP8(t, dir)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.webm"))
+	if err != nil {
+		t.Fatalf("Glob: %v", err)
+	}
+	if len(files) < 2 {
+		t.Fatalf("Expected multiple files, got %v", len(files))
+	}
+
+	for _, file := range files {
+		segment := readSegment(t, readFile(t, file))
+		var cluster []byte
+		for cluster == nil && len(segment) > 0 {
+			var id uint64
+			var data []byte
+			id, data, segment = readElement(t, segment)
+			if id == idCluster {
+				cluster = data
+			}
+		}
+		if cluster == nil {
+			t.Fatalf("No cluster in %v", file)
+		}
+		id, timecode, rest := readElement(t, cluster)
+		if id != idTimecode || testUint(timecode) != 0 {
+			t.Errorf("Bad timecode in %v", file)
+		}
+		id, block, _ := readElement(t, rest)
+		if id != idSimpleBlock || len(block) < 4 ||
+			block[1] != 0 || block[2] != 0 ||
+			(block[3]&0x80) == 0 {
+			t.Errorf("%v doesn't start with a keyframe at 0",
+				file)
+		}
+	}
+}
+
+func TestSegmentDuration(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	SegmentDuration = time.Nanosecond
+	defer func() {
+		SegmentDuration = 0
+	}()
+
+	recordVP8(t, dir)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.webm"))
+	if err != nil {
+		t.Fatalf("Glob: %v", err)
+	}
+	// a new file is started at each keyframe
+	if len(files) != 20 {
+		t.Errorf("Expected 20 files, got %v", len(files))
+	}
+}
+
+func TestCleanBroken(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	groups := testDirectory(t)
+	defer os.RemoveAll(groups)
+	saved := group.Directory
+	group.Directory = groups
+	Directory = dir
+	defer func() {
+		group.Directory = saved
+		Directory = ""
+		BrokenRecordings = "move"
+		BrokenSize = 1024
+	}()
+	err := ioutil.WriteFile(
+		filepath.Join(groups, "broken.json"), []byte("{}"), 0600,
+	)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	recordVP8(t, dir)
+	good := recordingFile(t, dir)
+	data := readFile(t, good)
+	ok, err := hasCluster(bytes.NewReader(data))
+	if err != nil || !ok {
+		t.Errorf("hasCluster: %v %v", ok, err)
+	}
+	cluster := bytes.Index(data, []byte{0x1F, 0x43, 0xB6, 0x75})
+	if cluster < 0 {
+		t.Fatalf("Couldn't find cluster")
+	}
+
+	groupDir := filepath.Join(dir, "broken")
+	unknownDir := filepath.Join(dir, "unknown")
+	for _, d := range []string{groupDir, unknownDir} {
+		err := os.MkdirAll(d, 0700)
+		if err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+	}
+	createIn := func(dir, name string, data []byte) string {
+		fn := filepath.Join(dir, name)
+		err := ioutil.WriteFile(fn, data, 0600)
+		if err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		return fn
+	}
+	create := func(name string, data []byte) string {
+		return createIn(groupDir, name, data)
+	}
+	headers := create("headers.webm", data[:cluster])
+	headersManifest := create("headers.json", []byte("{}"))
+	empty := create("empty.webm.part", nil)
+	truncated := create("truncated.webm.part", data[:cluster+16])
+	encrypted := create("encrypted.webm",
+		append([]byte(encryptionMagic), make([]byte, cluster+16)...))
+	other := create("other.json.part", nil)
+	unknown := createIn(unknownDir, "empty.webm.part", nil)
+
+	exists := func(fn string) bool {
+		_, err := os.Stat(fn)
+		return err == nil
+	}
+	moved := func(fn string) bool {
+		return !exists(fn) && exists(filepath.Join(
+			filepath.Dir(fn), ".broken", filepath.Base(fn),
+		))
+	}
+
+	// only the size is checked
+	BrokenSize = int64(cluster + 16)
+	CleanBroken()
+	if !moved(headers) || !moved(headersManifest) || !moved(empty) {
+		t.Errorf("Small files were not moved")
+	}
+	if !exists(good) || !exists(truncated) || !exists(encrypted) ||
+		!exists(other) || !exists(unknown) {
+		t.Errorf("Moved too many files")
+	}
+
+	// the contents are checked
+	BrokenSize = 0
+	BrokenRecordings = "delete"
+	headers = create("headers.webm", data[:cluster])
+	encrypted = create("encrypted.webm",
+		append([]byte(encryptionMagic), make([]byte, cluster+16)...))
+	CleanBroken()
+	if exists(headers) {
+		t.Errorf("Recording without clusters was not deleted")
+	}
+	if !exists(filepath.Join(groupDir, ".broken", "empty.webm.part")) {
+		t.Errorf("Broken directory was scanned")
+	}
+	if !exists(good) || !exists(truncated) || !exists(encrypted) ||
+		!exists(other) {
+		t.Errorf("Deleted too many files")
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	file, err := os.OpenFile("/dev/full", os.O_WRONLY, 0)
+	if err != nil {
+		t.Skipf("Open: %v", err)
+	}
+
+	defer func(size int) {
+		BufferSize = size
+	}(BufferSize)
+
+	for _, size := range []int{0, 4096} {
+		BufferSize = size
+		f := newWebmFile(file, nil)
+		n, err := f.Write([]byte{0xEC, 0x81, 0})
+		if n != 3 || err != nil {
+			t.Errorf("Write: %v %v", n, err)
+		}
+		if size > 0 {
+			// the error is reported when the buffer is flushed
+			if f.Err() != nil {
+				t.Errorf("Unexpected error %v", f.Err())
+			}
+			f.Sync()
+		}
+		if !errors.Is(f.Err(), syscall.ENOSPC) {
+			t.Errorf("Expected ENOSPC, got %v", f.Err())
+		}
+	}
+	file.Close()
+}
+
+func TestPartFile(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	count := func(pattern string) int {
+		files, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			t.Fatalf("Glob: %v", err)
+		}
+		return len(files)
+	}
+
+	c := newTestConn(t, nil, nil, dir, &testUpTrack{codec: vp8Codec})
+	for i := 0; i < 10; i++ {
+		err := c.tracks[0].WriteRTP(vp8Packet(i))
+		if err != nil && err != conn.ErrKeyframeNeeded {
+			t.Fatalf("WriteRTP: %v", err)
+		}
+	}
+	if count("*.webm.part") != 1 || count("*.webm") != 0 {
+		t.Errorf("Expected a single part file")
+	}
+	c.Close()
+	if count("*.webm.part") != 0 || count("*.webm") != 1 {
+		t.Errorf("Part file was not renamed")
+	}
+}
+
+func TestEncryptedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galene-encrypt-")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, "test.webm"),
+		os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	f, err := newEncryptedFile(file, key)
+	if err != nil {
+		t.Fatalf("newEncryptedFile: %v", err)
+	}
+
+	data := make([]byte, 3*encryptionChunkSize+1000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	for i := 0; i < len(data); i += 5000 {
+		j := i + 5000
+		if j > len(data) {
+			j = len(data)
+		}
+		_, err := f.Write(data[i:j])
+		if err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	// patch across a chunk boundary, and in the buffered chunk
+	for _, off := range []int{encryptionChunkSize - 4, len(data) - 10} {
+		patch := []byte("patchpatch")
+		_, err = f.WriteAt(patch, int64(off))
+		if err != nil {
+			t.Fatalf("WriteAt %v: %v", off, err)
+		}
+		copy(data[off:], patch)
+	}
+	_, err = f.WriteAt([]byte("x"), int64(len(data)))
+	if err == nil {
+		t.Errorf("WriteAt beyond end succeeded")
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	encrypted, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if bytes.Contains(encrypted, []byte("patchpatch")) {
+		t.Errorf("Plaintext found in encrypted file")
+	}
+
+	var out bytes.Buffer
+	err = DecryptRecording(&out, bytes.NewReader(encrypted), key)
+	if err != nil {
+		t.Fatalf("DecryptRecording: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("Decrypted data doesn't match")
+	}
+
+	// a truncated file yields its complete chunks
+	out.Reset()
+	err = DecryptRecording(&out,
+		bytes.NewReader(encrypted[:len(encrypted)-100]), key)
+	if err == nil {
+		t.Errorf("Truncated file was accepted")
+	}
+	if !bytes.Equal(out.Bytes(), data[:3*encryptionChunkSize]) {
+		t.Errorf("Truncated file: got %v bytes", out.Len())
+	}
+
+	out.Reset()
+	err = DecryptRecording(&out, bytes.NewReader(encrypted),
+		make([]byte, 32))
+	if err == nil || out.Len() != 0 {
+		t.Errorf("Decrypted with wrong key")
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	if thumbnailName("a/b.webm") != "a/b.jpg" {
+		t.Errorf("Thumbnail name: got %v", thumbnailName("a/b.webm"))
+	}
+
+	dir, err := ioutil.TempDir("", "galene-thumbnail-")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	recording := filepath.Join(dir, "test.webm")
+	err = writeThumbnail(recording, []byte{0x00, 0x01, 0x02, 0x03})
+	if err == nil {
+		t.Errorf("Garbage frame was decoded")
+	}
+	if _, err := os.Stat(thumbnailName(recording)); err == nil {
+		t.Errorf("Thumbnail written for garbage frame")
+	}
+	if _, err := os.Stat(thumbnailName(recording) + ".part"); err == nil {
+		t.Errorf("Temporary file was not removed")
+	}
+}
+
+func TestTranscript(t *testing.T) {
+	if transcriptName("a/b.webm") != "a/b.vtt" {
+		t.Errorf("Transcript name: got %v", transcriptName("a/b.webm"))
+	}
+
+	start := time.Unix(1000, 0)
+	messages := []chatMessage{
+		{time: start.Add(-time.Second), username: "bob", text: "early"},
+		{time: start.Add(3723500 * time.Millisecond),
+			username: "alice", text: "a < b\n\n&c"},
+		{time: start.Add(2 * time.Hour), username: "bob",
+			action: true, text: "leaves"},
+		{time: start.Add(time.Minute), text: "anonymous"},
+		{time: start.Add(time.Minute), username: "bob", text: "\n "},
+	}
+	expected := "WEBVTT\n\n" +
+		"00:00:00.000 --> 00:00:05.000\n<v bob>early\n\n" +
+		"01:02:03.500 --> 01:02:08.500\n<v alice>a &lt; b\n&amp;c\n\n" +
+		"01:29:55.000 --> 01:30:00.000\n<v bob><i>bob leaves</i>\n\n" +
+		"00:01:00.000 --> 00:01:05.000\nanonymous\n\n"
+	data := formatTranscript(start, 90*time.Minute, messages)
+	if string(data) != expected {
+		t.Errorf("Got %q, expected %q", data, expected)
+	}
+
+	dir, err := ioutil.TempDir("", "galene-transcript-")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	recording := filepath.Join(dir, "test.webm")
+	err = writeTranscript(recording, data)
+	if err != nil {
+		t.Fatalf("Write transcript: %v", err)
+	}
+	d, err := ioutil.ReadFile(transcriptName(recording))
+	if err != nil || !bytes.Equal(d, data) {
+		t.Errorf("Read transcript: %q, %v", d, err)
+	}
+	if _, err := os.Stat(transcriptName(recording) + ".part"); err == nil {
+		t.Errorf("Temporary file was not removed")
+	}
+}
+
+func TestDataChannels(t *testing.T) {
+	if dataName("a/b.webm") != "a/b.data.jsonl" {
+		t.Errorf("Data name: got %v", dataName("a/b.webm"))
+	}
+
+	start := time.Unix(1000, 0)
+	messages := []dataMessage{
+		{time: start.Add(-time.Second), channel: "poll",
+			data: []byte(`{"a":1}`), text: true},
+		{time: start.Add(1500 * time.Millisecond), channel: "board",
+			data: []byte{0, 1, 2}},
+		{time: start.Add(time.Hour), channel: "poll",
+			data: []byte("late"), text: true},
+	}
+	expected := `{"time":0,"channel":"poll","data":"{\"a\":1}"}` + "\n" +
+		`{"time":1.5,"channel":"board","data":"AAEC","binary":true}` +
+		"\n" + `{"time":60,"channel":"poll","data":"late"}` + "\n"
+	data := formatData(start, time.Minute, messages)
+	if string(data) != expected {
+		t.Errorf("Got %q, expected %q", data, expected)
+	}
+
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	client := &Client{group: testGroup(t, "data")}
+	c := newTestConn(t, client, nil, dir, &testUpTrack{codec: vp8Codec})
+	// the group doesn't record data channels
+	c.WriteData("poll", []byte("ignored"), true)
+
+	now := time.Now()
+	c.addData(dataMessage{
+		time: now, channel: "big", data: make([]byte, MaxDataMessageSize+1),
+	})
+	for i := 0; i < MaxDataRate+5; i++ {
+		c.addData(dataMessage{
+			time: now, channel: "poll", data: []byte("x"), text: true,
+		})
+	}
+	c.addData(dataMessage{
+		time: now.Add(time.Second), channel: "poll",
+		data: []byte("y"), text: true,
+	})
+	for i := 0; i < 20; i++ {
+		err := c.tracks[0].WriteRTP(vp8Packet(i))
+		if err != nil && err != conn.ErrKeyframeNeeded {
+			t.Fatalf("WriteRTP: %v", err)
+		}
+	}
+	c.Close()
+
+	contents := readFile(t, dataName(recordingFile(t, dir)))
+	lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	if len(lines) != MaxDataRate+1 {
+		t.Fatalf("Expected %v messages, got %v", MaxDataRate+1, lines)
+	}
+	var r dataRecord
+	err := json.Unmarshal([]byte(lines[len(lines)-1]), &r)
+	if err != nil || r.Channel != "poll" || r.Data != "y" || r.Binary {
+		t.Errorf("Unexpected record %v, %v", r, err)
+	}
+}
+
+type testSink struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (s *testSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestSink(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	var labels []string
+	var sinks []*testSink
+	Sink = func(group, label string) (io.WriteCloser, error) {
+		labels = append(labels, label)
+		s := &testSink{}
+		sinks = append(sinks, s)
+		return s, nil
+	}
+	defer func() {
+		Sink = nil
+	}()
+
+	recordVP8(t, dir)
+
+	if len(labels) != 1 || labels[0] != ".webm" {
+		t.Fatalf("Unexpected sinks %v", labels)
+	}
+	if !sinks[0].closed {
+		t.Errorf("Sink was not closed")
+	}
+	ok, err := hasCluster(bytes.NewReader(sinks[0].Bytes()))
+	if err != nil || !ok {
+		t.Errorf("Recording is not valid: %v", err)
+	}
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(fis) != 0 {
+		t.Errorf("Unexpected files %v", fis)
+	}
+}
+
+func TestManifestTrack(t *testing.T) {
+	track := newManifestTrack("audio", webrtc.RTPCodecCapability{
+		MimeType:    "audio/opus",
+		ClockRate:   48000,
+		Channels:    2,
+		SDPFmtpLine: "minptime=10;useinbandfec=1;sprop-stereo=1",
+		RTCPFeedback: []webrtc.RTCPFeedback{
+			{Type: "transport-cc"}, {Type: "nack", Parameter: "pli"},
+		},
+	})
+	data, err := json.Marshal(track)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	expected := `{"name":"audio","codec":"audio/opus",` +
+		`"clock-rate":48000,` +
+		`"fmtp":"minptime=10;useinbandfec=1;sprop-stereo=1",` +
+		`"rtcp-feedback":["transport-cc","nack pli"]}`
+	if string(data) != expected {
+		t.Errorf("Got %v, expected %v", string(data), expected)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	Manifest = true
+	defer func() {
+		Manifest = false
+	}()
+
+	recordVP8(t, dir)
+
+	recording := recordingFile(t, dir)
+	fi, err := os.Stat(recording)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	data := readFile(t, manifestName(recording))
+
+	// check the schema
+	var raw map[string]interface{}
+	err = json.Unmarshal(data, &raw)
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	for _, field := range []struct {
+		name, kind string
+	}{
+		{"group", "string"}, {"id", "string"},
+		{"start", "string"}, {"end", "string"},
+		{"timezone", "string"},
+		{"size", "number"}, {"tracks", "array"},
+	} {
+		var ok bool
+		switch field.kind {
+		case "string":
+			_, ok = raw[field.name].(string)
+		case "number":
+			_, ok = raw[field.name].(float64)
+		case "array":
+			_, ok = raw[field.name].([]interface{})
+		}
+		if !ok {
+			t.Errorf("Field %v is missing or not a %v: %v",
+				field.name, field.kind, raw[field.name])
+		}
+	}
+
+	if _, ok := raw["capture-start"]; ok {
+		t.Errorf("Unexpected capture-start without capture times")
+	}
+
+	var m manifest
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if m.Id != "up" || m.Size != fi.Size() || m.End.Before(m.Start) {
+		t.Errorf("Unexpected manifest %v", m)
+	}
+	if len(m.Tracks) != 1 || m.Tracks[0].Codec != "video/vp8" ||
+		m.Tracks[0].Width != 320 || m.Tracks[0].Height != 240 ||
+		m.Tracks[0].ClockRate != 90000 {
+		t.Errorf("Unexpected tracks %v", m.Tracks)
+	}
+
+	parts, err := filepath.Glob(filepath.Join(dir, "*.part"))
+	if err != nil {
+		t.Fatalf("Glob: %v", err)
+	}
+	if len(parts) != 0 {
+		t.Errorf("Temporary files remain: %v", parts)
+	}
+}
+
+func TestReceptionStats(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	Manifest = true
+	defer func() {
+		Manifest = false
+	}()
+
+	c := newTestConn(t, nil, nil, dir, &testUpTrack{codec: vp8Codec})
+	for i := 0; i < 50; i++ {
+		if i == 13 || i == 27 || i == 35 {
+			continue
+		}
+		err := c.tracks[0].WriteRTP(vp8Packet(i))
+		if err != nil && err != conn.ErrKeyframeNeeded {
+			t.Fatalf("WriteRTP: %v", err)
+		}
+	}
+	// a reordered packet is not lost
+	err := c.tracks[0].WriteRTP(vp8Packet(35))
+	if err != nil && err != conn.ErrKeyframeNeeded {
+		t.Fatalf("WriteRTP: %v", err)
+	}
+
+	s := c.stats().Tracks[0]
+	if s.Packets != 50 || s.Lost != 2 {
+		t.Errorf("Expected 2 of 50 packets lost, got %v of %v",
+			s.Lost, s.Packets)
+	}
+	c.Close()
+
+	var m manifest
+	err = json.Unmarshal(
+		readFile(t, manifestName(recordingFile(t, dir))), &m,
+	)
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	// packets received before the file was opened are not counted
+	if len(m.Tracks) != 1 || m.Tracks[0].Lost != 2 ||
+		m.Tracks[0].Packets < 45 || m.Tracks[0].Packets > 50 {
+		t.Errorf("Unexpected tracks %v", m.Tracks)
+	}
+}
+
+func TestFilenameTemplate(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	FilenameTemplate = `{{.Group}}/{{.Time.Format "2006"}}/{{.Label}}`
+	defer func() {
+		FilenameTemplate = ""
+	}()
+
+	data := filenameData{Group: "room", Label: "../../user"}
+	for i := 0; i < 2; i++ {
+		f, err := openDiskFile(dir, data)
+		if err != nil {
+			t.Fatalf("openDiskFile: %v", err)
+		}
+		f.Close()
+		delOpenFile(f.Name())
+	}
+
+	year := time.Now().Format("2006")
+	for _, fn := range []string{
+		".._.._user.webm.part", ".._.._user-01.webm.part",
+	} {
+		_, err := os.Stat(filepath.Join(dir, "room", year, fn))
+		if err != nil {
+			t.Errorf("Stat: %v", err)
+		}
+	}
+
+	FilenameTemplate = "../{{.Label}}"
+	_, err := openDiskFile(dir, data)
+	if err == nil {
+		t.Errorf("Filename outside of directory was accepted")
+	}
+}
+
+func TestUTCFilenames(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skipf("LoadLocation: %v", err)
+	}
+	// daylight saving time ends in the meantime
+	times := []time.Time{
+		time.Date(2021, 10, 31, 0, 30, 0, 0, time.UTC).In(paris),
+		time.Date(2021, 10, 31, 1, 10, 0, 0, time.UTC).In(paris),
+	}
+
+	filenames := func() []string {
+		var names []string
+		for _, tm := range times {
+			name, err := recordingFilename(
+				nil, filenameData{Time: tm},
+			)
+			if err != nil {
+				t.Fatalf("recordingFilename: %v", err)
+			}
+			names = append(names, name)
+		}
+		return names
+	}
+
+	local := filenames()
+	if local[0] < local[1] {
+		t.Errorf("Expected local times to go backwards, got %v", local)
+	}
+
+	UTCFilenames = true
+	defer func() {
+		UTCFilenames = false
+	}()
+	utc := filenames()
+	if utc[0] >= utc[1] {
+		t.Errorf("UTC filenames are not monotonic: %v", utc)
+	}
+	expected := "2021-10-31T00:30:00.000Z"
+	if runtime.GOOS == "windows" {
+		expected = "2021-10-31T00-30-00-000Z"
+	}
+	if utc[0] != expected {
+		t.Errorf("Expected %v, got %v", expected, utc[0])
+	}
+}
+
+func TestFilenameCollision(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	FilenameTemplate = "fixed"
+	FilenameAttempts = 3
+	defer func() {
+		FilenameTemplate = ""
+		FilenameAttempts = 100
+	}()
+
+	var names []string
+	for i := 0; i < 5; i++ {
+		f, err := openDiskFile(dir, filenameData{})
+		if err != nil {
+			t.Fatalf("openDiskFile: %v", err)
+		}
+		f.Close()
+		delOpenFile(f.Name())
+		names = append(names, filepath.Base(f.Name()))
+	}
+
+	for i, name := range []string{
+		"fixed.webm.part", "fixed-01.webm.part", "fixed-02.webm.part",
+	} {
+		if names[i] != name {
+			t.Errorf("Expected %v, got %v", name, names[i])
+		}
+	}
+	random := regexp.MustCompile(`^fixed-[0-9a-f]{8}\.webm\.part$`)
+	for _, name := range names[3:] {
+		if !random.MatchString(name) {
+			t.Errorf("Expected a random suffix, got %v", name)
+		}
+	}
+}
+
+func TestLabelCollision(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	// the names don't depend on the time, as if both connections
+	// started at the same instant
+	FilenameTemplate = "{{.Label}}"
+	defer func() {
+		FilenameTemplate = ""
+	}()
+
+	client := &Client{group: testGroup(t, "conn")}
+	var conns []*diskConn
+	// the ids must not occur in the label, or the name is
+	// disambiguated with a counter
+	for _, id := range []string{"1", "2"} {
+		track := &testUpTrack{codec: vp8Codec}
+		up := &testUp{id: id, label: "camera"}
+		c := newTestConn(t, client, up, dir, track)
+		conns = append(conns, c)
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *diskConn) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				err := c.tracks[0].WriteRTP(vp8Packet(i))
+				if err != nil && err != conn.ErrKeyframeNeeded {
+					t.Errorf("WriteRTP: %v", err)
+					return
+				}
+			}
+			c.Close()
+		}(c)
+	}
+	wg.Wait()
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	var names []string
+	for _, fi := range fis {
+		if filepath.Ext(fi.Name()) == ".webm" && !isSymlink(fi) {
+			names = append(names, fi.Name())
+		}
+	}
+	// ReadDir sorts by name, and "-" sorts before "."
+	if len(names) != 2 || names[1] != "camera.webm" ||
+		(names[0] != "camera-1.webm" && names[0] != "camera-2.webm") {
+		t.Fatalf("Unexpected recordings %v", names)
+	}
+	for _, name := range names {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		ok, err := hasCluster(f)
+		f.Close()
+		if err != nil || !ok {
+			t.Errorf("Recording %v is not valid: %v", name, err)
+		}
+	}
+}
+
+func TestMinFreeSpace(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	free, err := freeSpace(dir)
+	if err != nil {
+		t.Skipf("freeSpace: %v", err)
+	}
+
+	Directory = dir
+	MinFreeSpace = free + 1<<40
+	defer func() {
+		Directory = ""
+		MinFreeSpace = 0
+	}()
+
+	g := testGroup(t, "test")
+	client := &Client{group: g}
+	defer client.Close()
+
+	up := &testUp{id: "up"}
+	err = client.PushConn(g, up.id, up, nil, "")
+	if err != errLowDiskSpace {
+		t.Errorf("Expected %v, got %v", errLowDiskSpace, err)
+	}
+	if len(client.down) != 0 {
+		t.Errorf("Connection recorded despite low disk space")
+	}
+
+	MinFreeSpace = 1
+	err = client.PushConn(g, up.id, up, nil, "")
+	if err != nil {
+		t.Errorf("PushConn: %v", err)
+	}
+	if len(client.down) != 1 {
+		t.Errorf("Connection not recorded")
+	}
+}
+
+func TestMultipleRecorders(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	Directory = dir
+	defer func() {
+		Directory = ""
+	}()
+
+	g := testGroupDescription(t, "recorders", `{"allow-recording": true}`)
+	names := []string{"local", "cloud"}
+	rates := []uint64{100000, 500000}
+	var clients []*Client
+	for i, name := range names {
+		client, err := StartRecorder(g, Options{
+			Name:       name,
+			MaxBitrate: rates[i],
+		})
+		if err != nil {
+			t.Fatalf("StartRecorder: %v", err)
+		}
+		if client.Name() != name {
+			t.Errorf("Expected name %v, got %v",
+				name, client.Name())
+		}
+		clients = append(clients, client)
+	}
+	_, err := StartRecorder(g, Options{Name: names[0]})
+	if err == nil {
+		t.Errorf("Started two recorders with the same name")
+	}
+
+	// two simulcast layers, each of which fits one of the recorders
+	layers := []conn.UpTrack{
+		&testUpTrack{codec: vp8Codec, label: "video", bitrate: 80000},
+		&testUpTrack{codec: vp8Codec, label: "video", bitrate: 400000},
+	}
+	up := &testUp{id: "up", label: "camera"}
+	var conns []*diskConn
+	for i, client := range clients {
+		c := newTestConn(t, client, up, "", layers...)
+		if c.video != layers[i] {
+			t.Errorf("Recorder %v selected the wrong layer",
+				names[i])
+		}
+		// the recorders don't limit the sender
+		if r := c.GetMaxBitrate(0); r != ^uint64(0) {
+			t.Errorf("Expected no bitrate limit, got %v", r)
+		}
+		conns = append(conns, c)
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *diskConn) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				err := c.tracks[0].WriteRTP(vp8Packet(i))
+				if err != nil && err != conn.ErrKeyframeNeeded {
+					t.Errorf("WriteRTP: %v", err)
+					return
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	if n := Stop(g, names[0]); n != 1 {
+		t.Errorf("Expected 1 connection, got %v", n)
+	}
+	if findRecorder(g, names[0]) != nil ||
+		findRecorder(g, names[1]) != clients[1] {
+		t.Errorf("Stop affected the wrong recorders")
+	}
+	if !clients[1].IsRecording() {
+		t.Errorf("Recorder %v was stopped", names[1])
+	}
+	Stop(g, names[1])
+	if len(g.GetClients(nil)) != 0 {
+		t.Errorf("Recording clients are still in the group")
+	}
+
+	fis, err := ioutil.ReadDir(filepath.Join(dir, "recorders"))
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	var files []string
+	for _, fi := range fis {
+		if filepath.Ext(fi.Name()) == ".webm" && !isSymlink(fi) {
+			files = append(files, fi.Name())
+		}
+	}
+	if len(files) != 2 {
+		t.Fatalf("Expected 2 recordings, got %v", files)
+	}
+	for _, name := range files {
+		f, err := os.Open(filepath.Join(dir, "recorders", name))
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		ok, err := hasCluster(f)
+		f.Close()
+		if err != nil || !ok {
+			t.Errorf("Recording %v is not valid: %v", name, err)
+		}
+	}
+}
+
+func TestSubdirectory(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	Directory = dir
+	Subdirectory = "user"
+	defer func() {
+		Directory = ""
+		Subdirectory = ""
+	}()
+
+	g := testGroup(t, "test")
+	client := &Client{group: g}
+	defer client.Close()
+
+	ups := []*testUp{{id: "1", username: "../bob"}, {id: "2"}}
+	for _, up := range ups {
+		newTestConn(t, client, up, "")
+	}
+
+	for _, d := range []string{".._bob", "2"} {
+		fi, err := os.Stat(filepath.Join(dir, "test", d))
+		if err != nil || !fi.IsDir() {
+			t.Errorf("Expected directory %v", d)
+		}
+	}
+}
+
+func TestTrackName(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	track := &testUpTrack{codec: vp8Codec}
+	up := &testUp{id: "up", username: " ali\x00ce\xff"}
+	c := newTestConn(t, nil, up, dir, track)
+	for i := 0; i < 20; i++ {
+		err := c.tracks[0].WriteRTP(vp8Packet(i))
+		if err != nil && err != conn.ErrKeyframeNeeded {
+			t.Fatalf("WriteRTP: %v", err)
+		}
+	}
+	c.Close()
+
+	entries := readRecording(t, dir).Tracks.TrackEntry
+	if len(entries) != 1 || entries[0].Name != "alice\uFFFD" {
+		t.Errorf("Unexpected tracks %v", entries)
+	}
+}
+
+func TestChapters(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	Directory = dir
+	defer func() {
+		Directory = ""
+	}()
+
+	g := testGroup(t, "test")
+	client := &Client{group: g}
+
+	track := &testUpTrack{codec: vp8Codec}
+	alice := &testUp{id: "1", username: "alice"}
+	newTestConn(t, client, alice, "", track)
+	write := func(from, to int) {
+		client.mu.Lock()
+		c := client.down[alice.id]
+		client.mu.Unlock()
+		for i := from; i < to; i++ {
+			err := c.tracks[0].WriteRTP(vp8Packet(i))
+			if err != nil && err != conn.ErrKeyframeNeeded {
+				t.Fatalf("WriteRTP: %v", err)
+			}
+		}
+	}
+
+	write(0, 10)
+	time.Sleep(200 * time.Millisecond)
+	bob := &testUp{id: "2", username: "bob"}
+	newTestConn(t, client, bob, "")
+	time.Sleep(200 * time.Millisecond)
+	err := client.PushConn(g, bob.id, nil, nil, "")
+	if err != nil {
+		t.Fatalf("PushConn: %v", err)
+	}
+	write(10, 20)
+	client.Close()
+
+	segment := readSegment(t,
+		readFile(t, recordingFile(t, filepath.Join(dir, "test"))),
+	)
+	seekHead := parseElements(t, segment[:seekHeadSpace])
+	chaptersPosition := uint64(0)
+	for _, seek := range parseElements(t, seekHead[0].data) {
+		var id, position uint64
+		for _, e := range parseElements(t, seek.data) {
+			switch e.id {
+			case idSeekID:
+				id = testUint(e.data)
+			case idSeekPosition:
+				position = testUint(e.data)
+			}
+		}
+		if id == idChapters {
+			chaptersPosition = position
+		}
+	}
+	if chaptersPosition == 0 {
+		t.Fatalf("No Chapters in SeekHead")
+	}
+
+	id, chapters, _ := readElement(t, segment[chaptersPosition:])
+	if id != idChapters {
+		t.Fatalf("Expected Chapters, got %x", id)
+	}
+	id, edition, _ := readElement(t, chapters)
+	if id != idEditionEntry {
+		t.Fatalf("Expected EditionEntry, got %x", id)
+	}
+	var titles []string
+	var times []uint64
+	for _, atom := range parseElements(t, edition) {
+		if atom.id != idChapterAtom {
+			t.Fatalf("Expected ChapterAtom, got %x", atom.id)
+		}
+		for _, e := range parseElements(t, atom.data) {
+			switch e.id {
+			case idChapterTimeStart:
+				times = append(times, testUint(e.data))
+			case idChapterDisplay:
+				for _, f := range parseElements(t, e.data) {
+					if f.id == idChapString {
+						titles = append(titles,
+							string(f.data))
+					}
+				}
+			}
+		}
+	}
+
+	if len(titles) != 2 || titles[0] != "bob joined" ||
+		titles[1] != "bob left" {
+		t.Errorf("Unexpected chapters %v", titles)
+	}
+	if len(times) != 2 ||
+		times[0] < uint64(150*time.Millisecond) ||
+		times[0] > uint64(time.Second) ||
+		times[1] < times[0]+uint64(150*time.Millisecond) {
+		t.Errorf("Unexpected chapter times %v", times)
+	}
+}
+
+func TestLatest(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no symbolic links on Windows")
+	}
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	Directory = dir
+	defer func() {
+		Directory = ""
+	}()
+
+	g := testGroup(t, "test")
+	client := &Client{group: g}
+	defer client.Close()
+
+	track := &testUpTrack{codec: vp8Codec}
+	latest := filepath.Join(dir, "test", "latest.webm")
+	var recordings []string
+	for _, id := range []string{"1", "2"} {
+		c := newTestConn(t, client, &testUp{id: id}, "", track)
+		for i := 0; i < 20; i++ {
+			err := c.tracks[0].WriteRTP(vp8Packet(i))
+			if err != nil && err != conn.ErrKeyframeNeeded {
+				t.Fatalf("WriteRTP: %v", err)
+			}
+		}
+		err := client.PushConn(g, id, nil, nil, "")
+		if err != nil {
+			t.Fatalf("PushConn: %v", err)
+		}
+
+		target, err := os.Readlink(latest)
+		if err != nil {
+			t.Fatalf("Readlink: %v", err)
+		}
+		if filepath.IsAbs(target) || filepath.Ext(target) != ".webm" {
+			t.Errorf("Unexpected target %v", target)
+		}
+		for _, r := range recordings {
+			if r == target {
+				t.Errorf("Latest wasn't updated")
+			}
+		}
+		recordings = append(recordings, target)
+		_, err = os.Stat(latest)
+		if err != nil {
+			t.Errorf("Stat: %v", err)
+		}
+	}
+
+	for _, r := range recordings {
+		err := removeRecording(filepath.Join(dir, "test", r))
+		if err != nil {
+			t.Errorf("removeRecording: %v", err)
+		}
+	}
+	_, err := os.Lstat(latest)
+	if !os.IsNotExist(err) {
+		t.Errorf("Dangling pointer was not removed: %v", err)
+	}
+}
+
+func TestRecordingPermissions(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	saved := group.Directory
+	group.Directory = dir
+	defer func() {
+		group.Directory = saved
+	}()
+
+	for name, desc := range map[string]string{
+		"forbidden": `{}`,
+		"allowed":   `{"allow-recording": true}`,
+	} {
+		err := ioutil.WriteFile(
+			filepath.Join(dir, name+".json"), []byte(desc), 0600,
+		)
+		if err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	defer func(username string) {
+		Username = username
+	}(Username)
+	Username = "Recorder"
+
+	forbidden, err := group.Add("forbidden", nil)
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	_, err = Start(forbidden)
+	if err == nil {
+		t.Errorf("Recording started in a group that forbids it")
+	}
+
+	allowed, err := group.Add("allowed", nil)
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	client, err := Start(allowed)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer Stop(allowed, "")
+	if client.Username() != "Recorder" {
+		t.Errorf("Expected username Recorder, got %v",
+			client.Username())
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	Directory = dir
+	defer func() {
+		Directory = ""
+	}()
+
+	saved := group.Directory
+	group.Directory = dir
+	defer func() {
+		group.Directory = saved
+	}()
+	err := ioutil.WriteFile(filepath.Join(dir, "shutdown.json"),
+		[]byte(`{"allow-recording": true}`), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	g, err := group.Add("shutdown", nil)
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	client, err := Start(g)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	track := &testUpTrack{codec: vp8Codec}
+	c := newTestConn(t, client, &testUp{id: "1"}, "", track)
+	for i := 0; i < 50; i++ {
+		err := c.tracks[0].WriteRTP(vp8Packet(i))
+		if err != nil && err != conn.ErrKeyframeNeeded {
+			t.Fatalf("WriteRTP: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = Shutdown(ctx)
+	if err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	if len(g.GetClients(nil)) != 0 {
+		t.Errorf("Recording client is still in the group")
+	}
+	parts, err := filepath.Glob(filepath.Join(dir, "shutdown", "*.part"))
+	if err != nil || len(parts) != 0 {
+		t.Errorf("Unexpected partial files %v (%v)", parts, err)
+	}
+	recordingFile(t, filepath.Join(dir, "shutdown"))
+}
+
+func TestRecordingLimit(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	Directory = dir
+	defer func() {
+		Directory = ""
+	}()
+
+	saved := group.Directory
+	group.Directory = dir
+	defer func() {
+		group.Directory = saved
+	}()
+	err := ioutil.WriteFile(filepath.Join(dir, "limited.json"),
+		[]byte(`{"max-recordings": 2}`), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	g, err := group.Add("limited", nil)
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	push := func(client *Client, g *group.Group, id string) error {
+		up := &testUp{id: id}
+		return client.PushConn(g, id, up, nil, "")
+	}
+
+	count := Recordings()
+	client := &Client{group: g}
+	for _, id := range []string{"1", "2"} {
+		err := push(client, g, id)
+		if err != nil {
+			t.Fatalf("PushConn: %v", err)
+		}
+	}
+	err = push(client, g, "3")
+	if err != errTooManyRecordings {
+		t.Errorf("Expected errTooManyRecordings, got %v", err)
+	}
+	// the limit applies to all the recording clients of the group
+	other := &Client{group: g}
+	err = push(other, g, "3")
+	if err != errTooManyRecordings {
+		t.Errorf("Expected errTooManyRecordings, got %v", err)
+	}
+	other.Close()
+	err = push(client, g, "2")
+	if err != nil {
+		t.Errorf("Replace connection: %v", err)
+	}
+	if Recordings() != count+2 {
+		t.Errorf("Expected %v recordings, got %v",
+			count+2, Recordings())
+	}
+	err = client.PushConn(g, "1", nil, nil, "")
+	if err != nil {
+		t.Fatalf("PushConn: %v", err)
+	}
+	err = push(client, g, "3")
+	if err != nil {
+		t.Errorf("PushConn after removal: %v", err)
+	}
+	if len(client.GetStats().Down) != 2 {
+		t.Errorf("Expected 2 connections in stats, got %v",
+			len(client.GetStats().Down))
+	}
+	client.Close()
+	if Recordings() != count {
+		t.Errorf("Expected %v recordings, got %v", count, Recordings())
+	}
+
+	MaxRecordings = count + 1
+	defer func() {
+		MaxRecordings = 0
+	}()
+	tg := testGroup(t, "test")
+	client = &Client{group: tg}
+	defer client.Close()
+	err = push(client, tg, "1")
+	if err != nil {
+		t.Fatalf("PushConn: %v", err)
+	}
+	err = push(client, tg, "2")
+	if err != errTooManyRecordings {
+		t.Errorf("Expected errTooManyRecordings, got %v", err)
+	}
+}
+
+func TestWarn(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	c := &diskConn{client: &Client{group: testGroup(t, "warn")}}
+	count := func(message string) int {
+		return strings.Count(buf.String(), message+"\n")
+	}
+
+	c.warn("disk slow")
+	c.warn("disk slow")
+	c.warn("disk broken")
+	if count("disk slow") != 1 || count("disk broken") != 1 {
+		t.Errorf("Unexpected warnings %q", buf.String())
+	}
+
+	defer func(interval time.Duration) {
+		WarnInterval = interval
+	}(WarnInterval)
+	WarnInterval = 0
+	c.warn("disk slow")
+	if count("disk slow") != 2 {
+		t.Errorf("Warning was throttled")
+	}
+}
+
+func TestGroupDirectory(t *testing.T) {
+	Directory = "/recordings"
+	defer func() {
+		Directory = ""
+	}()
+
+	good := map[string]string{
+		"a":     "/recordings/a",
+		"a/b":   "/recordings/a/b",
+		"a..b":  "/recordings/a..b",
+		".a/b.": "/recordings/.a/b.",
+	}
+	for name, expected := range good {
+		d, err := groupDirectory(name)
+		if err != nil || d != filepath.FromSlash(expected) {
+			t.Errorf("%v: expected %v, got %v (%v)",
+				name, expected, d, err)
+		}
+	}
+
+	bad := []string{
+		"", "..", "../a", "a/..", "a/../../b", "/a", "//a", "a//b",
+		"a/./b", "./a", "a/", `a\..\b`, `..\a`, "a\x00b",
+	}
+	for _, name := range bad {
+		d, err := groupDirectory(name)
+		if err == nil {
+			t.Errorf("%q: expected error, got %v", name, d)
+		}
+	}
+}
+
+func TestGroupDirectoryOverride(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+	allowed := testDirectory(t)
+	defer os.RemoveAll(allowed)
+	other := testDirectory(t)
+	defer os.RemoveAll(other)
+
+	Directory = dir
+	AllowedDirectories = []string{allowed}
+	saved := group.Directory
+	group.Directory = dir
+	defer func() {
+		Directory = ""
+		AllowedDirectories = nil
+		group.Directory = saved
+	}()
+
+	overrides := map[string]string{
+		"override-relative": "secure/relative",
+		"override-absolute": filepath.Join(allowed, "absolute"),
+		"override-escape":   "../escape",
+		"override-other":    filepath.Join(other, "other"),
+		"override-root":     allowed,
+	}
+	for name, d := range overrides {
+		data, err := json.Marshal(map[string]interface{}{
+			"recording-directory": d,
+			"allow-subgroups":     true,
+		})
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		err = ioutil.WriteFile(
+			filepath.Join(dir, name+".json"), data, 0600,
+		)
+		if err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	_, err := group.Add("override-absolute", nil)
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	good := map[string]string{
+		"override-plain": filepath.Join(dir, "override-plain"),
+		"override-relative": filepath.Join(
+			dir, "secure", "relative",
+		),
+		"override-relative/sub": filepath.Join(
+			dir, "secure", "relative", "sub",
+		),
+		"override-absolute": filepath.Join(allowed, "absolute"),
+	}
+	for name, expected := range good {
+		d, err := GroupDirectory(name)
+		if err != nil || d != expected {
+			t.Errorf("%v: expected %v, got %v (%v)",
+				name, expected, d, err)
+		}
+	}
+
+	for _, name := range []string{
+		"override-escape", "override-other", "override-root",
+	} {
+		d, err := GroupDirectory(name)
+		if err == nil {
+			t.Errorf("%v: expected error, got %v", name, d)
+		}
+	}
+
+	names := map[string][2]string{
+		"override-plain/a.webm": {
+			"override-plain",
+			filepath.Join(dir, "override-plain", "a.webm"),
+		},
+		"override-absolute/b.webm": {
+			"override-absolute",
+			filepath.Join(allowed, "absolute", "b.webm"),
+		},
+	}
+	for expected, v := range names {
+		name, err := relativeName(v[0], v[1])
+		if err != nil || name != expected {
+			t.Errorf("%v: expected %v, got %v (%v)",
+				v[1], expected, name, err)
+		}
+	}
+	_, err = relativeName(
+		"override-absolute", filepath.Join(other, "c.webm"),
+	)
+	if err == nil {
+		t.Errorf("Expected error for file outside directories")
+	}
+}
+
+func TestStats(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	c := newTestConn(t, nil, nil, dir, &testUpTrack{codec: vp8Codec})
+	client := &Client{down: map[string]*diskConn{"up": c}}
+	for i := 0; i < 25; i++ {
+		p := vp8Packet(i)
+		c.tracks[0].Accumulate(uint32(12 + len(p.Payload)))
+		err := c.tracks[0].WriteRTP(p)
+		if err != nil && err != conn.ErrKeyframeNeeded {
+			t.Fatalf("WriteRTP: %v", err)
+		}
+	}
+
+	stats := client.Stats()
+	if len(stats) != 1 || stats[0].Id != "up" ||
+		len(stats[0].Tracks) != 1 {
+		t.Fatalf("Unexpected stats %v", stats)
+	}
+	s := stats[0].Tracks[0]
+	// the last sample is still in the sample builder
+	if s.Samples != 24 || s.Keyframes != 3 || s.Bytes == 0 {
+		t.Errorf("Unexpected track stats %v", s)
+	}
+	// the connection was not counted by PushConn
+	c.Close()
+}
+
+func TestPause(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	c := newTestConn(t, nil, nil, dir, &testUpTrack{codec: vp8Codec})
+	write := func(i int) error {
+		err := c.tracks[0].WriteRTP(vp8Packet(i))
+		if err != nil && err != conn.ErrKeyframeNeeded {
+			t.Fatalf("WriteRTP: %v", err)
+		}
+		return err
+	}
+
+	for i := 0; i < 10; i++ {
+		write(i)
+	}
+	c.setPaused(true)
+	for i := 10; i < 30; i++ {
+		write(i)
+	}
+	c.setPaused(false)
+	// this pops the last sample before the keyframe
+	err := write(30)
+	if err != conn.ErrKeyframeNeeded {
+		t.Errorf("Expected ErrKeyframeNeeded, got %v", err)
+	}
+	for i := 31; i < 46; i++ {
+		write(i)
+	}
+
+	s := c.stats().Tracks[0]
+	if s.Samples != 9+15 {
+		t.Errorf("Expected %v samples, got %v", 9+15, s.Samples)
+	}
+	c.Close()
+}
+
+func TestKeyframeRequests(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	c := newTestConn(t, nil, nil, dir, &testUpTrack{codec: vp8Codec})
+	requests := func(from, to int) int {
+		count := 0
+		for i := from; i < to; i++ {
+			err := c.tracks[0].WriteRTP(vp8Packet(i))
+			if err == conn.ErrKeyframeNeeded {
+				count++
+			} else if err != nil {
+				t.Fatalf("WriteRTP: %v", err)
+			}
+		}
+		return count
+	}
+
+	// no keyframe yet, requests are coalesced
+	if n := requests(1, 6); n != 1 {
+		t.Errorf("Expected 1 request, got %v", n)
+	}
+	c.tracks[0].mu.Lock()
+	c.tracks[0].kfRequested =
+		time.Now().Add(-keyframeRequestInterval)
+	c.tracks[0].mu.Unlock()
+	if n := requests(6, 10); n != 1 {
+		t.Errorf("Expected 1 request, got %v", n)
+	}
+	// the keyframe is written, and no more requests are needed
+	if n := requests(10, 20); n != 0 {
+		t.Errorf("Expected no requests, got %v", n)
+	}
+	if !c.tracks[0].kfRequested.IsZero() {
+		t.Errorf("Keyframe request not reset")
+	}
+	c.Close()
+}
+
+func TestAudioOnly(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	tracks := []conn.UpTrack{
+		&testUpTrack{codec: vp8Codec},
+		&testUpTrack{codec: opusCodec},
+	}
+	client := &Client{group: testGroup(t, "conn"), audioOnly: true}
+	c := newTestConn(t, client, nil, dir, tracks...)
+	if len(c.tracks) != 1 || c.videoCount != 0 {
+		t.Fatalf("Expected a single audio track")
+	}
+
+	for i := 0; i < 10; i++ {
+		p := rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				PayloadType:    111,
+				SequenceNumber: uint16(i),
+				Timestamp:      uint32(i * 960),
+				SSRC:           42,
+			},
+			Payload: []byte{0xFC, 0xFF, 0xFE},
+		}
+		err := c.tracks[0].WriteRTP(&p)
+		if err != nil {
+			t.Fatalf("WriteRTP: %v", err)
+		}
+	}
+	c.Close()
+
+	segment := readRecording(t, dir)
+	if len(segment.Tracks.TrackEntry) != 1 ||
+		segment.Tracks.TrackEntry[0].CodecID != "A_OPUS" {
+		t.Errorf("Expected a single Opus track, got %v",
+			segment.Tracks.TrackEntry)
+	}
+}
+
+func TestVideoLabel(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	tracks := []conn.UpTrack{
+		&testUpTrack{codec: vp8Codec, label: "camera", bitrate: 500000},
+		&testUpTrack{codec: vp8Codec, label: "screenshare"},
+	}
+
+	for _, test := range []struct {
+		label    string
+		expected string
+	}{{"", "camera"}, {"screenshare", "screenshare"}, {"none", "camera"}} {
+		VideoLabel = test.label
+		c := newTestConn(t, nil, nil, dir, tracks...)
+		if len(c.tracks) != 1 ||
+			c.tracks[0].remote.Label() != test.expected {
+			t.Errorf("%q: expected track %v",
+				test.label, test.expected)
+		}
+		c.Close()
+	}
+	VideoLabel = ""
+}
+
+func TestSelectVideoBitrate(t *testing.T) {
+	tracks := []conn.UpTrack{
+		&testUpTrack{codec: vp8Codec, bitrate: 150000},
+		&testUpTrack{codec: vp8Codec, bitrate: 1500000},
+		&testUpTrack{codec: vp8Codec, bitrate: 500000},
+	}
+	for _, test := range []struct {
+		maxBitrate uint64
+		expected   int
+	}{{0, 1}, {2000000, 1}, {1000000, 2}, {500000, 2}, {200000, 0},
+		{100000, 0}} {
+		video, provisional := selectVideo(tracks, test.maxBitrate)
+		if video != tracks[test.expected] || provisional {
+			t.Errorf("%v: expected track %v",
+				test.maxBitrate, test.expected)
+		}
+	}
+}
+
+func TestSimulcast(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	Directory = dir
+	defer func(delay time.Duration) {
+		Directory = ""
+		selectDelay = delay
+	}(selectDelay)
+	selectDelay = 50 * time.Millisecond
+
+	// the layers of a simulcast sender share the same label
+	layers := []*testUpTrack{
+		{codec: vp8Codec, label: "video"},
+		{codec: vp8Codec, label: "video"},
+		{codec: vp8Codec, label: "video"},
+	}
+	tracks := []conn.UpTrack{&testUpTrack{codec: opusCodec, label: "audio"}}
+	for _, l := range layers {
+		tracks = append(tracks, l)
+	}
+
+	g := testGroup(t, "simulcast")
+	client := New(g, "RECORDING", false)
+	defer client.Close()
+	up := &testUp{id: "up", label: "camera"}
+	video := func() conn.UpTrack {
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		c := client.down[up.id]
+		if c == nil || len(c.tracks) != 2 {
+			t.Fatalf("Expected an audio and a video track")
+		}
+		return c.video
+	}
+
+	// the bitrates are not known yet
+	newTestConn(t, client, up, "", tracks...)
+	if video() != layers[0] {
+		t.Errorf("Expected the first layer before bitrates are known")
+	}
+	atomic.StoreUint64(&layers[0].bitrate, 150000)
+	atomic.StoreUint64(&layers[1].bitrate, 1500000)
+	atomic.StoreUint64(&layers[2].bitrate, 500000)
+	deadline := time.Now().Add(5 * time.Second)
+	for video() != layers[1] {
+		if time.Now().After(deadline) {
+			t.Fatalf("The highest layer was not selected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the highest layer goes away
+	newTestConn(t, client, up, "", tracks[0], layers[0], layers[2])
+	if video() != layers[2] {
+		t.Errorf("Expected the remaining highest layer")
+	}
+}
+
+// recordTimeOffset records 3s of audio and of video that starts 500ms
+// after the audio, with unrelated RTP clocks synchronised by sender
+// reports.  It returns the times of the first and last blocks of the
+// audio and video tracks, in milliseconds.
+func recordTimeOffset(t *testing.T) (first, last map[string]int64) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	tracks := []conn.UpTrack{
+		&testUpTrack{codec: opusCodec},
+		&testUpTrack{codec: vp8Codec},
+	}
+	c := newTestConn(t, nil, nil, dir, tracks...)
+
+	// the audio and video clocks have unrelated origins, and video
+	// starts 500ms after audio.
+	const audioBase = 3000000000
+	const videoBase = 12345
+	ntp := uint64(0xE0000000) << 32
+	c.tracks[0].SetTimeOffset(ntp, audioBase)
+	c.tracks[1].SetTimeOffset(ntp+(1<<31), videoBase)
+
+	for ms := 0; ms < 3000; ms += 20 {
+		j := ms / 20
+		p := rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				PayloadType:    111,
+				SequenceNumber: uint16(j),
+				Timestamp:      uint32(audioBase + j*960),
+				SSRC:           43,
+			},
+			Payload: []byte{0xFC, 0xFF, 0xFE},
+		}
+		err := c.tracks[0].WriteRTP(&p)
+		if err != nil {
+			t.Fatalf("WriteRTP: %v", err)
+		}
+		if ms >= 500 && (ms-500)%100 == 0 {
+			p := vp8Packet((ms - 500) / 100)
+			p.Timestamp += videoBase
+			err := c.tracks[1].WriteRTP(p)
+			if err != nil && err != conn.ErrKeyframeNeeded {
+				t.Fatalf("WriteRTP: %v", err)
+			}
+		}
+	}
+	c.Close()
+
+	segment := readRecording(t, dir)
+	kinds := make(map[uint64]string)
+	for _, e := range segment.Tracks.TrackEntry {
+		switch e.CodecID {
+		case "A_OPUS":
+			kinds[e.TrackNumber] = "audio"
+		case "V_VP8":
+			kinds[e.TrackNumber] = "video"
+		}
+	}
+
+	first = map[string]int64{"audio": -1, "video": -1}
+	last = make(map[string]int64)
+	for _, cluster := range segment.Cluster {
+		for _, b := range cluster.SimpleBlock {
+			tc := int64(cluster.Timecode) + int64(b.Timecode)
+			kind := kinds[b.TrackNumber]
+			if first[kind] < 0 {
+				first[kind] = tc
+			}
+			last[kind] = tc
+		}
+	}
+	return first, last
+}
+
+func TestTimeOffset(t *testing.T) {
+	first, last := recordTimeOffset(t)
+
+	// the file starts with the first video keyframe, at 500ms, and
+	// the audio that precedes it is trimmed.  The last audio sample
+	// is at 2980ms, the last video frame at 2900ms.
+	if first["video"] != 0 {
+		t.Errorf("Expected video at 0, got %v", first["video"])
+	}
+	if first["audio"] < 0 || first["audio"] > 1 {
+		t.Errorf("Expected audio at 0, got %v", first["audio"])
+	}
+	if d := last["audio"] - last["video"]; d < 79 || d > 81 {
+		t.Errorf("Expected audio 80ms after video, got %v", d)
+	}
+}
+
+func TestUnalignedStart(t *testing.T) {
+	AlignStart = false
+	defer func() {
+		AlignStart = true
+	}()
+
+	first, last := recordTimeOffset(t)
+
+	// the file starts with the first audio sample, and the first
+	// video keyframe follows 500ms later
+	if first["audio"] != 0 {
+		t.Errorf("Expected audio at 0, got %v", first["audio"])
+	}
+	if d := first["video"] - first["audio"]; d < 499 || d > 501 {
+		t.Errorf("Expected video 500ms after audio, got %v", d)
+	}
+	if d := last["audio"] - last["video"]; d < 79 || d > 81 {
+		t.Errorf("Expected audio 80ms after video, got %v", d)
+	}
+}
+
+func TestAbsCaptureTime(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	Manifest = true
+	defer func() {
+		Manifest = false
+	}()
+
+	extensions := map[string]uint8{conn.AbsCaptureTimeURI: 3}
+	tracks := []conn.UpTrack{
+		&testUpTrack{
+			codec:      opusCodec,
+			extensions: extensions,
+		},
+		&testUpTrack{
+			codec:      vp8Codec,
+			extensions: extensions,
+		},
+	}
+	c := newTestConn(t, nil, nil, dir, tracks...)
+
+	// as in TestTimeOffset, but the sender reports are wrong, and
+	// must be overridden by the capture times.
+	const audioBase = 3000000000
+	const videoBase = 12345
+	ntp := uint64(0xE0000000) << 32
+	capture := func(p *rtp.Packet, ms int) {
+		ext := make([]byte, 8)
+		binary.BigEndian.PutUint64(ext, ntp+uint64(ms)<<32/1000)
+		err := p.SetExtension(3, ext)
+		if err != nil {
+			t.Fatalf("SetExtension: %v", err)
+		}
+	}
+	c.tracks[0].SetTimeOffset(ntp, audioBase)
+	c.tracks[1].SetTimeOffset(ntp, videoBase)
+
+	for ms := 0; ms < 3000; ms += 20 {
+		j := ms / 20
+		p := rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				PayloadType:    111,
+				SequenceNumber: uint16(j),
+				Timestamp:      uint32(audioBase + j*960),
+				SSRC:           43,
+			},
+			Payload: []byte{0xFC, 0xFF, 0xFE},
+		}
+		capture(&p, ms)
+		err := c.tracks[0].WriteRTP(&p)
+		if err != nil {
+			t.Fatalf("WriteRTP: %v", err)
+		}
+		if ms >= 500 && (ms-500)%100 == 0 {
+			p := vp8Packet((ms - 500) / 100)
+			p.Timestamp += videoBase
+			capture(p, ms)
+			err := c.tracks[1].WriteRTP(p)
+			if err != nil && err != conn.ErrKeyframeNeeded {
+				t.Fatalf("WriteRTP: %v", err)
+			}
+		}
+		if ms == 1000 {
+			c.tracks[1].SetTimeOffset(ntp, videoBase)
+		}
+	}
+	c.Close()
+
+	segment := readRecording(t, dir)
+	var audio, video uint64
+	for _, e := range segment.Tracks.TrackEntry {
+		switch e.CodecID {
+		case "A_OPUS":
+			audio = e.TrackNumber
+		case "V_VP8":
+			video = e.TrackNumber
+		}
+	}
+	last := make(map[uint64]int64)
+	for _, cluster := range segment.Cluster {
+		for _, b := range cluster.SimpleBlock {
+			tc := int64(cluster.Timecode) + int64(b.Timecode)
+			last[b.TrackNumber] = tc
+		}
+	}
+	if d := last[audio] - last[video]; d < 79 || d > 81 {
+		t.Errorf("Expected audio 80ms after video, got %v", d)
+	}
+
+	var m manifest
+	err := json.Unmarshal(
+		readFile(t, manifestName(recordingFile(t, dir))), &m,
+	)
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	expected := rtptime.NTPToTime(ntp).Add(500 * time.Millisecond)
+	if m.CaptureStart == nil {
+		t.Errorf("Missing capture-start")
+	} else if d := m.CaptureStart.Sub(expected); d < -time.Millisecond ||
+		d > time.Millisecond {
+		t.Errorf("Expected capture-start %v, got %v",
+			expected, m.CaptureStart)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	count := func(marker bool) int {
+		dir := testDirectory(t)
+		defer os.RemoveAll(dir)
+
+		c := newTestConn(t, nil, nil, dir, &testUpTrack{codec: vp8Codec})
+		for i := 0; i < 25; i++ {
+			p := vp8Packet(i)
+			if i == 24 {
+				p.Marker = marker
+			}
+			err := c.tracks[0].WriteRTP(p)
+			if err != nil && err != conn.ErrKeyframeNeeded {
+				t.Fatalf("WriteRTP: %v", err)
+			}
+		}
+		c.Close()
+
+		n := 0
+		for _, cluster := range readRecording(t, dir).Cluster {
+			n += len(cluster.SimpleBlock)
+		}
+		return n
+	}
+
+	if n := count(true); n != 25 {
+		t.Errorf("Expected 25 samples, got %v", n)
+	}
+	// the last frame might be missing its tail
+	if n := count(false); n != 24 {
+		t.Errorf("Expected 24 samples, got %v", n)
+	}
+}
+
+func TestResolutionChange(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	c := newTestConn(t, nil, nil, dir, &testUpTrack{codec: vp8Codec})
+	for i := 0; i < 40; i++ {
+		p := vp8Packet(i)
+		if i >= 20 && i%10 == 0 {
+			// a 640x480 keyframe
+			p.Payload = []byte{
+				0x10, 0x00, 0, 0, 0x9d, 0x01, 0x2a,
+				0x80, 0x02, 0xE0, 0x01,
+			}
+		}
+		err := c.tracks[0].WriteRTP(p)
+		if err != nil && err != conn.ErrKeyframeNeeded {
+			t.Fatalf("WriteRTP: %v", err)
+		}
+	}
+	c.Close()
+
+	if c.tracks[0].width != 640 || c.tracks[0].height != 480 {
+		t.Errorf("Expected 640x480, got %vx%v",
+			c.tracks[0].width, c.tracks[0].height)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.webm"))
+	if err != nil {
+		t.Fatalf("Glob: %v", err)
+	}
+	if len(files) != 2 {
+		t.Errorf("Expected 2 files, got %v", files)
+	}
+}
+
+func vp9Packet(i int) *rtp.Packet {
+	// a non-keyframe
+	payload := []byte{0x4C, 0x86, 0, 0}
+	if i%10 == 0 {
+		// a 320x240 keyframe
+		payload = []byte{
+			0x0C, 0x82, 0x49, 0x83, 0x42,
+			0x00, 0x13, 0xF0, 0x0E, 0xF0,
+		}
+	}
+	return &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         true,
+			PayloadType:    98,
+			SequenceNumber: uint16(i),
+			Timestamp:      uint32(i * 9000),
+			SSRC:           43,
+		},
+		Payload: payload,
+	}
+}
+
+func TestCodecChange(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	Directory = dir
+	defer func() {
+		Directory = ""
+	}()
+
+	g := testGroup(t, "test")
+	client := &Client{group: g}
+
+	up := &testUp{id: "1", username: "alice"}
+	record := func(codec string, packet func(int) *rtp.Packet) {
+		track := &testUpTrack{
+			codec: webrtc.RTPCodecCapability{
+				MimeType:  codec,
+				ClockRate: 90000,
+			},
+		}
+		c := newTestConn(t, client, up, "", track)
+		for i := 0; i < 40; i++ {
+			err := c.tracks[0].WriteRTP(packet(i))
+			if err != nil && err != conn.ErrKeyframeNeeded {
+				t.Fatalf("WriteRTP: %v", err)
+			}
+		}
+	}
+
+	record("video/VP8", vp8Packet)
+	// the publisher renegotiates on the same connection
+	record("video/VP9", vp9Packet)
+	client.Close()
+
+	parts, err := filepath.Glob(filepath.Join(dir, "test", "*.part"))
+	if err != nil || len(parts) != 0 {
+		t.Errorf("Unexpected partial files %v (%v)", parts, err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "test", "*-*.webm"))
+	if err != nil || len(files) != 2 {
+		t.Fatalf("Expected 2 files, got %v (%v)", files, err)
+	}
+
+	codecs := make(map[string]bool)
+	for _, file := range files {
+		segment := readWebm(t, file)
+		entries := segment.Tracks.TrackEntry
+		if len(entries) != 1 {
+			t.Fatalf("Expected 1 track in %v, got %v",
+				file, len(entries))
+		}
+		codecs[entries[0].CodecID] = true
+		d := segment.Info.Duration
+		if d < 3000 || d > 4000 {
+			t.Errorf("Bad duration %vms in %v", d, file)
+		}
+	}
+	if !codecs["V_VP8"] || !codecs["V_VP9"] {
+		t.Errorf("Expected VP8 and VP9 recordings, got %v", codecs)
+	}
+}
+
+// h264Packets returns the packets of the i-th frame of an H.264 stream
+// at 10 frames per second, starting at packet seqno.  The parameter sets
+// are only sent with the keyframe, which is frame 10.
+func h264Packets(i int, seqno uint16) []*rtp.Packet {
+	nals := [][]byte{{0x41, 0x9A, 0x00, 0x00}}
+	if i == 10 {
+		nals = [][]byte{
+			// a 320x240 baseline SPS
+			{0x67, 0x42, 0xC0, 0x1E, 0xDA, 0x05, 0x07, 0xE4},
+			{0x68, 0xCE, 0x38, 0x80},
+			{0x65, 0x88, 0x80, 0x00},
+		}
+	}
+	packets := make([]*rtp.Packet, len(nals))
+	for j, nal := range nals {
+		packets[j] = &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         j == len(nals)-1,
+				PayloadType:    102,
+				SequenceNumber: seqno + uint16(j),
+				Timestamp:      uint32(i * 9000),
+				SSRC:           44,
+			},
+			Payload: nal,
+		}
+	}
+	return packets
+}
+
+func TestH264ParameterSets(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	AlignStart = false
+	defer func() {
+		AlignStart = true
+	}()
+
+	tracks := []conn.UpTrack{
+		&testUpTrack{codec: opusCodec},
+		&testUpTrack{
+			codec: webrtc.RTPCodecCapability{
+				MimeType:  "video/H264",
+				ClockRate: 90000,
+			},
+		},
+	}
+	c := newTestConn(t, nil, nil, dir, tracks...)
+
+	// 2s of audio, and of video whose parameter sets arrive after 1s
+	seqno := uint16(0)
+	for i := 0; i < 20; i++ {
+		for _, p := range h264Packets(i, seqno) {
+			err := c.tracks[1].WriteRTP(p)
+			if err != nil && err != conn.ErrKeyframeNeeded {
+				t.Fatalf("WriteRTP: %v", err)
+			}
+			seqno++
+		}
+		for j := 5 * i; j < 5*(i+1); j++ {
+			p := rtp.Packet{
+				Header: rtp.Header{
+					Version:        2,
+					PayloadType:    111,
+					SequenceNumber: uint16(j),
+					Timestamp:      uint32(j * 960),
+					SSRC:           43,
+				},
+				Payload: []byte{0xFC, 0xFF, 0xFE},
+			}
+			err := c.tracks[0].WriteRTP(&p)
+			if err != nil {
+				t.Fatalf("WriteRTP: %v", err)
+			}
+		}
+	}
+	c.Close()
+
+	// the audio is recorded on its own until the keyframe, which
+	// starts a file with both tracks
+	files, err := filepath.Glob(filepath.Join(dir, "*.webm"))
+	if err != nil || len(files) != 2 {
+		t.Fatalf("Expected 2 files, got %v (%v)", files, err)
+	}
+	counts := make(map[string]int)
+	for _, file := range files {
+		segment := readWebm(t, file)
+		var codecs []string
+		for _, e := range segment.Tracks.TrackEntry {
+			codecs = append(codecs, e.CodecID)
+		}
+		counts[strings.Join(codecs, ",")]++
+		if len(segment.Cluster) == 0 {
+			t.Errorf("No data in %v", file)
+		}
+	}
+	if counts["A_OPUS"] != 1 || counts["A_OPUS,V_MPEG4/ISO/AVC"] != 1 {
+		t.Errorf("Unexpected tracks %v", counts)
+	}
+}
+
+func TestPreroll(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	tracks := []conn.UpTrack{
+		&testUpTrack{codec: opusCodec},
+		&testUpTrack{codec: vp8Codec},
+	}
+	c := newTestConn(t, nil, nil, dir, tracks...)
+
+	// audio every 20ms, video every 100ms starting at 410ms, in real
+	// time since the start of the file is estimated from arrival times
+	start := time.Now()
+	for ms := 0; ms < 1000; ms += 10 {
+		time.Sleep(time.Until(
+			start.Add(time.Duration(ms) * time.Millisecond),
+		))
+		if ms%20 == 0 {
+			j := ms / 20
+			p := rtp.Packet{
+				Header: rtp.Header{
+					Version:        2,
+					PayloadType:    111,
+					SequenceNumber: uint16(j),
+					Timestamp:      uint32(j * 960),
+					SSRC:           43,
+				},
+				Payload: []byte{0xFC, 0xFF, 0xFE},
+			}
+			err := c.tracks[0].WriteRTP(&p)
+			if err != nil {
+				t.Fatalf("WriteRTP: %v", err)
+			}
+		}
+		if ms >= 410 && (ms-410)%100 == 0 {
+			err := c.tracks[1].WriteRTP(vp8Packet((ms - 410) / 100))
+			if err != nil && err != conn.ErrKeyframeNeeded {
+				t.Fatalf("WriteRTP: %v", err)
+			}
+		}
+	}
+	c.Close()
+
+	segment := readRecording(t, dir)
+	var audio, video uint64
+	for _, e := range segment.Tracks.TrackEntry {
+		switch e.CodecID {
+		case "A_OPUS":
+			audio = e.TrackNumber
+		case "V_VP8":
+			video = e.TrackNumber
+		}
+	}
+	if len(segment.Cluster) == 0 ||
+		len(segment.Cluster[0].SimpleBlock) == 0 {
+		t.Fatalf("Empty recording")
+	}
+	// audio and video that start together may be written in either
+	// order, but no audio may precede the first keyframe
+	first := true
+	n := 0
+	for _, cluster := range segment.Cluster {
+		for _, b := range cluster.SimpleBlock {
+			tm := int64(cluster.Timecode) + int64(b.Timecode)
+			switch b.TrackNumber {
+			case video:
+				if first && (!b.Keyframe || tm != 0) {
+					t.Errorf("Recording doesn't start " +
+						"with a keyframe")
+				}
+				first = false
+			case audio:
+				if first && tm != 0 {
+					t.Errorf("Audio at %vms precedes "+
+						"the first keyframe", tm)
+				}
+				n++
+			}
+		}
+	}
+	// the audio samples from 420ms to 980ms
+	if n < 27 || n > 31 {
+		t.Errorf("Expected 29 audio samples, got %v", n)
+	}
+
+	for i := 0; i < 2*maxPrerollSamples; i++ {
+		c.tracks[0].addPreroll(uint32(i*960), nil)
+	}
+	if len(c.tracks[0].preroll) != maxPrerollSamples {
+		t.Errorf("Expected %v samples in preroll, got %v",
+			maxPrerollSamples, len(c.tracks[0].preroll))
+	}
+}
+
+func TestSeparateTracks(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	SeparateTracks = true
+	defer func() {
+		SeparateTracks = false
+	}()
+
+	tracks := []conn.UpTrack{
+		&testUpTrack{codec: opusCodec},
+		&testUpTrack{codec: vp8Codec},
+	}
+	c := newTestConn(t, nil, nil, dir, tracks...)
+
+	// 2s of video at 10fps, and of audio at 50 samples per second
+	for i := 0; i < 20; i++ {
+		err := c.tracks[1].WriteRTP(vp8Packet(i))
+		if err != nil && err != conn.ErrKeyframeNeeded {
+			t.Fatalf("WriteRTP: %v", err)
+		}
+		for j := 5 * i; j < 5*(i+1); j++ {
+			p := rtp.Packet{
+				Header: rtp.Header{
+					Version:        2,
+					PayloadType:    111,
+					SequenceNumber: uint16(j),
+					Timestamp:      uint32(j * 960),
+					SSRC:           43,
+				},
+				Payload: []byte{0xFC, 0xFF, 0xFE},
+			}
+			err := c.tracks[0].WriteRTP(&p)
+			if err != nil {
+				t.Fatalf("WriteRTP: %v", err)
+			}
+		}
+	}
+	c.Close()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.webm"))
+	if err != nil || len(files) != 2 {
+		t.Fatalf("Expected 2 files, got %v (%v)", files, err)
+	}
+	audio := strings.TrimSuffix(files[0], "-Audio.webm")
+	video := strings.TrimSuffix(files[1], "-Video.webm")
+	if audio == files[0] || video == files[1] || audio != video {
+		t.Errorf("Unexpected file names %v", files)
+	}
+
+	// the last block of each file, in milliseconds
+	var last [2]int64
+	for i, codec := range []string{"A_OPUS", "V_VP8"} {
+		segment := readWebm(t, files[i])
+		entries := segment.Tracks.TrackEntry
+		if len(entries) != 1 || entries[0].CodecID != codec ||
+			entries[0].TrackNumber != 1 {
+			t.Errorf("Unexpected tracks in %v: %v",
+				files[i], entries)
+		}
+		for _, cluster := range segment.Cluster {
+			for _, b := range cluster.SimpleBlock {
+				tm := int64(cluster.Timecode) +
+					int64(b.Timecode)
+				if tm > last[i] {
+					last[i] = tm
+				}
+			}
+		}
+	}
+	// the sample builder keeps the last sample of each track
+	if last[0] < 1800 || last[1] < 1700 ||
+		last[0]-last[1] < 0 || last[0]-last[1] > 200 {
+		t.Errorf("Tracks are not in sync: %v", last)
+	}
+}
+
+func TestIVF(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	IVF = true
+	defer func() {
+		IVF = false
+	}()
+
+	recordVP8(t, dir)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*-Video.ivf"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected 1 IVF file, got %v (%v)", files, err)
+	}
+	data := readFile(t, files[0])
+	if len(data) < 32 || string(data[:4]) != "DKIF" ||
+		string(data[8:12]) != "VP80" {
+		t.Fatalf("Bad IVF header")
+	}
+	le := binary.LittleEndian
+	if le.Uint16(data[12:]) != 320 || le.Uint16(data[14:]) != 240 {
+		t.Errorf("Bad dimensions %vx%v",
+			le.Uint16(data[12:]), le.Uint16(data[14:]))
+	}
+	if le.Uint32(data[16:]) != 1000 || le.Uint32(data[20:]) != 1 {
+		t.Errorf("Bad time base %v/%v",
+			le.Uint32(data[20:]), le.Uint32(data[16:]))
+	}
+
+	frames := uint32(0)
+	last := int64(-1)
+	for d := data[32:]; len(d) > 0; frames++ {
+		if len(d) < 12 {
+			t.Fatalf("Truncated frame header")
+		}
+		size := int(le.Uint32(d))
+		tm := int64(le.Uint64(d[4:]))
+		if tm <= last {
+			t.Errorf("Timestamps not increasing: %v, %v", last, tm)
+		}
+		last = tm
+		if len(d) < 12+size {
+			t.Fatalf("Truncated frame")
+		}
+		d = d[12+size:]
+	}
+	if count := le.Uint32(data[24:]); count != frames {
+		t.Errorf("Frame count is %v, expected %v", count, frames)
+	}
+	// the sample builder keeps the last sample
+	if frames < 190 || last < 19000 {
+		t.Errorf("Expected about 200 frames, got %v up to %vms",
+			frames, last)
+	}
+}
+
+func TestWraparound(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	track := &testUpTrack{codec: opusCodec}
+	newConn := func() *diskConn {
+		c := newTestConn(t, nil, nil, dir, track)
+		return c
+	}
+
+	c := newConn()
+	for i := 0; i < 10; i++ {
+		p := rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				PayloadType:    111,
+				SequenceNumber: uint16(i),
+				Timestamp:      0xFFFFFFFF - 5*960 + uint32(i*960),
+				SSRC:           42,
+			},
+			Payload: []byte{0xFC, 0xFF, 0xFE},
+		}
+		err := c.tracks[0].WriteRTP(&p)
+		if err != nil {
+			t.Fatalf("WriteRTP: %v", err)
+		}
+	}
+	c.Close()
+
+	var times []int64
+	for _, cluster := range readRecording(t, dir).Cluster {
+		for _, b := range cluster.SimpleBlock {
+			times = append(times,
+				int64(cluster.Timecode)+int64(b.Timecode))
+		}
+	}
+	if len(times) != 10 {
+		t.Fatalf("Expected 10 blocks, got %v", len(times))
+	}
+	for i := range times {
+		if times[i] != int64(i*20) {
+			t.Errorf("Block %v at %v, expected %v",
+				i, times[i], i*20)
+		}
+	}
+
+	// more than 2^32 ticks since the origin, without filling the gaps
+	defer func(d time.Duration) {
+		DTXThreshold = d
+	}(DTXThreshold)
+	DTXThreshold = 0
+	c = newConn()
+	c.mu.Lock()
+	err := c.initWriter()
+	if err != nil {
+		t.Fatalf("initWriter: %v", err)
+	}
+	tr := c.tracks[0]
+	ts := uint32(0xFFFFFFF0)
+	for i := 0; i < 6; i++ {
+		err := tr.writeSample(true, ts, []byte{0xFC, 0xFF, 0xFE})
+		if err != nil {
+			t.Fatalf("writeSample: %v", err)
+		}
+		if tr.elapsed != int64(i)<<30 {
+			t.Errorf("Expected %v, got %v",
+				int64(i)<<30, tr.elapsed)
+		}
+		ts += 1 << 30
+	}
+	c.mu.Unlock()
+	c.Close()
+}
+
+func TestDTX(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	track := &testUpTrack{codec: opusCodec}
+	c := newTestConn(t, nil, nil, dir, track)
+
+	for i := 0; i < 10; i++ {
+		ts := i * 960
+		if i >= 5 {
+			// one second of DTX
+			ts += 50 * 960
+		}
+		p := rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				PayloadType:    111,
+				SequenceNumber: uint16(i),
+				Timestamp:      uint32(ts),
+				SSRC:           42,
+			},
+			Payload: []byte{0xFC, 0xFF, 0xFE},
+		}
+		err := c.tracks[0].WriteRTP(&p)
+		if err != nil {
+			t.Fatalf("WriteRTP: %v", err)
+		}
+	}
+	c.Close()
+
+	var times []int64
+	for _, cluster := range readRecording(t, dir).Cluster {
+		for _, b := range cluster.SimpleBlock {
+			times = append(times,
+				int64(cluster.Timecode)+int64(b.Timecode))
+		}
+	}
+	if len(times) != 60 {
+		t.Fatalf("Expected 60 blocks, got %v", len(times))
+	}
+	for i := range times {
+		if times[i] != int64(i*20) {
+			t.Errorf("Block %v at %v, expected %v",
+				i, times[i], i*20)
+		}
+	}
+}
+
+func TestOggCRC(t *testing.T) {
+	if crc := oggCRC([]byte("123456789")); crc != 0x89A1897F {
+		t.Errorf("Expected 0x89A1897F, got %#x", crc)
+	}
+}
+
+func TestOgg(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	Ogg = true
+	defer func() {
+		Ogg = false
+	}()
+
+	track := &testUpTrack{codec: opusCodec}
+	c := newTestConn(t, nil, nil, dir, track)
+
+	for i := 0; i < 15; i++ {
+		ts := i * 960
+		if i >= 5 {
+			// one second of DTX, filled when writing
+			ts += 50 * 960
+		}
+		if i >= 10 {
+			// a 40ms gap, filled by the Ogg writer
+			ts += 2 * 960
+		}
+		p := rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				PayloadType:    111,
+				SequenceNumber: uint16(i),
+				Timestamp:      uint32(ts),
+				SSRC:           42,
+			},
+			Payload: []byte{0xFC, 0xFF, 0xFE},
+		}
+		err := c.tracks[0].WriteRTP(&p)
+		if err != nil {
+			t.Fatalf("WriteRTP: %v", err)
+		}
+	}
+	c.Close()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.ogg"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected 1 Ogg file, got %v (%v)", files, err)
+	}
+	data := readFile(t, files[0])
+
+	le := binary.LittleEndian
+	var packets [][]byte
+	var granules []uint64
+	var flags []byte
+	for d := data; len(d) > 0; {
+		if len(d) < 27 || string(d[:4]) != "OggS" {
+			t.Fatalf("Bad page header")
+		}
+		segments := int(d[26])
+		if len(d) < 27+segments {
+			t.Fatalf("Truncated segment table")
+		}
+		length := 27 + segments
+		for _, s := range d[27 : 27+segments] {
+			length += int(s)
+		}
+		if len(d) < length {
+			t.Fatalf("Truncated page")
+		}
+		page := append([]byte(nil), d[:length]...)
+		crc := le.Uint32(page[22:])
+		page[22], page[23], page[24], page[25] = 0, 0, 0, 0
+		if oggCRC(page) != crc {
+			t.Errorf("Bad CRC in page %v", len(packets))
+		}
+		if le.Uint32(page[18:]) != uint32(len(packets)) {
+			t.Errorf("Bad sequence number in page %v", len(packets))
+		}
+		packets = append(packets, page[27+segments:])
+		granules = append(granules, le.Uint64(page[6:]))
+		flags = append(flags, page[5])
+		d = d[length:]
+	}
+
+	if len(packets) < 3 ||
+		!bytes.HasPrefix(packets[0], []byte("OpusHead")) ||
+		!bytes.HasPrefix(packets[1], []byte("OpusTags")) {
+		t.Fatalf("Bad headers")
+	}
+	if packets[0][9] != 2 {
+		t.Errorf("Expected 2 channels, got %v", packets[0][9])
+	}
+	for i, f := range flags {
+		bos := i == 0
+		eos := i == len(flags)-1
+		if ((f&oggBOS) != 0) != bos || ((f&oggEOS) != 0) != eos {
+			t.Errorf("Bad flags %v in page %v", f, i)
+		}
+	}
+
+	// the last sample is flushed when closing, so we expect 15
+	// packets spanning 67 frames
+	audio := granules[2:]
+	if len(audio) != 67 {
+		t.Fatalf("Expected 67 audio pages, got %v", len(audio))
+	}
+	for i, g := range audio {
+		if g != uint64(i+1)*960 {
+			t.Errorf("Page %v has granule %v, expected %v",
+				i, g, (i+1)*960)
+		}
+	}
+}
+
+func TestOpusDuration(t *testing.T) {
+	tests := []struct {
+		data     []byte
+		duration uint32
+	}{
+		{[]byte{0xFC}, 960},
+		{[]byte{0x08}, 960},
+		{[]byte{0x19}, 2 * 2880},
+		{[]byte{0xE3, 0x05}, 5 * 120},
+		{[]byte{0x03}, 0},
+		{nil, 0},
+	}
+	for _, test := range tests {
+		d := opusDuration(test.data, 48000)
+		if d != test.duration {
+			t.Errorf("Duration of %v: expected %v, got %v",
+				test.data, test.duration, d)
+		}
+	}
+}
+
+func TestClonePacket(t *testing.T) {
+	var a packetAllocator
+	packet := vp8Packet(3)
+	packet.CSRC = []uint32{1, 2}
+	p := a.clone(packet)
+	if p.SequenceNumber != 3 || p.Timestamp != 3*9000 ||
+		!p.Marker || p.SSRC != 42 || len(p.CSRC) != 0 {
+		t.Errorf("Bad header %v", p.Header)
+	}
+	if !bytes.Equal(p.Payload, packet.Payload) {
+		t.Errorf("Bad payload %v", p.Payload)
+	}
+	packet.Payload[0] = 0xFF
+	if p.Payload[0] == 0xFF {
+		t.Errorf("Payload is shared")
+	}
+
+	// appending to a payload must not overwrite the next one
+	q := a.clone(vp8Packet(4))
+	_ = append(p.Payload, 0xAA)
+	if q.Payload[0] != 0x10 {
+		t.Errorf("Payloads overlap")
+	}
+}
+
+func BenchmarkClonePacket(b *testing.B) {
+	var a packetAllocator
+	packet := vp8Packet(1)
+	packet.Payload = make([]byte, 1200)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		a.clone(packet)
+	}
+}
+
+func BenchmarkWriteRTP(b *testing.B) {
+	dir := testDirectory(b)
+	defer os.RemoveAll(dir)
+
+	c := newTestConn(b, nil, nil, dir, &testUpTrack{codec: vp8Codec})
+	packets := make([]*rtp.Packet, 10)
+	for i := range packets {
+		packets[i] = vp8Packet(i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p := packets[i%len(packets)]
+		p.SequenceNumber = uint16(i)
+		p.Timestamp = uint32(i * 9000)
+		err := c.tracks[0].WriteRTP(p)
+		if err != nil && err != conn.ErrKeyframeNeeded {
+			b.Fatalf("WriteRTP: %v", err)
+		}
+	}
+	b.StopTimer()
+	c.Close()
+}
+
+func TestWriteQueue(t *testing.T) {
+	// no writer goroutine, so that the queue fills up
+	q := &writeQueue{}
+	q.cond = sync.NewCond(&q.mu)
+
+	file := &webmFile{}
+	data := []byte{0}
+	audio := &diskTrack{}
+	video := &diskTrack{}
+	// audio at even times, video at odd times with a keyframe at 7
+	for i := 0; i < writeQueueSize; i++ {
+		job := writeJob{
+			track: audio, file: file, keyframe: true,
+			tm: int64(i), data: data,
+		}
+		if i%2 == 1 {
+			job = writeJob{
+				track: video, file: file, keyframe: i%8 == 7,
+				tm: int64(i), data: data,
+			}
+		}
+		if d, _ := q.push(job); d != nil {
+			t.Fatalf("Unexpected drop at %v", i)
+		}
+	}
+	// the oldest interframe is dropped, with the video that depends
+	// on it
+	d, n := q.push(writeJob{
+		track: audio, file: file, keyframe: true,
+		tm: writeQueueSize, data: data,
+	})
+	if d != video || n != 3 {
+		t.Errorf("Expected 3 video samples to be dropped, got %v", n)
+	}
+	if len(q.jobs) != writeQueueSize-2 {
+		t.Errorf("Expected %v jobs, got %v",
+			writeQueueSize-2, len(q.jobs))
+	}
+	if q.jobs[0].tm != 0 || q.jobs[1].tm != 2 || q.jobs[4].tm != 7 {
+		t.Errorf("Dropped the wrong samples")
+	}
+	if file.Queued() != int64(len(q.jobs))*(1+blockOverhead) {
+		t.Errorf("Expected %v queued bytes, got %v",
+			len(q.jobs)*(1+blockOverhead), file.Queued())
+	}
+	if atomic.LoadUint32(&video.kfNeeded) != 0 {
+		t.Errorf("Keyframe requested, but one is queued")
+	}
+
+	// without a keyframe to resume at, the track needs one
+	q.jobs = q.jobs[:0]
+	for i := 0; i < writeQueueSize; i++ {
+		q.push(writeJob{
+			track: video, file: file, keyframe: i == 0,
+			tm: int64(i), data: data,
+		})
+	}
+	d, n = q.push(writeJob{
+		track: video, file: file, tm: writeQueueSize, data: data,
+	})
+	if d != video || n != writeQueueSize || len(q.jobs) != 1 {
+		t.Errorf("Expected all interframes to be dropped, got %v", n)
+	}
+	if atomic.LoadUint32(&video.kfNeeded) == 0 {
+		t.Errorf("Keyframe not requested")
+	}
+
+	// if all samples are keyframes, the oldest one is dropped
+	q.jobs = q.jobs[:0]
+	for i := 0; i < writeQueueSize; i++ {
+		q.push(writeJob{
+			track: audio, file: file, keyframe: true, tm: int64(i),
+		})
+	}
+	d, n = q.push(writeJob{track: video, file: file, keyframe: true})
+	if d != audio || n != 1 || q.jobs[0].tm != 1 {
+		t.Errorf("Expected the oldest sample to be dropped")
+	}
+}
+
+func TestConcurrentTracks(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	tracks := []conn.UpTrack{
+		&testUpTrack{codec: opusCodec},
+		&testUpTrack{codec: vp8Codec},
+	}
+	c := newTestConn(t, nil, nil, dir, tracks...)
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 500; j++ {
+			c.tracks[0].WriteRTP(&rtp.Packet{
+				Header: rtp.Header{
+					Version:        2,
+					PayloadType:    111,
+					SequenceNumber: uint16(j),
+					Timestamp:      uint32(j * 960),
+					SSRC:           43,
+				},
+				Payload: []byte{0xFC, 0xFF, 0xFE},
+			})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			c.tracks[1].WriteRTP(vp8Packet(i))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		ntp := uint64(0xE0000000) << 32
+		for i := 0; i < 10; i++ {
+			c.tracks[i%2].SetTimeOffset(
+				ntp+uint64(i)<<32, uint32(i*90000),
+			)
+			c.stats()
+		}
+	}()
+	wg.Wait()
+	c.Close()
+
+	segment := readRecording(t, dir)
+	if len(segment.Tracks.TrackEntry) != 2 {
+		t.Errorf("Expected 2 tracks, got %v",
+			len(segment.Tracks.TrackEntry))
+	}
+}
+
+func TestBuilderDepth(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	AudioDepth, VideoDepth = 8, 512
+	defer func() {
+		AudioDepth, VideoDepth = 16, 128
+	}()
+
+	tracks := []conn.UpTrack{
+		&testUpTrack{codec: vp8Codec},
+		&testUpTrack{codec: opusCodec},
+	}
+	c := newTestConn(t, nil, nil, dir, tracks...)
+	defer c.Close()
+	if len(c.tracks) != 2 {
+		t.Fatalf("Expected 2 tracks, got %v", len(c.tracks))
+	}
+	if c.tracks[0].depth != 512 || c.tracks[1].depth != 8 {
+		t.Errorf("Got depths %v and %v, expected 512 and 8",
+			c.tracks[0].depth, c.tracks[1].depth)
+	}
+
+	for _, d := range []struct {
+		depth    int
+		expected uint16
+	}{{0, 1}, {-3, 1}, {100, 100}, {1 << 20, 0xFFFF}} {
+		if builderDepth(d.depth) != d.expected {
+			t.Errorf("builderDepth(%v): got %v, expected %v",
+				d.depth, builderDepth(d.depth), d.expected)
+		}
+	}
+}
+
+func TestEmptySample(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	track := &testUpTrack{
+		codec: webrtc.RTPCodecCapability{
+			MimeType:  "audio/PCMU",
+			ClockRate: 8000,
+		},
+	}
+	c := newTestConn(t, nil, nil, dir, track)
+
+	for i := 0; i < 20; i++ {
+		payload := make([]byte, 160)
+		if i == 10 {
+			payload = nil
+		}
+		p := rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				PayloadType:    0,
+				SequenceNumber: uint16(i),
+				Timestamp:      uint32(i * 160),
+				SSRC:           42,
+			},
+			Payload: payload,
+		}
+		err := c.tracks[0].WriteRTP(&p)
+		if err != nil {
+			t.Fatalf("WriteRTP: %v", err)
+		}
+	}
+	stats := c.stats()
+	c.Close()
+
+	if stats.Tracks[0].Empty != 1 {
+		t.Errorf("Expected 1 empty sample, got %v",
+			stats.Tracks[0].Empty)
+	}
+	segment := readRecording(t, dir)
+	n := 0
+	for _, cluster := range segment.Cluster {
+		for _, b := range cluster.SimpleBlock {
+			if len(b.Data) == 0 || len(b.Data[0]) == 0 {
+				t.Errorf("Empty block at %v", b.Timecode)
+			}
+			n++
+		}
+	}
+	if n == 0 {
+		t.Errorf("No blocks recorded")
+	}
+}
+
+func TestTrackFailure(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	SeparateTracks = true
+	defer func() {
+		SeparateTracks = false
+	}()
+
+	tracks := []conn.UpTrack{
+		&testUpTrack{codec: opusCodec},
+		&testUpTrack{codec: vp8Codec},
+	}
+	c := newTestConn(t, nil, nil, dir, tracks...)
+
+	write := func(from, to int) {
+		for i := from; i < to; i++ {
+			err := c.tracks[1].WriteRTP(vp8Packet(i))
+			if err != nil && err != conn.ErrKeyframeNeeded {
+				t.Fatalf("WriteRTP: %v", err)
+			}
+			for j := 5 * i; j < 5*(i+1); j++ {
+				p := rtp.Packet{
+					Header: rtp.Header{
+						Version:        2,
+						PayloadType:    111,
+						SequenceNumber: uint16(j),
+						Timestamp:      uint32(j * 960),
+						SSRC:           43,
+					},
+					Payload: []byte{0xFC, 0xFF, 0xFE},
+				}
+				err := c.tracks[0].WriteRTP(&p)
+				if err != nil {
+					t.Fatalf("WriteRTP: %v", err)
+				}
+			}
+		}
+	}
+
+	write(0, 10)
+	c.mu.Lock()
+	c.tracks[0].file.fail(errors.New("test error"))
+	c.mu.Unlock()
+	samples := c.stats().Tracks[1].Samples
+	write(10, 30)
+
+	stats := c.stats()
+	c.Close()
+
+	if !stats.Tracks[0].Disabled || stats.Tracks[1].Disabled {
+		t.Errorf("Expected only audio to be disabled, got %v",
+			stats.Tracks)
+	}
+	if stats.Tracks[1].Samples < samples+19 {
+		t.Errorf("Video stopped being recorded: %v samples, then %v",
+			samples, stats.Tracks[1].Samples)
+	}
+}
@@ -0,0 +1,278 @@
+package diskwriter
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// EncryptionKey, if not nil, is the AES-256 key used to encrypt
+// recordings.
+//
+// An encrypted recording starts with the eight bytes "GALENEC1" followed
+// by the chunk size as a 32-bit big-endian integer.  The plaintext is
+// split into chunks of that size, the last one of which may be shorter,
+// possibly empty.  Each chunk is stored as a 12-byte nonce followed by
+// the chunk sealed with AES-GCM; the additional data is the index of the
+// chunk as a 64-bit big-endian integer followed by a byte that is 1 for
+// the last chunk and 0 otherwise.
+var EncryptionKey []byte
+
+const (
+	encryptionMagic     = "GALENEC1"
+	encryptionHeader    = len(encryptionMagic) + 4
+	encryptionChunkSize = 64 * 1024
+	encryptionOverhead  = 12 + 16
+)
+
+var errBadEncryptedFile = errors.New("bad encrypted recording")
+
+// LoadEncryptionKey reads a hex-encoded 256-bit key from a file.
+func LoadEncryptionKey(filename string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, errors.New("encryption key must be 32 bytes long")
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkData(index uint64, final bool) []byte {
+	var ad [9]byte
+	binary.BigEndian.PutUint64(ad[:8], index)
+	if final {
+		ad[8] = 1
+	}
+	return ad[:]
+}
+
+// encryptedFile encrypts the data written to a recording.  It supports
+// overwriting data that has already been written, which is needed in
+// order to patch the Duration and SeekHead when the recording is closed.
+type encryptedFile struct {
+	file *os.File
+	aead cipher.AEAD
+	// the index of the chunk being filled
+	index uint64
+	// the plaintext of the chunk being filled
+	buf []byte
+}
+
+func newEncryptedFile(file *os.File, key []byte) (*encryptedFile, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, encryptionHeader)
+	copy(header, encryptionMagic)
+	binary.BigEndian.PutUint32(
+		header[len(encryptionMagic):], encryptionChunkSize,
+	)
+	_, err = file.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedFile{
+		file: file,
+		aead: aead,
+		buf:  make([]byte, 0, encryptionChunkSize),
+	}, nil
+}
+
+func (f *encryptedFile) seal(index uint64, data []byte, final bool) ([]byte, error) {
+	nonce := make([]byte, f.aead.NonceSize(),
+		f.aead.NonceSize()+len(data)+f.aead.Overhead())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return f.aead.Seal(nonce, nonce, data, chunkData(index, final)), nil
+}
+
+// chunkOffset returns the offset of a chunk in the underlying file.
+func chunkOffset(index uint64) int64 {
+	return int64(encryptionHeader) +
+		int64(index)*(encryptionChunkSize+encryptionOverhead)
+}
+
+func (f *encryptedFile) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		m := encryptionChunkSize - len(f.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		f.buf = append(f.buf, p[:m]...)
+		p = p[m:]
+		if len(f.buf) == encryptionChunkSize {
+			chunk, err := f.seal(f.index, f.buf, false)
+			if err != nil {
+				return n, err
+			}
+			_, err = f.file.Write(chunk)
+			if err != nil {
+				return n, err
+			}
+			f.index++
+			f.buf = f.buf[:0]
+		}
+		n += m
+	}
+	return n, nil
+}
+
+// WriteAt overwrites data that has already been written.  Chunks that
+// are already on disk are decrypted and sealed again with a fresh nonce.
+func (f *encryptedFile) WriteAt(p []byte, off int64) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		index := uint64(off / encryptionChunkSize)
+		start := int(off % encryptionChunkSize)
+		m := encryptionChunkSize - start
+		if m > len(p) {
+			m = len(p)
+		}
+
+		if index == f.index {
+			if start+m > len(f.buf) {
+				return n, errors.New("write beyond end of file")
+			}
+			copy(f.buf[start:], p[:m])
+		} else if index < f.index {
+			chunk := make(
+				[]byte, encryptionChunkSize+encryptionOverhead,
+			)
+			_, err := f.file.ReadAt(chunk, chunkOffset(index))
+			if err != nil {
+				return n, err
+			}
+			ns := f.aead.NonceSize()
+			data, err := f.aead.Open(nil, chunk[:ns], chunk[ns:],
+				chunkData(index, false))
+			if err != nil {
+				return n, err
+			}
+			copy(data[start:], p[:m])
+			chunk, err = f.seal(index, data, false)
+			if err != nil {
+				return n, err
+			}
+			_, err = f.file.WriteAt(chunk, chunkOffset(index))
+			if err != nil {
+				return n, err
+			}
+		} else {
+			return n, errors.New("write beyond end of file")
+		}
+
+		p = p[m:]
+		off += int64(m)
+		n += m
+	}
+	return n, nil
+}
+
+// Sync flushes the complete chunks to stable storage.  The last,
+// incomplete chunk is only written out when the file is closed.
+func (f *encryptedFile) Sync() error {
+	return f.file.Sync()
+}
+
+// Close writes out the last chunk and closes the underlying file.
+func (f *encryptedFile) Close() error {
+	chunk, err := f.seal(f.index, f.buf, true)
+	if err == nil {
+		_, err = f.file.Write(chunk)
+	}
+	err2 := f.file.Close()
+	if err == nil {
+		err = err2
+	}
+	return err
+}
+
+func (f *encryptedFile) Name() string {
+	return f.file.Name()
+}
+
+// DecryptRecording decrypts a recording encrypted with key.  If the
+// recording is truncated, as happens when the server crashes, the
+// complete chunks are written out before an error is returned.
+func DecryptRecording(w io.Writer, r io.Reader, key []byte) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, encryptionHeader)
+	_, err = io.ReadFull(r, header)
+	if err != nil || !bytes.Equal(
+		header[:len(encryptionMagic)], []byte(encryptionMagic),
+	) {
+		return errBadEncryptedFile
+	}
+	size := binary.BigEndian.Uint32(header[len(encryptionMagic):])
+	if size == 0 || size > 16*1024*1024 {
+		return errBadEncryptedFile
+	}
+
+	ns := aead.NonceSize()
+	chunk := make([]byte, int(size)+encryptionOverhead)
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(r, chunk)
+		if err == io.EOF {
+			return errors.New("truncated recording")
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if n < ns {
+			return errors.New("truncated recording")
+		}
+		data, err := aead.Open(nil, chunk[:ns], chunk[ns:n],
+			chunkData(index, false))
+		final := false
+		if err != nil {
+			data, err = aead.Open(nil, chunk[:ns], chunk[ns:n],
+				chunkData(index, true))
+			if err != nil {
+				return err
+			}
+			final = true
+		}
+		_, err = w.Write(data)
+		if err != nil {
+			return err
+		}
+		if final {
+			var b [1]byte
+			m, _ := r.Read(b[:])
+			if m > 0 {
+				return errBadEncryptedFile
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package diskwriter
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jech/galene/group"
+)
+
+// RetentionPeriod is the age after which recordings are deleted.  Zero
+// means that recordings are kept forever.
+var RetentionPeriod time.Duration
+
+// RetentionInterval is the interval between two scans for old recordings.
+var RetentionInterval = time.Hour
+
+// the files currently being written
+var openFiles struct {
+	mu    sync.Mutex
+	files map[string]bool
+}
+
+func addOpenFile(name string) {
+	openFiles.mu.Lock()
+	defer openFiles.mu.Unlock()
+	if openFiles.files == nil {
+		openFiles.files = make(map[string]bool)
+	}
+	openFiles.files[name] = true
+}
+
+func delOpenFile(name string) {
+	openFiles.mu.Lock()
+	defer openFiles.mu.Unlock()
+	delete(openFiles.files, name)
+}
+
+func isOpenFile(name string) bool {
+	openFiles.mu.Lock()
+	defer openFiles.mu.Unlock()
+	return openFiles.files[name]
+}
+
+// Expire deletes the recordings that are older than RetentionPeriod.
+// Only the recording directories of the running groups and of the groups
+// that have a description file are scanned.
+func Expire() {
+	if RetentionPeriod <= 0 || Directory == "" {
+		return
+	}
+
+	now := time.Now()
+	deleted := make(map[string]int)
+	walk := func(name, path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Expire recordings: %v", err)
+			}
+			return nil
+		}
+		if fi.IsDir() || isSymlink(fi) || !isRecording(path) {
+			return nil
+		}
+		if now.Sub(fi.ModTime()) < RetentionPeriod {
+			return nil
+		}
+		if isOpenFile(path) {
+			return nil
+		}
+		err = removeRecording(path)
+		if err != nil {
+			log.Printf("Expire recordings: %v", err)
+			return nil
+		}
+		deleted[name]++
+		return nil
+	}
+	walkGroups(walk)
+
+	for name, count := range deleted {
+		message := fmt.Sprintf(
+			"Deleted %v recordings older than %v", count,
+			RetentionPeriod,
+		)
+		log.Printf("%v: %v", name, message)
+		g := group.Get(name)
+		if g != nil {
+			g.WallOps(message)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package diskwriter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jech/galene/group"
+)
+
+func TestExpire(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	Directory = dir
+	RetentionPeriod = time.Hour
+	defer func() {
+		Directory = ""
+		RetentionPeriod = 0
+	}()
+
+	groups := testDirectory(t)
+	defer os.RemoveAll(groups)
+	saved := group.Directory
+	group.Directory = groups
+	defer func() {
+		group.Directory = saved
+	}()
+	err := ioutil.WriteFile(
+		filepath.Join(groups, "expire.json"), []byte("{}"), 0600,
+	)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	for _, d := range []string{"expire", "unknown"} {
+		err := os.MkdirAll(filepath.Join(dir, d), 0700)
+		if err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	createIn := func(g, name string, tm time.Time) string {
+		fn := filepath.Join(dir, g, name)
+		err := ioutil.WriteFile(fn, nil, 0600)
+		if err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		err = os.Chtimes(fn, tm, tm)
+		if err != nil {
+			t.Fatalf("Chtimes: %v", err)
+		}
+		return fn
+	}
+	create := func(name string, tm time.Time) string {
+		return createIn("expire", name, tm)
+	}
+	oldFile := create("old.webm", old)
+	oldManifest := create("old.json", old)
+	oldThumbnail := create("old.jpg", old)
+	newFile := create("new.webm", time.Now())
+	openFile := create("open.webm", old)
+	otherFile := create("other.txt", old)
+	unknownFile := createIn("unknown", "old.webm", old)
+	addOpenFile(openFile)
+	defer delOpenFile(openFile)
+
+	Expire()
+
+	exists := func(fn string) bool {
+		_, err := os.Stat(fn)
+		return err == nil
+	}
+	if exists(oldFile) {
+		t.Errorf("Old recording was not deleted")
+	}
+	if exists(oldManifest) {
+		t.Errorf("Old manifest was not deleted")
+	}
+	if exists(oldThumbnail) {
+		t.Errorf("Old thumbnail was not deleted")
+	}
+	if !exists(newFile) || !exists(openFile) || !exists(otherFile) {
+		t.Errorf("Deleted too many files")
+	}
+	if !exists(unknownFile) {
+		t.Errorf("Deleted recording of unknown group")
+	}
+}
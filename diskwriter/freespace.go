@@ -0,0 +1,31 @@
+package diskwriter
+
+import (
+	"errors"
+)
+
+// MinFreeSpace is the amount of free disk space, in bytes, below which
+// new connections are not recorded.  Zero disables the check.
+var MinFreeSpace uint64
+
+var errLowDiskSpace = errors.New("not enough free disk space")
+
+var errFreeSpaceUnsupported = errors.New("free space is not known")
+
+// checkFreeSpace returns errLowDiskSpace if there are fewer than
+// MinFreeSpace bytes available to the filesystem that contains directory.
+// If the free space cannot be determined, or recordings are not written
+// to disk, recording proceeds.
+func checkFreeSpace(directory string) error {
+	if MinFreeSpace == 0 || Sink != nil {
+		return nil
+	}
+	free, err := freeSpace(directory)
+	if err != nil {
+		return nil
+	}
+	if free < MinFreeSpace {
+		return errLowDiskSpace
+	}
+	return nil
+}
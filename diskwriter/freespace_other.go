@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !windows
+// +build !linux,!darwin,!freebsd,!dragonfly,!windows
+
+package diskwriter
+
+func freeSpace(path string) (uint64, error) {
+	return 0, errFreeSpaceUnsupported
+}
@@ -0,0 +1,19 @@
+//go:build linux || darwin || freebsd || dragonfly
+// +build linux darwin freebsd dragonfly
+
+package diskwriter
+
+import (
+	"syscall"
+)
+
+// freeSpace returns the number of bytes available to unprivileged users
+// in the filesystem that contains path.
+func freeSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(path, &st)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
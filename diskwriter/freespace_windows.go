@@ -0,0 +1,26 @@
+package diskwriter
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var procGetDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").
+	NewProc("GetDiskFreeSpaceExW")
+
+// freeSpace returns the number of bytes available to the current user
+// in the filesystem that contains path.
+func freeSpace(path string) (uint64, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	r, _, err := procGetDiskFreeSpaceEx.Call(
+		uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&free)), 0, 0,
+	)
+	if r == 0 {
+		return 0, err
+	}
+	return free, nil
+}
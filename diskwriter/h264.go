@@ -0,0 +1,283 @@
+package diskwriter
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// splitAnnexB splits an H.264 bytestream in Annex B format, as produced
+// by the depacketiser, into NAL units.
+func splitAnnexB(data []byte) [][]byte {
+	var nals [][]byte
+	start := -1
+	i := 0
+	for i+2 < len(data) {
+		if data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 {
+			if start >= 0 {
+				nals = appendNAL(nals, data[start:i])
+			}
+			i += 3
+			start = i
+			continue
+		}
+		i++
+	}
+	if start >= 0 {
+		nals = appendNAL(nals, data[start:])
+	}
+	return nals
+}
+
+func appendNAL(nals [][]byte, nal []byte) [][]byte {
+	// strip the leading zero of a four-byte start code
+	for len(nal) > 0 && nal[len(nal)-1] == 0 {
+		nal = nal[:len(nal)-1]
+	}
+	if len(nal) == 0 {
+		return nals
+	}
+	return append(nals, nal)
+}
+
+// splitAVCC splits a sample in AVCC format (NAL units prefixed with
+// a four-byte length) into NAL units.
+func splitAVCC(data []byte) [][]byte {
+	var nals [][]byte
+	for len(data) >= 4 {
+		l := binary.BigEndian.Uint32(data)
+		data = data[4:]
+		if uint32(len(data)) < l {
+			break
+		}
+		if l > 0 {
+			nals = append(nals, data[:l])
+		}
+		data = data[l:]
+	}
+	return nals
+}
+
+// toAVCC converts a list of NAL units into AVCC format, as required by
+// Matroska.
+func toAVCC(nals [][]byte) []byte {
+	length := 0
+	for _, nal := range nals {
+		length += 4 + len(nal)
+	}
+	data := make([]byte, 0, length)
+	for _, nal := range nals {
+		data = append(data,
+			byte(len(nal)>>24), byte(len(nal)>>16),
+			byte(len(nal)>>8), byte(len(nal)),
+		)
+		data = append(data, nal...)
+	}
+	return data
+}
+
+const (
+	h264NALIDR = 5
+	h264NALSPS = 7
+	h264NALPPS = 8
+)
+
+func h264NALType(nal []byte) byte {
+	if len(nal) < 1 {
+		return 0
+	}
+	return nal[0] & 0x1F
+}
+
+// avcConfigurationRecord builds the AVCDecoderConfigurationRecord that
+// goes into the CodecPrivate element of an H.264 track.
+func avcConfigurationRecord(sps, pps []byte) ([]byte, error) {
+	if len(sps) < 4 || len(pps) < 1 {
+		return nil, errors.New("bad H.264 parameter sets")
+	}
+	record := []byte{
+		1, sps[1], sps[2], sps[3],
+		0xFC | 3, // four-byte lengths
+		0xE0 | 1, byte(len(sps) >> 8), byte(len(sps)),
+	}
+	record = append(record, sps...)
+	record = append(record, 1, byte(len(pps)>>8), byte(len(pps)))
+	record = append(record, pps...)
+	return record, nil
+}
+
+// unescapeRBSP removes emulation prevention bytes from a NAL unit.
+func unescapeRBSP(data []byte) []byte {
+	rbsp := make([]byte, 0, len(data))
+	zeroes := 0
+	for _, b := range data {
+		if zeroes >= 2 && b == 3 {
+			zeroes = 0
+			continue
+		}
+		if b == 0 {
+			zeroes++
+		} else {
+			zeroes = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return rbsp
+}
+
+// readUE reads an unsigned Exp-Golomb code.
+func (r *bitReader) readUE() (uint32, bool) {
+	zeroes := 0
+	for {
+		b, ok := r.read(1)
+		if !ok || zeroes > 31 {
+			return 0, false
+		}
+		if b == 1 {
+			break
+		}
+		zeroes++
+	}
+	v, ok := r.read(zeroes)
+	if !ok {
+		return 0, false
+	}
+	return (1 << uint(zeroes)) - 1 + v, true
+}
+
+// readSE reads a signed Exp-Golomb code.
+func (r *bitReader) readSE() (int32, bool) {
+	v, ok := r.readUE()
+	if !ok {
+		return 0, false
+	}
+	if v&1 != 0 {
+		return int32((v + 1) / 2), true
+	}
+	return -int32(v / 2), true
+}
+
+// spsDimensions returns the picture dimensions encoded in an H.264
+// sequence parameter set, including the NAL header.
+func spsDimensions(sps []byte) (uint32, uint32, error) {
+	errBad := errors.New("couldn't parse H.264 SPS")
+	if len(sps) < 4 || h264NALType(sps) != h264NALSPS {
+		return 0, 0, errBad
+	}
+	r := bitReader{data: unescapeRBSP(sps[1:])}
+	profile, _ := r.read(8)
+	r.read(16) // constraint flags and level
+	r.readUE() // seq_parameter_set_id
+
+	chromaFormat := uint32(1)
+	separateColourPlane := uint32(0)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat, _ = r.readUE()
+		if chromaFormat == 3 {
+			separateColourPlane, _ = r.read(1)
+		}
+		r.readUE() // bit_depth_luma_minus8
+		r.readUE() // bit_depth_chroma_minus8
+		r.read(1)  // qpprime_y_zero_transform_bypass_flag
+		scaling, ok := r.read(1)
+		if !ok {
+			return 0, 0, errBad
+		}
+		if scaling != 0 {
+			n := 8
+			if chromaFormat == 3 {
+				n = 12
+			}
+			for i := 0; i < n; i++ {
+				present, ok := r.read(1)
+				if !ok {
+					return 0, 0, errBad
+				}
+				if present == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						delta, ok := r.readSE()
+						if !ok {
+							return 0, 0, errBad
+						}
+						next = (last + delta + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	r.readUE() // log2_max_frame_num_minus4
+	pocType, _ := r.readUE()
+	if pocType == 0 {
+		r.readUE() // log2_max_pic_order_cnt_lsb_minus4
+	} else if pocType == 1 {
+		r.read(1)  // delta_pic_order_always_zero_flag
+		r.readSE() // offset_for_non_ref_pic
+		r.readSE() // offset_for_top_to_bottom_field
+		n, ok := r.readUE()
+		if !ok {
+			return 0, 0, errBad
+		}
+		for i := uint32(0); i < n; i++ {
+			r.readSE()
+		}
+	}
+	r.readUE() // max_num_ref_frames
+	r.read(1)  // gaps_in_frame_num_value_allowed_flag
+	widthMbs, _ := r.readUE()
+	heightMapUnits, _ := r.readUE()
+	frameMbsOnly, ok := r.read(1)
+	if !ok {
+		return 0, 0, errBad
+	}
+	if frameMbsOnly == 0 {
+		r.read(1) // mb_adaptive_frame_field_flag
+	}
+	r.read(1) // direct_8x8_inference_flag
+	cropping, ok := r.read(1)
+	if !ok {
+		return 0, 0, errBad
+	}
+
+	width := (widthMbs + 1) * 16
+	height := (2 - frameMbsOnly) * (heightMapUnits + 1) * 16
+
+	if cropping != 0 {
+		left, _ := r.readUE()
+		right, _ := r.readUE()
+		top, _ := r.readUE()
+		bottom, ok := r.readUE()
+		if !ok {
+			return 0, 0, errBad
+		}
+		cropX, cropY := uint32(1), uint32(1)
+		if separateColourPlane == 0 {
+			switch chromaFormat {
+			case 1:
+				cropX, cropY = 2, 2
+			case 2:
+				cropX, cropY = 2, 1
+			}
+		}
+		cropY *= 2 - frameMbsOnly
+		if (left+right)*cropX >= width ||
+			(top+bottom)*cropY >= height {
+			return 0, 0, errBad
+		}
+		width -= (left + right) * cropX
+		height -= (top + bottom) * cropY
+	}
+
+	return width, height, nil
+}
@@ -0,0 +1,111 @@
+package diskwriter
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// IVF, if true, causes VP8 and VP9 tracks to be recorded in IVF files
+// rather than webm.  Since IVF cannot carry audio, each track is recorded
+// in its own file, as with SeparateTracks; audio and H.264 tracks are
+// recorded in webm files.
+var IVF bool
+
+// the IVF time base, timestamps are in milliseconds
+const ivfRate, ivfScale = 1000, 1
+
+// separateTracks returns true if each track is recorded in its own file.
+func separateTracks() bool {
+	return SeparateTracks || IVF
+}
+
+// isIVF returns true if a track is recorded in an IVF file.
+func (t *diskTrack) isIVF() bool {
+	if !IVF {
+		return false
+	}
+	switch strings.ToLower(t.remote.Codec().MimeType) {
+	case "video/vp8", "video/vp9":
+		return true
+	}
+	return false
+}
+
+// newRawFile returns a file that is written without being parsed, for
+// containers other than webm.
+func newRawFile(file diskFile) *webmFile {
+	f := newWebmFile(file, nil)
+	f.skip = 1 << 62
+	f.tap = nil
+	return f
+}
+
+// ivfWriter writes the samples of a video track in the IVF format.  It
+// implements webm.BlockWriteCloser.
+type ivfWriter struct {
+	file   *webmFile
+	frames uint32
+}
+
+func newIVFWriter(file *webmFile, codec string, width, height uint32) (*ivfWriter, error) {
+	var fourcc string
+	switch strings.ToLower(codec) {
+	case "video/vp8":
+		fourcc = "VP80"
+	case "video/vp9":
+		fourcc = "VP90"
+	default:
+		return nil, errors.New("cannot write " + codec + " to IVF")
+	}
+
+	header := make([]byte, 32)
+	copy(header, "DKIF")
+	binary.LittleEndian.PutUint16(header[4:], 0)
+	binary.LittleEndian.PutUint16(header[6:], 32)
+	copy(header[8:], fourcc)
+	binary.LittleEndian.PutUint16(header[12:], uint16(width))
+	binary.LittleEndian.PutUint16(header[14:], uint16(height))
+	binary.LittleEndian.PutUint32(header[16:], ivfRate)
+	binary.LittleEndian.PutUint32(header[20:], ivfScale)
+	// the frame count is patched when the file is closed
+	file.Write(header)
+	if err := file.Err(); err != nil {
+		return nil, err
+	}
+	return &ivfWriter{file: file}, nil
+}
+
+func (w *ivfWriter) Write(keyframe bool, timestamp int64, data []byte) (int, error) {
+	var header [12]byte
+	binary.LittleEndian.PutUint32(header[0:], uint32(len(data)))
+	binary.LittleEndian.PutUint64(header[4:], uint64(timestamp))
+	w.file.Write(header[:])
+	w.file.Write(data)
+	if err := w.file.Err(); err != nil {
+		return 0, err
+	}
+	w.frames++
+	if timestamp > w.file.lastTime {
+		w.file.lastTime = timestamp
+	}
+	return len(data), nil
+}
+
+// Close patches the frame count into the header and closes the file.
+func (w *ivfWriter) Close() error {
+	err := w.file.flush()
+	if err == nil {
+		var count [4]byte
+		binary.LittleEndian.PutUint32(count[:], w.frames)
+		_, err = w.file.file.WriteAt(count[:], 24)
+		if err != nil {
+			w.file.fail(err)
+		}
+	}
+	err2 := w.file.Close()
+	if err == nil {
+		err = err2
+	}
+	return err
+}
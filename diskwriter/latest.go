@@ -0,0 +1,120 @@
+package diskwriter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// The latest recording of a group is pointed to by a symbolic link named
+// "latest" with the extension of the recording, in the group's directory.
+// On Windows, where symbolic links require special privileges, the file
+// "latest.txt" contains the name of the recording instead.
+const latestName = "latest"
+
+var latestExtensions = []string{".webm", ".ivf", ".ogg"}
+
+func isSymlink(fi os.FileInfo) bool {
+	return fi.Mode()&os.ModeSymlink != 0
+}
+
+// removeLatest removes a pointer to the latest recording, but never
+// a regular file that happens to have the same name.
+func removeLatest(name string) {
+	fi, err := os.Lstat(name)
+	if err != nil || !isSymlink(fi) {
+		return
+	}
+	os.Remove(name)
+}
+
+// updateLatest makes the pointer in directory point at recording.
+func updateLatest(directory, recording string) error {
+	target, err := filepath.Rel(directory, recording)
+	if err != nil {
+		return err
+	}
+
+	// the temporary names are unique, since multiple recording clients
+	// may update the pointer simultaneously
+	if runtime.GOOS == "windows" {
+		name := filepath.Join(directory, latestName+".txt")
+		temp := name + "." + newId()[:8] + ".part"
+		err := ioutil.WriteFile(temp,
+			[]byte(filepath.ToSlash(target)+"\n"), FileMode)
+		if err == nil {
+			err = os.Rename(temp, name)
+		}
+		if err != nil {
+			os.Remove(temp)
+		}
+		return err
+	}
+
+	ext := filepath.Ext(recording)
+	name := filepath.Join(directory, latestName+ext)
+	temp := name + "." + newId()[:8] + ".part"
+	err = os.Symlink(target, temp)
+	if err != nil {
+		return err
+	}
+	// rename replaces the old link atomically
+	err = os.Rename(temp, name)
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	for _, e := range latestExtensions {
+		if e != ext {
+			removeLatest(filepath.Join(directory, latestName+e))
+		}
+	}
+	return nil
+}
+
+// cleanLatest removes the pointers in directory that point at
+// a recording that no longer exists.
+func cleanLatest(directory string) {
+	if runtime.GOOS == "windows" {
+		name := filepath.Join(directory, latestName+".txt")
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return
+		}
+		target := filepath.Join(directory,
+			filepath.FromSlash(strings.TrimSpace(string(data))))
+		_, err = os.Stat(target)
+		if os.IsNotExist(err) {
+			os.Remove(name)
+		}
+		return
+	}
+
+	for _, ext := range latestExtensions {
+		name := filepath.Join(directory, latestName+ext)
+		_, err := os.Stat(name)
+		if os.IsNotExist(err) {
+			removeLatest(name)
+		}
+	}
+}
+
+// cleanLatestAbove calls cleanLatest on the directory of a recording
+// and on its parents up to Directory, or up to the member of
+// AllowedDirectories that contains it.
+func cleanLatestAbove(recording string) {
+	dir := filepath.Dir(recording)
+	for {
+		cleanLatest(dir)
+		if !belowRoots(dir) {
+			return
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,261 @@
+package diskwriter
+
+import (
+	"context"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/jech/galene/group"
+)
+
+// the number of chunks of data queued for a live viewer, beyond which the
+// viewer is disconnected
+const liveQueueLength = 1024
+
+// liveViewer is a client of the live stream of a recording.
+type liveViewer struct {
+	ch chan []byte
+	// true once the viewer was sent the header and the start of
+	// a cluster
+	started bool
+}
+
+// liveTap copies the data written to a webm file to the viewers of its
+// live stream.  Viewers are first sent the header, which is everything
+// that precedes the first cluster, then the data from the next keyframe
+// on.  Since the recording is not patched when it is streamed, the
+// stream has no duration and no cues.
+type liveTap struct {
+	mu     sync.Mutex
+	header []byte
+	// true once the first cluster was seen
+	complete bool
+	viewers  map[*liveViewer]bool
+	closed   bool
+}
+
+func newLiveTap() *liveTap {
+	return &liveTap{viewers: make(map[*liveViewer]bool)}
+}
+
+// send queues data for a viewer, and disconnects it if its queue is full.
+// Called locked.
+func (tap *liveTap) send(v *liveViewer, data []byte) {
+	select {
+	case v.ch <- data:
+	default:
+		delete(tap.viewers, v)
+		close(v.ch)
+	}
+}
+
+// write is called with the data written to the file.
+func (tap *liveTap) write(data []byte) {
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+
+	if !tap.complete {
+		tap.header = append(tap.header, data...)
+		return
+	}
+	var chunk []byte
+	for v := range tap.viewers {
+		if !v.started {
+			continue
+		}
+		if chunk == nil {
+			chunk = append([]byte(nil), data...)
+		}
+		tap.send(v, chunk)
+	}
+}
+
+// endHeader is called at the start of the first cluster.  The Duration
+// element, whose value is at the given offset, is replaced with a Void
+// element, since it is only known when the file is closed.
+func (tap *liveTap) endHeader(duration int64) {
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+
+	if tap.complete {
+		return
+	}
+	tap.complete = true
+	// the ID and size of the Duration take 3 bytes, its value 8
+	if duration >= 3 && duration+8 <= int64(len(tap.header)) {
+		copy(tap.header[duration-3:], voidElement(11))
+	}
+}
+
+// keyframe is called before a keyframe that starts a viewer's stream is
+// written.  The viewers that are waiting are sent the header and the
+// start of a cluster with the given timecode.
+func (tap *liveTap) keyframe(clusterTime uint64) {
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+
+	if !tap.complete {
+		return
+	}
+	var cluster []byte
+	for v := range tap.viewers {
+		if v.started {
+			continue
+		}
+		if cluster == nil {
+			cluster = appendID(nil, idCluster)
+			// unknown size
+			cluster = append(cluster, 0xFF)
+			cluster = appendUint(cluster, idTimecode, clusterTime, 0)
+		}
+		v.started = true
+		tap.send(v, tap.header)
+		if tap.viewers[v] {
+			tap.send(v, cluster)
+		}
+	}
+}
+
+// waiting returns true if a viewer is waiting for a keyframe.
+func (tap *liveTap) waiting() bool {
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+	for v := range tap.viewers {
+		if !v.started {
+			return true
+		}
+	}
+	return false
+}
+
+func (tap *liveTap) subscribe() (*liveViewer, error) {
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+	if tap.closed {
+		return nil, os.ErrNotExist
+	}
+	v := &liveViewer{ch: make(chan []byte, liveQueueLength)}
+	tap.viewers[v] = true
+	return v, nil
+}
+
+func (tap *liveTap) unsubscribe(v *liveViewer) {
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+	if tap.viewers[v] {
+		delete(tap.viewers, v)
+		close(v.ch)
+	}
+}
+
+// close is called when the file is closed, which ends the streams of all
+// viewers.
+func (tap *liveTap) close() {
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+	tap.closed = true
+	for v := range tap.viewers {
+		delete(tap.viewers, v)
+		close(v.ch)
+	}
+}
+
+// LiveConn describes a connection whose recording may be watched live.
+type LiveConn struct {
+	Id       string
+	Label    string
+	Username string
+}
+
+// findTap returns the tap of the webm file being written for the
+// connection with the given id in group g, or nil if there is none.
+func findTap(g *group.Group, id string) *liveTap {
+	for _, c := range g.GetClients(nil) {
+		client, ok := c.(*Client)
+		if !ok {
+			continue
+		}
+		client.mu.Lock()
+		down := client.down[id]
+		client.mu.Unlock()
+		if down == nil {
+			continue
+		}
+		down.mu.Lock()
+		file := down.file
+		down.mu.Unlock()
+		if file != nil && file.tap != nil {
+			return file.tap
+		}
+	}
+	return nil
+}
+
+// LiveConns returns the connections of group g whose recordings may be
+// watched live, which are those that are being written to a webm file.
+func LiveConns(g *group.Group) []LiveConn {
+	var conns []LiveConn
+	for _, c := range g.GetClients(nil) {
+		client, ok := c.(*Client)
+		if !ok {
+			continue
+		}
+		client.mu.Lock()
+		downs := make([]*diskConn, 0, len(client.down))
+		for _, down := range client.down {
+			downs = append(downs, down)
+		}
+		client.mu.Unlock()
+
+		for _, down := range downs {
+			down.mu.Lock()
+			live := down.file != nil && down.file.tap != nil
+			down.mu.Unlock()
+			if live {
+				conns = append(conns, LiveConn{
+					Id:       down.remote.Id(),
+					Label:    down.label,
+					Username: down.username,
+				})
+			}
+		}
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].Id < conns[j].Id
+	})
+	return conns
+}
+
+// Live writes the recording of the connection with the given id in group
+// g to w as a webm stream, starting at the next keyframe, which is
+// requested from the sender.  It returns when ctx is done, when the file
+// being recorded is closed, which happens whenever the recording is
+// split, or when w doesn't keep up.
+func Live(ctx context.Context, g *group.Group, id string, w io.Writer) error {
+	tap := findTap(g, id)
+	if tap == nil {
+		return os.ErrNotExist
+	}
+	v, err := tap.subscribe()
+	if err != nil {
+		return err
+	}
+	defer tap.unsubscribe(v)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case data, ok := <-v.ch:
+			if !ok {
+				return nil
+			}
+			_, err := w.Write(data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
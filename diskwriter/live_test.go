@@ -0,0 +1,61 @@
+package diskwriter
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/jech/galene/conn"
+)
+
+func TestLive(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	c := newTestConn(t, nil, nil, dir, &testUpTrack{codec: vp8Codec})
+	write := func(from, to int) {
+		for i := from; i < to; i++ {
+			err := c.tracks[0].WriteRTP(vp8Packet(i))
+			if err != nil && err != conn.ErrKeyframeNeeded {
+				t.Fatalf("WriteRTP: %v", err)
+			}
+		}
+	}
+
+	write(0, 15)
+	c.queue.drain()
+	c.mu.Lock()
+	tap := c.file.tap
+	c.mu.Unlock()
+	v, err := tap.subscribe()
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	if !tap.waiting() {
+		t.Errorf("Viewer is not waiting")
+	}
+	write(15, 50)
+	// the tap sees the samples once they have been written
+	c.queue.drain()
+	if tap.waiting() {
+		t.Errorf("Viewer is still waiting")
+	}
+	c.Close()
+
+	var data []byte
+	for chunk := range v.ch {
+		data = append(data, chunk...)
+	}
+	ok, err := hasCluster(bytes.NewReader(data))
+	if err != nil || !ok {
+		t.Errorf("Stream is not valid: %v", err)
+	}
+	if bytes.Contains(data, []byte{0x44, 0x89, 0x88}) {
+		t.Errorf("Stream has a duration")
+	}
+
+	_, err = tap.subscribe()
+	if err == nil {
+		t.Errorf("Subscribed to a closed stream")
+	}
+}
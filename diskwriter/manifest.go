@@ -0,0 +1,184 @@
+package diskwriter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/rtptime"
+)
+
+// Manifest, if true, causes a JSON file describing each recording to be
+// written next to it when it is complete.
+var Manifest bool
+
+// manifestTrack describes one track of a recording.
+type manifestTrack struct {
+	Name     string `json:"name,omitempty"`
+	Codec    string `json:"codec"`
+	Width    uint32 `json:"width,omitempty"`
+	Height   uint32 `json:"height,omitempty"`
+	Channels uint16 `json:"channels,omitempty"`
+
+	// the parameters negotiated for the codec, as in the SDP
+	ClockRate uint32   `json:"clock-rate,omitempty"`
+	Fmtp      string   `json:"fmtp,omitempty"`
+	Feedback  []string `json:"rtcp-feedback,omitempty"`
+
+	// reception statistics: packets expected and lost in the network,
+	// and the maximum interarrival jitter, in milliseconds
+	Packets uint64  `json:"packets,omitempty"`
+	Lost    uint64  `json:"lost,omitempty"`
+	Jitter  float64 `json:"jitter,omitempty"`
+}
+
+// newManifestTrack returns the description of a track with the given
+// name and codec.
+func newManifestTrack(name string, codec webrtc.RTPCodecCapability) manifestTrack {
+	track := manifestTrack{
+		Name:      name,
+		Codec:     strings.ToLower(codec.MimeType),
+		ClockRate: codec.ClockRate,
+		Fmtp:      codec.SDPFmtpLine,
+	}
+	for _, fb := range codec.RTCPFeedback {
+		f := fb.Type
+		if fb.Parameter != "" {
+			f += " " + fb.Parameter
+		}
+		track.Feedback = append(track.Feedback, f)
+	}
+	return track
+}
+
+// setReception fills in the reception statistics of a track since the
+// file was opened.  Called locked.
+func (track *manifestTrack) setReception(t *diskTrack) {
+	expected := atomic.LoadUint64(&t.expected) - t.fileExpected
+	received := atomic.LoadUint64(&t.received) - t.fileReceived
+	track.Packets = expected
+	track.Lost = lost(expected, received)
+	track.Jitter = float64(t.jitterDuration()) / float64(time.Millisecond)
+}
+
+// manifest is the contents of the file written next to a recording.
+// The duration is that of the media, in seconds, and the timezone is the
+// one in which the time in the name of the recording is expressed.
+type manifest struct {
+	Group    string          `json:"group"`
+	Label    string          `json:"label,omitempty"`
+	Id       string          `json:"id"`
+	Username string          `json:"username,omitempty"`
+	Start    time.Time       `json:"start"`
+	End      time.Time       `json:"end"`
+	Timezone string          `json:"timezone"`
+	Duration float64         `json:"duration"`
+	Size     int64           `json:"size"`
+	Tracks   []manifestTrack `json:"tracks"`
+
+	// the capture time of the start of the recording, in the clock
+	// of the sender, when known from the abs-capture-time extension
+	CaptureStart *time.Time `json:"capture-start,omitempty"`
+}
+
+// manifestName returns the name of the manifest of a recording.
+func manifestName(recording string) string {
+	return strings.TrimSuffix(recording, filepath.Ext(recording)) + ".json"
+}
+
+// writeManifest writes the manifest of a recording.  The manifest is
+// written to a temporary file which is then renamed, so that readers
+// never see a partial manifest.
+func writeManifest(recording string, m *manifest) error {
+	data, err := json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	filename := manifestName(recording)
+	err = ioutil.WriteFile(filename+".part", data, FileMode)
+	if err != nil {
+		os.Remove(filename + ".part")
+		return err
+	}
+	err = os.Rename(filename+".part", filename)
+	if err != nil {
+		os.Remove(filename + ".part")
+		return err
+	}
+	return nil
+}
+
+// finishFile writes the manifest, notifies the webhook and schedules the
+// upload once a file containing the given tracks has been closed.
+// Called locked.
+func (conn *diskConn) finishFile(file *webmFile, tracks []manifestTrack) {
+	if !Manifest && WebhookURL == "" && !uploadEnabled() {
+		return
+	}
+	recording := recordingName(file)
+	if file.Err() != nil || recording == "" {
+		return
+	}
+
+	fi, err := os.Stat(recording)
+	if err != nil {
+		log.Printf("Finish recording: %v", err)
+		return
+	}
+
+	_, username := conn.remote.User()
+	timezone, _ := conn.fileStart.Zone()
+	if UTCFilenames {
+		timezone = "UTC"
+	}
+	m := &manifest{
+		Group:    conn.client.group.Name(),
+		Label:    conn.label,
+		Id:       conn.remote.Id(),
+		Username: username,
+		Start:    conn.fileStart,
+		End:      time.Now(),
+		Timezone: timezone,
+		Duration: float64(file.lastTime) / 1000,
+		Size:     fi.Size(),
+		Tracks:   tracks,
+	}
+	if conn.originCapture && conn.originNTP != 0 {
+		start := rtptime.NTPToTime(conn.originNTP)
+		m.CaptureStart = &start
+	}
+
+	files := []string{recording}
+	for _, name := range []string{
+		transcriptName(recording), dataName(recording),
+	} {
+		_, err = os.Stat(name)
+		if err == nil {
+			files = append(files, name)
+		}
+	}
+	if Manifest {
+		err = writeManifest(recording, m)
+		if err != nil {
+			log.Printf("Write manifest: %v", err)
+		} else {
+			files = append(files, manifestName(recording))
+		}
+	}
+
+	if WebhookURL != "" {
+		notifyWebhook(recording, m)
+	}
+
+	if uploadEnabled() {
+		queueUpload(conn.client.group, files)
+	}
+}
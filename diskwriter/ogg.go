@@ -0,0 +1,167 @@
+package diskwriter
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"strings"
+)
+
+// Ogg, if true, causes Opus tracks that are recorded alone in a file,
+// either because the recording is audio-only or because of
+// SeparateTracks, to be written in Ogg files (RFC 7845) rather than webm.
+var Ogg bool
+
+// Ogg page header flags
+const (
+	oggBOS = 0x02
+	oggEOS = 0x04
+)
+
+// isOgg returns true if a track is recorded in an Ogg file.
+func (t *diskTrack) isOgg() bool {
+	if !Ogg || !t.conn.perTrack() {
+		return false
+	}
+	switch strings.ToLower(t.remote.Codec().MimeType) {
+	case "audio/opus", "audio/red":
+		return true
+	}
+	return false
+}
+
+var oggCRCTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if (r & 0x80000000) != 0 {
+				r = r<<1 ^ 0x04C11DB7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+	return table
+}()
+
+// oggCRC computes the checksum of an Ogg page, RFC 3533 Section 6.
+func oggCRC(data []byte) uint32 {
+	var crc uint32
+	for _, b := range data {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// oggWriter writes the samples of an Opus track in the Ogg format.  Each
+// packet is written in its own page.  It implements
+// webm.BlockWriteCloser.
+type oggWriter struct {
+	file     *webmFile
+	serial   uint32
+	sequence uint32
+	channels uint16
+	// the position of the end of the last packet, in samples at 48kHz
+	granule uint64
+	// the last packet, which is held back so that it can be marked
+	// as the end of the stream
+	last []byte
+}
+
+func newOggWriter(file *webmFile, channels uint16, rate uint32) (*oggWriter, error) {
+	var serial [4]byte
+	_, err := crand.Read(serial[:])
+	if err != nil {
+		return nil, err
+	}
+	w := &oggWriter{
+		file:     file,
+		serial:   binary.LittleEndian.Uint32(serial[:]),
+		channels: channels,
+	}
+
+	w.writePage(oggBOS, 0, opusHead(channels, rate))
+	tags := make([]byte, 0, 8+4+6+4)
+	tags = append(tags, "OpusTags"...)
+	tags = append(tags, 6, 0, 0, 0)
+	tags = append(tags, "galene"...)
+	tags = append(tags, 0, 0, 0, 0)
+	w.writePage(0, 0, tags)
+	if err := file.Err(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// writePage writes a page containing a single packet, or no packet if
+// packet is nil.
+func (w *oggWriter) writePage(flags byte, granule uint64, packet []byte) {
+	segments := 0
+	if packet != nil {
+		segments = len(packet)/255 + 1
+	}
+	page := make([]byte, 27+segments, 27+segments+len(packet))
+	copy(page, "OggS")
+	page[5] = flags
+	binary.LittleEndian.PutUint64(page[6:], granule)
+	binary.LittleEndian.PutUint32(page[14:], w.serial)
+	binary.LittleEndian.PutUint32(page[18:], w.sequence)
+	page[26] = byte(segments)
+	for i := 0; i < segments; i++ {
+		page[27+i] = 255
+	}
+	if segments > 0 {
+		page[27+segments-1] = byte(len(packet) % 255)
+	}
+	page = append(page, packet...)
+	binary.LittleEndian.PutUint32(page[22:], oggCRC(page))
+	w.sequence++
+	w.file.Write(page)
+}
+
+// writePacket writes out the packet held back, if any, and holds back
+// a new one.
+func (w *oggWriter) writePacket(packet []byte) {
+	if w.last != nil {
+		w.writePage(0, w.granule, w.last)
+	}
+	w.last = packet
+	w.granule += uint64(opusDuration(packet, 48000))
+}
+
+// Write writes an Opus packet.  Since an Ogg stream cannot contain gaps,
+// gaps longer than a 20ms frame are filled with silence, so that the
+// granule positions remain consistent with the timestamps.
+func (w *oggWriter) Write(keyframe bool, timestamp int64, data []byte) (int, error) {
+	frame := silence[0]
+	if w.channels == 2 {
+		frame = silence[1]
+	}
+	if timestamp > 0 {
+		position := uint64(timestamp) * 48
+		for position >= w.granule+960 {
+			w.writePacket(frame)
+		}
+	}
+	w.writePacket(append([]byte(nil), data...))
+	if err := w.file.Err(); err != nil {
+		return 0, err
+	}
+	if timestamp > w.file.lastTime {
+		w.file.lastTime = timestamp
+	}
+	return len(data), nil
+}
+
+// Close writes out the last page, marking the end of the stream, and
+// closes the file.
+func (w *oggWriter) Close() error {
+	if w.last != nil {
+		w.writePage(oggEOS, w.granule, w.last)
+		w.last = nil
+	} else {
+		w.writePage(oggEOS, w.granule, nil)
+	}
+	return w.file.Close()
+}
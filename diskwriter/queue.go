@@ -0,0 +1,150 @@
+package diskwriter
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/at-wat/ebml-go/webm"
+)
+
+// writeQueueSize is the maximum number of samples waiting to be written.
+const writeQueueSize = 256
+
+// writeJob is a sample waiting to be written to disk.
+type writeJob struct {
+	track    *diskTrack
+	writer   webm.BlockWriteCloser
+	file     *webmFile
+	keyframe bool
+	tm       int64
+	data     []byte
+}
+
+// blockOverhead estimates the size of the framing of a block, which is
+// counted together with its data in the size of the queued samples.
+const blockOverhead = 8
+
+// size returns the number of bytes that the sample adds to its file.
+func (job *writeJob) size() int64 {
+	return int64(len(job.data)) + blockOverhead
+}
+
+// writeQueue hands samples over to a goroutine that writes them to disk,
+// so that slow storage doesn't delay the processing of RTP packets.  We
+// don't use a channel, since we need to choose which sample to drop when
+// the queue is full.
+type writeQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	jobs   []writeJob
+	busy   bool
+	closed bool
+}
+
+func newWriteQueue() *writeQueue {
+	q := &writeQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	go q.run()
+	return q
+}
+
+// push queues a sample for writing.  If the queue is full, the oldest
+// sample that is not a keyframe is dropped, or the oldest sample if all
+// are keyframes.  The interframes of the same track that follow cannot
+// be decoded without it, so they are dropped too, up to the track's next
+// keyframe; if there is none, the track is marked as needing a keyframe.
+// It returns the track of the dropped samples, if any, and their number.
+func (q *writeQueue) push(job writeJob) (*diskTrack, int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil, 0
+	}
+
+	atomic.AddInt64(&job.file.queued, job.size())
+	q.jobs = append(q.jobs, job)
+	q.cond.Broadcast()
+	if len(q.jobs) <= writeQueueSize {
+		return nil, 0
+	}
+
+	i := 0
+	for j := range q.jobs {
+		if !q.jobs[j].keyframe {
+			i = j
+			break
+		}
+	}
+	dropped := q.jobs[i].track
+	jobs := q.jobs[:i]
+	n := 0
+	resync := false
+	for j := i; j < len(q.jobs); j++ {
+		jb := q.jobs[j]
+		if jb.track == dropped && !resync &&
+			(j == i || !jb.keyframe) {
+			atomic.AddInt64(&jb.file.queued, -jb.size())
+			n++
+			continue
+		}
+		if jb.track == dropped {
+			resync = true
+		}
+		jobs = append(jobs, jb)
+	}
+	for j := len(jobs); j < len(q.jobs); j++ {
+		q.jobs[j] = writeJob{}
+	}
+	q.jobs = jobs
+	if !resync {
+		atomic.StoreUint32(&dropped.kfNeeded, 1)
+	}
+	return dropped, n
+}
+
+func (q *writeQueue) run() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		for len(q.jobs) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if len(q.jobs) == 0 {
+			return
+		}
+		job := q.jobs[0]
+		q.jobs[0] = writeJob{}
+		q.jobs = q.jobs[1:]
+		q.busy = true
+		q.mu.Unlock()
+
+		_, err := job.writer.Write(job.keyframe, job.tm, job.data)
+		if err != nil {
+			job.file.fail(err)
+		}
+		atomic.AddInt64(&job.file.queued, -job.size())
+
+		q.mu.Lock()
+		q.busy = false
+		q.cond.Broadcast()
+	}
+}
+
+// drain waits until all queued samples have been written.
+func (q *writeQueue) drain() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.jobs) > 0 || q.busy {
+		q.cond.Wait()
+	}
+}
+
+// close causes the writer goroutine to terminate once the queue is empty.
+func (q *writeQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
@@ -0,0 +1,242 @@
+package diskwriter
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jech/galene/group"
+)
+
+// quotaMu serialises quota enforcement, so that two connections don't
+// both delete files to make room for a single one.
+var quotaMu sync.Mutex
+
+// quotaInterval is the time during which the usage computed when
+// enforcing a group's quota is trusted.
+const quotaInterval = time.Minute
+
+// quotaState is the usage of a group as of the last enforcement of its
+// quota, plus the files opened since then.
+type quotaState struct {
+	usage   int64
+	time    time.Time
+	running bool
+}
+
+var quotaStatesMu sync.Mutex
+var quotaStates = make(map[string]*quotaState)
+
+func getQuotaState(name string) *quotaState {
+	s := quotaStates[name]
+	if s == nil {
+		s = &quotaState{}
+		quotaStates[name] = s
+	}
+	return s
+}
+
+// isRecording returns true if path is the name of a finished recording.
+func isRecording(path string) bool {
+	switch filepath.Ext(path) {
+	case ".webm", ".ivf", ".ogg":
+		return true
+	}
+	return false
+}
+
+// sidecarNames returns the names of the files written next to a
+// recording.
+func sidecarNames(recording string) []string {
+	return []string{
+		manifestName(recording), thumbnailName(recording),
+		transcriptName(recording), dataName(recording),
+	}
+}
+
+// removeRecording deletes a recording and the files written next to it.
+func removeRecording(path string) error {
+	err := os.Remove(path)
+	if err != nil {
+		return err
+	}
+	for _, name := range sidecarNames(path) {
+		err = os.Remove(name)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Delete recording: %v", err)
+		}
+	}
+	cleanLatestAbove(path)
+	return nil
+}
+
+// quotaFile is a finished recording that may be deleted to enforce
+// a quota.  The size includes the files written next to it.
+type quotaFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// groupUsage returns the total size of the files in the directory of
+// a group, excluding the directories of its subgroups, together with the
+// finished recordings, oldest first.
+func groupUsage(name string) (int64, []quotaFile, error) {
+	dir, err := GroupDirectory(name)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var total int64
+	files := make(map[string]os.FileInfo)
+	err = filepath.Walk(dir,
+		func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if isSymlink(fi) {
+				return nil
+			}
+			if fi.IsDir() {
+				if path == dir {
+					return nil
+				}
+				rel, err := filepath.Rel(dir, path)
+				if err == nil && group.Get(
+					name+"/"+filepath.ToSlash(rel),
+				) != nil {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			files[path] = fi
+			total += fi.Size()
+			return nil
+		},
+	)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var recordings []quotaFile
+	for path, fi := range files {
+		if !isRecording(path) {
+			continue
+		}
+		f := quotaFile{path: path, size: fi.Size(), modTime: fi.ModTime()}
+		for _, name := range sidecarNames(path) {
+			if sfi, ok := files[name]; ok {
+				f.size += sfi.Size()
+			}
+		}
+		recordings = append(recordings, f)
+	}
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].modTime.Before(recordings[j].modTime)
+	})
+	return total, recordings, nil
+}
+
+// Usage returns the total size of the recordings of a group.
+func Usage(name string) (int64, error) {
+	total, _, err := groupUsage(name)
+	return total, err
+}
+
+// quotaNeeded returns the space that must be available for a new file.
+func quotaNeeded() int64 {
+	if MaxFileSize > 0 {
+		return MaxFileSize
+	}
+	return 0
+}
+
+// checkQuota is called before a file is opened.  Since this happens
+// while packets are being recorded, it only consults the cached usage
+// of the group, and enforces the quota in the background if the usage
+// is stale or the new file might not fit.
+func checkQuota(g *group.Group) {
+	quota := g.RecordingQuota()
+	if quota <= 0 {
+		return
+	}
+	needed := quotaNeeded()
+
+	quotaStatesMu.Lock()
+	defer quotaStatesMu.Unlock()
+
+	s := getQuotaState(g.Name())
+	fits := !s.time.IsZero() && time.Since(s.time) < quotaInterval &&
+		s.usage+needed <= quota
+	// count the new file until the usage is recomputed
+	s.usage += needed
+	if fits || s.running {
+		return
+	}
+	s.running = true
+	go func() {
+		enforceQuota(g)
+		quotaStatesMu.Lock()
+		s.running = false
+		quotaStatesMu.Unlock()
+	}()
+}
+
+// enforceQuota deletes the oldest recordings of a group until a new file
+// of size MaxFileSize fits within the group's quota.  Files that are
+// being written are never deleted.
+func enforceQuota(g *group.Group) {
+	quota := g.RecordingQuota()
+	if quota <= 0 {
+		return
+	}
+
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+
+	total, recordings, err := groupUsage(g.Name())
+	if err != nil {
+		log.Printf("Recording quota: %v", err)
+		return
+	}
+	needed := quotaNeeded()
+
+	count := 0
+	for _, r := range recordings {
+		if total+needed <= quota {
+			break
+		}
+		if isOpenFile(r.path) {
+			continue
+		}
+		err := removeRecording(r.path)
+		if err != nil {
+			log.Printf("Recording quota: %v", err)
+			continue
+		}
+		total -= r.size
+		count++
+	}
+
+	quotaStatesMu.Lock()
+	s := getQuotaState(g.Name())
+	s.usage = total
+	s.time = time.Now()
+	quotaStatesMu.Unlock()
+
+	if count > 0 {
+		message := fmt.Sprintf(
+			"Deleted %v recordings in order to stay within quota",
+			count,
+		)
+		log.Printf("%v: %v", g.Name(), message)
+		g.WallOps(message)
+	}
+}
@@ -0,0 +1,185 @@
+package diskwriter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jech/galene/group"
+)
+
+func TestQuota(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	Directory = dir
+	defer func() {
+		Directory = ""
+	}()
+
+	saved := group.Directory
+	group.Directory = dir
+	defer func() {
+		group.Directory = saved
+	}()
+	err := ioutil.WriteFile(filepath.Join(dir, "quota.json"),
+		[]byte(`{"recording-quota": 1}`), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	g, err := group.Add("quota", nil)
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	gdir := filepath.Join(dir, "quota")
+	err = os.MkdirAll(gdir, 0700)
+	if err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	now := time.Now()
+	files := []struct {
+		name string
+		size int
+		age  time.Duration
+	}{
+		{"old.webm", 600000, 3 * time.Hour},
+		{"old.json", 1000, 3 * time.Hour},
+		{"middle.webm", 300000, 2 * time.Hour},
+		{"new.webm", 300000, time.Hour},
+		{"current.webm.part", 200000, 0},
+	}
+	total := int64(0)
+	for _, f := range files {
+		path := filepath.Join(gdir, f.name)
+		err := ioutil.WriteFile(path, make([]byte, f.size), 0600)
+		if err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		tm := now.Add(-f.age)
+		err = os.Chtimes(path, tm, tm)
+		if err != nil {
+			t.Fatalf("Chtimes: %v", err)
+		}
+		total += int64(f.size)
+	}
+
+	usage, err := Usage("quota")
+	if err != nil || usage != total {
+		t.Errorf("Usage: got %v (%v), expected %v", usage, err, total)
+	}
+
+	enforceQuota(g)
+
+	for _, f := range files {
+		_, err := os.Stat(filepath.Join(gdir, f.name))
+		deleted := strings.HasPrefix(f.name, "old.")
+		if deleted && err == nil {
+			t.Errorf("%v was not deleted", f.name)
+		} else if !deleted && err != nil {
+			t.Errorf("%v was deleted: %v", f.name, err)
+		}
+	}
+	usage, err = Usage("quota")
+	if err != nil || usage != total-601000 {
+		t.Errorf("Usage: got %v (%v), expected %v",
+			usage, err, total-601000)
+	}
+
+	// checkQuota trusts the cached usage while it is recent
+	older := filepath.Join(gdir, "older.webm")
+	err = ioutil.WriteFile(older, make([]byte, 600000), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	tm := now.Add(-4 * time.Hour)
+	err = os.Chtimes(older, tm, tm)
+	if err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+	checkQuota(g)
+	quotaStatesMu.Lock()
+	running := quotaStates["quota"].running
+	quotaStates["quota"].time = now.Add(-2 * quotaInterval)
+	quotaStatesMu.Unlock()
+	if running {
+		t.Errorf("Quota enforced despite recent usage")
+	}
+
+	// once it is stale, the quota is enforced in the background
+	checkQuota(g)
+	for i := 0; ; i++ {
+		quotaStatesMu.Lock()
+		running := quotaStates["quota"].running
+		quotaStatesMu.Unlock()
+		if !running {
+			break
+		}
+		if i >= 100 {
+			t.Fatalf("Quota enforcement didn't terminate")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, err = os.Stat(older)
+	if !os.IsNotExist(err) {
+		t.Errorf("%v was not deleted", older)
+	}
+}
+
+func TestIsRecording(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	Directory = dir
+	defer func() {
+		Directory = ""
+	}()
+
+	saved := group.Directory
+	group.Directory = dir
+	defer func() {
+		group.Directory = saved
+	}()
+	err := ioutil.WriteFile(filepath.Join(dir, "status.json"),
+		[]byte(`{"allow-recording": true}`), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	g, err := group.Add("status", nil)
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	client, err := Start(g)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	check := func(expected bool) {
+		t.Helper()
+		if client.IsRecording() != expected ||
+			g.IsRecording() != expected {
+			t.Errorf("Expected recording to be %v", expected)
+		}
+	}
+
+	// no connection is being recorded yet
+	check(false)
+	up := &testUp{id: "1"}
+	newTestConn(t, client, up, "")
+	check(true)
+	client.SetPaused(true)
+	check(false)
+	client.SetPaused(false)
+	check(true)
+	err = client.PushConn(g, up.id, nil, nil, "")
+	if err != nil {
+		t.Fatalf("PushConn: %v", err)
+	}
+	check(false)
+	newTestConn(t, client, up, "")
+	Stop(g, "")
+	check(false)
+}
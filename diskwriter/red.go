@@ -0,0 +1,103 @@
+package diskwriter
+
+import (
+	"errors"
+
+	"github.com/pion/rtp"
+)
+
+var errBadRED = errors.New("couldn't parse RED payload")
+
+// redBlock is one of the blocks carried by a RED packet, RFC 2198.
+type redBlock struct {
+	// timestamp offset relative to the packet's timestamp
+	offset uint32
+	data   []byte
+}
+
+// parseRED splits a RED payload into blocks.  The redundant blocks come
+// first, oldest first, and the primary encoding comes last.
+func parseRED(payload []byte) ([]redBlock, error) {
+	var blocks []redBlock
+	var lengths []int
+	i := 0
+	for {
+		if i >= len(payload) {
+			return nil, errBadRED
+		}
+		if (payload[i] & 0x80) == 0 {
+			// the header of the primary encoding
+			blocks = append(blocks, redBlock{})
+			i++
+			break
+		}
+		if i+4 > len(payload) {
+			return nil, errBadRED
+		}
+		offset := uint32(payload[i+1])<<6 | uint32(payload[i+2])>>2
+		length := int(payload[i+2]&0x3)<<8 | int(payload[i+3])
+		blocks = append(blocks, redBlock{offset: offset})
+		lengths = append(lengths, length)
+		i += 4
+	}
+
+	for j, l := range lengths {
+		if i+l > len(payload) {
+			return nil, errBadRED
+		}
+		blocks[j].data = payload[i : i+l]
+		i += l
+	}
+	blocks[len(blocks)-1].data = payload[i:]
+	return blocks, nil
+}
+
+func redPacket(p *rtp.Packet, seqno uint16, ts uint32, data []byte) *rtp.Packet {
+	packet := &rtp.Packet{
+		Header:  p.Header,
+		Payload: append([]byte(nil), data...),
+	}
+	packet.SequenceNumber = seqno
+	packet.Timestamp = ts
+	return packet
+}
+
+// unwrapRED converts a RED packet into packets carrying the primary
+// encoding.  If packets were lost since the last call, the lost packets
+// are reconstructed from the redundant blocks where possible.
+// Called locked.
+func (t *diskTrack) unwrapRED(p *rtp.Packet) []*rtp.Packet {
+	blocks, err := parseRED(p.Payload)
+	if err != nil {
+		return nil
+	}
+
+	var packets []*rtp.Packet
+	delta := p.SequenceNumber - t.redSeqno
+	if t.redValid && delta > 1 && delta < 0x8000 {
+		// We assume that the redundant blocks are the immediately
+		// preceding packets, which is what browsers send.
+		for j, b := range blocks[:len(blocks)-1] {
+			distance := uint16(len(blocks) - 1 - j)
+			if distance >= delta || len(b.data) == 0 {
+				continue
+			}
+			packets = append(packets, redPacket(
+				p, p.SequenceNumber-distance,
+				p.Timestamp-b.offset, b.data,
+			))
+		}
+	}
+	if !t.redValid || delta < 0x8000 {
+		t.redSeqno = p.SequenceNumber
+		t.redValid = true
+	}
+
+	primary := blocks[len(blocks)-1]
+	if len(primary.data) > 0 {
+		packets = append(packets, redPacket(
+			p, p.SequenceNumber, p.Timestamp, primary.data,
+		))
+	}
+	return packets
+}
@@ -0,0 +1,85 @@
+package diskwriter
+
+import (
+	"errors"
+	"io"
+	"strings"
+)
+
+// SinkFactory creates the destination of a recording of the named group.
+// The label is that of the connection, followed by the suffix of the
+// file, which includes its extension and thus determines the container;
+// when tracks are recorded separately, the factory is called once for
+// each of them.
+type SinkFactory func(group, label string) (io.WriteCloser, error)
+
+// Sink, if not nil, is used to create the destinations of recordings
+// instead of files in the group's directory.  If a destination implements
+// io.WriterAt, the recording's headers are patched when it is closed,
+// which makes it seekable; otherwise, its duration is unknown.  Since no
+// file is written to disk, no manifest, transcript or thumbnail is
+// written, and recordings are not encrypted.
+var Sink SinkFactory
+
+// sinkFile adapts the destination of a recording to the interface of the
+// files on disk.
+type sinkFile struct {
+	w io.WriteCloser
+}
+
+func (f sinkFile) Write(p []byte) (int, error) {
+	return f.w.Write(p)
+}
+
+// WriteAt patches data that has already been written if the destination
+// allows it, and drops it otherwise.
+func (f sinkFile) WriteAt(p []byte, off int64) (int, error) {
+	w, ok := f.w.(io.WriterAt)
+	if !ok {
+		return len(p), nil
+	}
+	return w.WriteAt(p, off)
+}
+
+func (f sinkFile) Sync() error {
+	s, ok := f.w.(interface{ Sync() error })
+	if !ok {
+		return nil
+	}
+	return s.Sync()
+}
+
+func (f sinkFile) Close() error {
+	return f.w.Close()
+}
+
+// Name returns the empty string, since the recording is not on disk.
+func (f sinkFile) Name() string {
+	return ""
+}
+
+// openSinks creates the destinations of a recording by calling Sink once
+// for each suffix.
+func openSinks(group, label string, suffixes []string) ([]diskFile, error) {
+	if EncryptionKey != nil {
+		return nil, errors.New("cannot encrypt recordings sent to a sink")
+	}
+	files := make([]diskFile, 0, len(suffixes))
+	for _, suffix := range suffixes {
+		w, err := Sink(group, label+suffix)
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, sinkFile{w})
+	}
+	return files, nil
+}
+
+// recordingName returns the name of the recording that file is written
+// to, or the empty string if it is not written to disk.
+func recordingName(file *webmFile) string {
+	return strings.TrimSuffix(file.file.Name(), ".part")
+}
@@ -0,0 +1,109 @@
+package diskwriter
+
+import (
+	"bytes"
+	"errors"
+	"image/jpeg"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/vp8"
+)
+
+// Thumbnails, if true, causes a JPEG image of the first VP8 keyframe of
+// each recording to be written next to it.  It is ignored if recordings
+// are encrypted.
+var Thumbnails bool
+
+// thumbnailSlots bounds the number of keyframes being decoded at any
+// given time.
+var thumbnailSlots = make(chan struct{}, 1)
+
+// thumbnailName returns the name of the thumbnail of a recording.
+func thumbnailName(recording string) string {
+	return strings.TrimSuffix(recording, filepath.Ext(recording)) + ".jpg"
+}
+
+// decodeThumbnail decodes a VP8 keyframe and encodes it as JPEG.
+func decodeThumbnail(data []byte) ([]byte, error) {
+	d := vp8.NewDecoder()
+	d.Init(bytes.NewReader(data), len(data))
+	fh, err := d.DecodeFrameHeader()
+	if err != nil {
+		return nil, err
+	}
+	if !fh.KeyFrame {
+		return nil, errors.New("not a keyframe")
+	}
+	img, err := d.DecodeFrame()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 75})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeThumbnail writes the thumbnail of a recording.  Like the
+// manifest, it is written to a temporary file which is then renamed.
+func writeThumbnail(recording string, data []byte) error {
+	img, err := decodeThumbnail(data)
+	if err != nil {
+		return err
+	}
+
+	filename := thumbnailName(recording)
+	f, err := os.OpenFile(filename+".part",
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC, FileMode)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(img)
+	err2 := f.Close()
+	if err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(filename+".part", filename)
+	}
+	if err != nil {
+		os.Remove(filename + ".part")
+		return err
+	}
+	return nil
+}
+
+// maybeThumbnail schedules the creation of a thumbnail if data is the
+// first VP8 keyframe of the current file.  Decoding happens in a separate
+// goroutine; if another keyframe is being decoded, this one is skipped
+// and we try again at the next keyframe.  Called with both locks held.
+func (t *diskTrack) maybeThumbnail(keyframe bool, data []byte) {
+	if !Thumbnails || EncryptionKey != nil || !keyframe ||
+		recordingName(t.file) == "" ||
+		t.conn.thumbnailGeneration == t.conn.generation ||
+		!strings.EqualFold(t.remote.Codec().MimeType, "video/vp8") {
+		return
+	}
+
+	select {
+	case thumbnailSlots <- struct{}{}:
+	default:
+		return
+	}
+	t.conn.thumbnailGeneration = t.conn.generation
+
+	recording := recordingName(t.file)
+	frame := append([]byte(nil), data...)
+	go func() {
+		defer func() { <-thumbnailSlots }()
+		err := writeThumbnail(recording, frame)
+		if err != nil {
+			log.Printf("Write thumbnail: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,293 @@
+package diskwriter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jech/galene/group"
+)
+
+// S3Endpoint, if not empty, is the URL of an S3-compatible service to
+// which completed recordings are uploaded, such as
+// "https://s3.eu-west-1.amazonaws.com".  Objects are addressed in path
+// style, as endpoint/bucket/key.
+var S3Endpoint string
+
+// S3Bucket is the bucket to which recordings are uploaded.
+var S3Bucket string
+
+// S3Prefix is prepended to the name of a recording, relative to
+// Directory, in order to build the key of the uploaded object.
+var S3Prefix string
+
+// S3Region is the region used to sign requests.
+var S3Region = "us-east-1"
+
+// S3AccessKey and S3SecretKey are the credentials used to sign requests.
+var S3AccessKey, S3SecretKey string
+
+// S3DeleteLocal, if true, causes recordings to be deleted from the local
+// disk once they have been successfully uploaded.
+var S3DeleteLocal bool
+
+// UploadWorkers is the number of recordings that are uploaded
+// concurrently.
+var UploadWorkers = 2
+
+// uploadDelays are the delays before each attempt to upload a file.
+var uploadDelays = []time.Duration{
+	0, 10 * time.Second, time.Minute, 5 * time.Minute,
+}
+
+// uploadJob is a recording waiting to be uploaded, together with the
+// files that accompany it, such as its manifest.
+type uploadJob struct {
+	group *group.Group
+	files []string
+}
+
+var uploader struct {
+	once sync.Once
+	jobs chan uploadJob
+}
+
+func uploadEnabled() bool {
+	return S3Endpoint != "" && S3Bucket != ""
+}
+
+// queueUpload schedules the upload of files, which belong to a single
+// recording.  It never blocks.
+func queueUpload(g *group.Group, files []string) {
+	uploader.once.Do(func() {
+		uploader.jobs = make(chan uploadJob, 256)
+		n := UploadWorkers
+		if n < 1 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			go uploadLoop(uploader.jobs)
+		}
+	})
+
+	select {
+	case uploader.jobs <- uploadJob{group: g, files: files}:
+	default:
+		uploadWarn(g, fmt.Sprintf(
+			"Upload of %v: too many pending uploads",
+			filepath.Base(files[0]),
+		))
+	}
+}
+
+func uploadWarn(g *group.Group, message string) {
+	log.Println(message)
+	if g != nil {
+		g.WallOps(message)
+	}
+}
+
+func uploadLoop(jobs <-chan uploadJob) {
+	for job := range jobs {
+		uploadRecording(job)
+	}
+}
+
+// uploadRecording uploads the files of a recording, retrying after
+// failures, and deletes them if requested.
+func uploadRecording(job uploadJob) {
+	name := filepath.Base(job.files[0])
+	client := &http.Client{}
+	for _, filename := range job.files {
+		var err error
+		for _, delay := range uploadDelays {
+			time.Sleep(delay)
+			err = uploadFile(
+				client, job.group.Name(), filename, time.Now(),
+			)
+			if err == nil {
+				break
+			}
+			log.Printf("Upload %v: %v", filename, err)
+		}
+		if err != nil {
+			uploadWarn(job.group, fmt.Sprintf(
+				"Upload of %v failed: %v", name, err,
+			))
+			return
+		}
+	}
+
+	if S3DeleteLocal {
+		for _, filename := range job.files {
+			err := os.Remove(filename)
+			if err != nil {
+				log.Printf("Upload: %v", err)
+			}
+		}
+	}
+	uploadWarn(job.group, "Uploaded recording "+name)
+}
+
+// s3Key returns the key of the object corresponding to filename, which
+// is a recording of the named group.
+func s3Key(name, filename string) (string, error) {
+	rel, err := relativeName(name, filename)
+	if err != nil {
+		return "", err
+	}
+	return S3Prefix + rel, nil
+}
+
+func uploadFile(client *http.Client, name, filename string, now time.Time) error {
+	key, err := s3Key(name, filename)
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(S3Endpoint)
+	if err != nil {
+		return err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + S3Bucket + "/" + key
+	// make sure the path is sent exactly as it is signed
+	u.RawPath = s3Escape(u.Path)
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PUT", u.String(), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = fi.Size()
+	if fi.Size() == 0 {
+		req.Body = http.NoBody
+	}
+	if strings.HasSuffix(filename, ".webm") {
+		req.Header.Set("Content-Type", "video/webm")
+	} else if strings.HasSuffix(filename, ".ivf") {
+		req.Header.Set("Content-Type", "video/x-ivf")
+	} else if strings.HasSuffix(filename, ".ogg") {
+		req.Header.Set("Content-Type", "audio/ogg")
+	} else if strings.HasSuffix(filename, ".vtt") {
+		req.Header.Set("Content-Type", "text/vtt")
+	} else if strings.HasSuffix(filename, ".json") {
+		req.Header.Set("Content-Type", "application/json")
+	} else if strings.HasSuffix(filename, ".jsonl") {
+		req.Header.Set("Content-Type", "application/jsonl")
+	}
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	req.Header.Set("X-Amz-Date", now.UTC().Format("20060102T150405Z"))
+	signS3(req, S3AccessKey, S3SecretKey, S3Region, now)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// s3Escape escapes a path as required by AWS Signature Version 4: every
+// byte except unreserved characters and slashes is percent-encoded.
+func s3Escape(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') ||
+			(c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// signS3 adds an Authorization header to req following AWS Signature
+// Version 4.  All the headers of req are signed, together with the host;
+// req must already carry the X-Amz-Content-Sha256 and X-Amz-Date headers.
+// The request has no query.
+func signS3(req *http.Request, accessKey, secretKey, region string, now time.Time) {
+	date := now.UTC().Format("20060102")
+	amzDate := now.UTC().Format("20060102T150405Z")
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(
+			strings.Join(v, ","),
+		)
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{
+		req.Method,
+		s3Escape(path),
+		"",
+		canonicalHeaders.String(),
+		signedHeaders,
+		headers["x-amz-content-sha256"],
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%v/%v, "+
+			"SignedHeaders=%v, Signature=%v",
+		accessKey, scope, signedHeaders, signature,
+	))
+}
@@ -0,0 +1,94 @@
+package diskwriter
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+// WebhookURL, if not empty, is a URL to which a JSON description of each
+// recording is posted when it is complete.
+var WebhookURL string
+
+// WebhookSecret, if not empty, is used to sign the requests sent to
+// WebhookURL.  The signature is the hex-encoded HMAC-SHA256 of the body,
+// sent in the X-Galene-Signature header as "sha256=<signature>".
+var WebhookSecret string
+
+// webhookDelays are the delays before each attempt to notify the webhook.
+var webhookDelays = []time.Duration{
+	0, 5 * time.Second, 30 * time.Second, 2 * time.Minute,
+}
+
+// webhookPayload is the body of a webhook request.
+type webhookPayload struct {
+	// the name of the recording, relative to Directory
+	File string `json:"file"`
+	manifest
+}
+
+// notifyWebhook asynchronously posts a description of recording to
+// WebhookURL.
+func notifyWebhook(recording string, m *manifest) {
+	file, err := relativeName(m.Group, recording)
+	if err != nil {
+		file = filepath.Base(recording)
+	}
+	body, err := json.Marshal(webhookPayload{
+		File:     file,
+		manifest: *m,
+	})
+	if err != nil {
+		log.Printf("Webhook: %v", err)
+		return
+	}
+	go postWebhook(WebhookURL, WebhookSecret, body)
+}
+
+// postWebhook posts body to url, retrying after failures.
+func postWebhook(url, secret string, body []byte) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	var err error
+	for _, delay := range webhookDelays {
+		time.Sleep(delay)
+		err = postWebhookOnce(client, url, secret, body)
+		if err == nil {
+			return
+		}
+	}
+	log.Printf("Webhook: %v, giving up", err)
+}
+
+func postWebhookOnce(client *http.Client, url, secret string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set("X-Galene-Signature",
+			"sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
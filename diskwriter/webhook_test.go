@@ -0,0 +1,99 @@
+package diskwriter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	dir := testDirectory(t)
+	defer os.RemoveAll(dir)
+
+	type request struct {
+		body      []byte
+		signature string
+	}
+	requests := make(chan request, 8)
+	failures := 1
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			mu.Lock()
+			fail := failures > 0
+			failures--
+			mu.Unlock()
+			if fail {
+				http.Error(w, "try again",
+					http.StatusServiceUnavailable)
+				return
+			}
+			requests <- request{body, r.Header.Get("X-Galene-Signature")}
+		},
+	))
+	defer server.Close()
+
+	Directory = dir
+	WebhookURL = server.URL
+	WebhookSecret = "secret"
+	savedDelays := webhookDelays
+	webhookDelays = []time.Duration{0, 10 * time.Millisecond}
+	defer func() {
+		Directory = ""
+		WebhookURL = ""
+		WebhookSecret = ""
+		webhookDelays = savedDelays
+	}()
+
+	recordVP8(t, dir)
+
+	var req request
+	select {
+	case req = <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Webhook was not called")
+	}
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(req.body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if req.signature != expected {
+		t.Errorf("Bad signature %v, expected %v",
+			req.signature, expected)
+	}
+
+	var payload struct {
+		File     string          `json:"file"`
+		Id       string          `json:"id"`
+		Duration float64         `json:"duration"`
+		Size     int64           `json:"size"`
+		Tracks   []manifestTrack `json:"tracks"`
+	}
+	err := json.Unmarshal(req.body, &payload)
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	recording := recordingFile(t, dir)
+	fi, err := os.Stat(recording)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if payload.File != filepath.Base(recording) || payload.Id != "up" ||
+		payload.Size != fi.Size() || len(payload.Tracks) != 1 {
+		t.Errorf("Unexpected payload %v", string(req.body))
+	}
+	// 200 frames at 10 fps, the last one at 19.9s
+	if payload.Duration < 19.8 || payload.Duration > 20 {
+		t.Errorf("Unexpected duration %v", payload.Duration)
+	}
+}
@@ -0,0 +1,685 @@
+package diskwriter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EBML and Matroska element IDs, including the length marker.
+const (
+	idEBML                = 0x1A45DFA3
+	idSegment             = 0x18538067
+	idSeekHead            = 0x114D9B74
+	idSeek                = 0x4DBB
+	idSeekID              = 0x53AB
+	idSeekPosition        = 0x53AC
+	idInfo                = 0x1549A966
+	idDuration            = 0x4489
+	idDateUTC             = 0x4461
+	idTracks              = 0x1654AE6B
+	idCluster             = 0x1F43B675
+	idTimecode            = 0xE7
+	idSimpleBlock         = 0xA3
+	idCues                = 0x1C53BB6B
+	idCuePoint            = 0xBB
+	idCueTime             = 0xB3
+	idCueTrackPositions   = 0xB7
+	idCueTrack            = 0xF7
+	idCueClusterPosition  = 0xF1
+	idCueRelativePosition = 0xF0
+	idVoid                = 0xEC
+	idChapters            = 0x1043A770
+	idEditionEntry        = 0x45B9
+	idChapterAtom         = 0xB6
+	idChapterUID          = 0x73C4
+	idChapterTimeStart    = 0x91
+	idChapterDisplay      = 0x80
+	idChapString          = 0x85
+	idChapLanguage        = 0x437C
+)
+
+// the space reserved for the SeekHead at the start of the segment
+const seekHeadSpace = 96
+
+// the minimum interval between cue points of a track, in milliseconds
+const cueInterval = 1000
+
+// readVint parses a variable-length integer.  If id is true, the length
+// marker is kept, as is the case for element IDs.  It returns the value,
+// the number of bytes consumed, and whether the value was all ones,
+// which denotes an unknown size.  A length of 0 indicates that more
+// data is needed, -1 that the data is malformed.
+func readVint(data []byte, id bool) (uint64, int, bool) {
+	if len(data) < 1 {
+		return 0, 0, false
+	}
+	length := 1
+	for length <= 8 && (data[0]&(0x80>>uint(length-1))) == 0 {
+		length++
+	}
+	if length > 8 {
+		return 0, -1, false
+	}
+	if len(data) < length {
+		return 0, 0, false
+	}
+	mask := byte(0xFF)
+	if !id {
+		mask = 0xFF >> uint(length)
+	}
+	v := uint64(data[0] & mask)
+	ones := (data[0] | ^(0xFF >> uint(length))) == 0xFF
+	for i := 1; i < length; i++ {
+		v = v<<8 | uint64(data[i])
+		ones = ones && data[i] == 0xFF
+	}
+	return v, length, ones
+}
+
+func appendID(b []byte, id uint32) []byte {
+	switch {
+	case id >= 1<<24:
+		return append(b,
+			byte(id>>24), byte(id>>16), byte(id>>8), byte(id),
+		)
+	case id >= 1<<16:
+		return append(b, byte(id>>16), byte(id>>8), byte(id))
+	case id >= 1<<8:
+		return append(b, byte(id>>8), byte(id))
+	default:
+		return append(b, byte(id))
+	}
+}
+
+// appendElement appends an element with the given ID and contents.
+func appendElement(b []byte, id uint32, data []byte) []byte {
+	b = appendID(b, id)
+	if len(data) < 0x7F {
+		b = append(b, 0x80|byte(len(data)))
+	} else {
+		var size [8]byte
+		binary.BigEndian.PutUint64(size[:], uint64(len(data)))
+		size[0] = 0x01
+		b = append(b, size[:]...)
+	}
+	return append(b, data...)
+}
+
+// appendUint appends an unsigned integer element.  If width is 0, the
+// shortest encoding is used.
+func appendUint(b []byte, id uint32, v uint64, width int) []byte {
+	if width == 0 {
+		width = 1
+		for width < 8 && v >= 1<<(8*uint(width)) {
+			width++
+		}
+	}
+	var data [8]byte
+	binary.BigEndian.PutUint64(data[:], v)
+	return appendElement(b, id, data[8-width:])
+}
+
+// voidElement returns a Void element that is exactly n bytes long.
+func voidElement(n int) []byte {
+	if n < 2 {
+		panic("Void element too short")
+	}
+	if n-2 < 0x7F {
+		return appendElement(nil, idVoid, make([]byte, n-2))
+	}
+	// use an eight-byte size so that the length is exact
+	b := make([]byte, n)
+	b[0] = idVoid
+	binary.BigEndian.PutUint64(b[1:], uint64(n-9))
+	b[1] = 0x01
+	return b
+}
+
+// chapter is a chapter of a recording, starting at the given time in
+// milliseconds.
+type chapter struct {
+	time  uint64
+	title string
+}
+
+type cuePoint struct {
+	time     uint64
+	track    uint64
+	cluster  int64
+	relative int64
+}
+
+// diskFile is the file underlying a recording, either an *os.File
+// or an *encryptedFile.
+type diskFile interface {
+	io.Writer
+	io.WriterAt
+	Sync() error
+	Close() error
+	Name() string
+}
+
+// webmFile wraps the file underlying a recording.  It follows the
+// structure of the data written by the muxer, and writes a SeekHead and
+// a Cues element when the file is closed, which makes the recording
+// seekable.
+type webmFile struct {
+	// the number of bytes written, and the size of the samples
+	// waiting in the write queue, accessed atomically.  These must
+	// come first in order to ensure 64-bit alignment.
+	size, queued int64
+
+	file diskFile
+	// the tracks for which cue points are generated
+	cueTracks map[uint64]bool
+
+	// number of bytes written to file
+	offset int64
+	// data not yet written to file
+	pending []byte
+	// number of bytes to pass through without parsing
+	skip int64
+
+	// the offset of the segment's data, 0 if not seen yet
+	segment int64
+	// the positions below are relative to the segment's data,
+	// -1 if not seen yet
+	seekHead, info, tracks int64
+	// the position of the current cluster, and of its data
+	cluster, clusterData int64
+	clusterTime          uint64
+	// the time of the last cue point of each track
+	lastCue map[uint64]uint64
+	cues    []cuePoint
+
+	// the offset of the value of the Duration element, 0 if unknown
+	duration int64
+	// the time at which the file was created
+	date time.Time
+	// the timestamp of the latest block
+	lastTime int64
+
+	// chapters are added by the connection, concurrently with writing
+	chapterMu sync.Mutex
+	chapters  []chapter
+
+	// the first write error, after which nothing more is written
+	errMu sync.Mutex
+	err   error
+
+	// buffers the data written to file, nil if unbuffered
+	bufMu sync.Mutex
+	buf   *bufio.Writer
+
+	// copies the data to the viewers of the live stream, nil if the
+	// file cannot be streamed
+	tap *liveTap
+
+	done chan struct{}
+}
+
+func newWebmFile(file diskFile, cueTracks map[uint64]bool) *webmFile {
+	f := &webmFile{
+		file:      file,
+		cueTracks: cueTracks,
+		seekHead:  -1,
+		info:      -1,
+		tracks:    -1,
+		cluster:   -1,
+		lastCue:   make(map[uint64]uint64),
+		date:      time.Now(),
+		tap:       newLiveTap(),
+		done:      make(chan struct{}),
+	}
+	if BufferSize > 0 {
+		f.buf = bufio.NewWriterSize(file, BufferSize)
+	}
+	return f
+}
+
+func (f *webmFile) write(data []byte) error {
+	if err := f.Err(); err != nil {
+		return err
+	}
+	if f.tap != nil {
+		// live viewers are not delayed by buffering
+		f.tap.write(data)
+	}
+	f.bufMu.Lock()
+	var n int
+	var err error
+	if f.buf != nil {
+		n, err = f.buf.Write(data)
+	} else {
+		n, err = f.file.Write(data)
+	}
+	f.bufMu.Unlock()
+	f.offset += int64(n)
+	atomic.StoreInt64(&f.size, f.offset)
+	if err != nil {
+		f.fail(err)
+	}
+	return err
+}
+
+// fail records an error that occurred when writing to the file.
+func (f *webmFile) fail(err error) {
+	f.errMu.Lock()
+	defer f.errMu.Unlock()
+	if f.err == nil {
+		f.err = err
+	}
+}
+
+// Err returns the first error that occurred when writing to the file.
+func (f *webmFile) Err() error {
+	f.errMu.Lock()
+	defer f.errMu.Unlock()
+	return f.err
+}
+
+// flush writes out any buffered data.
+func (f *webmFile) flush() error {
+	f.bufMu.Lock()
+	defer f.bufMu.Unlock()
+	if f.buf == nil {
+		return nil
+	}
+	err := f.buf.Flush()
+	if err != nil {
+		f.fail(err)
+	}
+	return err
+}
+
+// Sync flushes the file to stable storage.
+func (f *webmFile) Sync() error {
+	err := f.flush()
+	if err != nil {
+		return err
+	}
+	return f.file.Sync()
+}
+
+// Size returns the number of bytes written to the file so far.
+func (f *webmFile) Size() int64 {
+	return atomic.LoadInt64(&f.size)
+}
+
+// Queued returns an estimate of the size of the samples waiting to be
+// written to the file.
+func (f *webmFile) Queued() int64 {
+	return atomic.LoadInt64(&f.queued)
+}
+
+// Write never fails, since the muxer doesn't cope well with errors.
+// Errors are reported by Err instead.
+func (f *webmFile) Write(p []byte) (int, error) {
+	if f.Err() != nil {
+		return len(p), nil
+	}
+	f.pending = append(f.pending, p...)
+	for len(f.pending) > 0 {
+		n, err := f.consume()
+		if err != nil {
+			f.pending = nil
+			break
+		}
+		if n == 0 {
+			break
+		}
+	}
+	if len(f.pending) == 0 {
+		f.pending = nil
+	}
+	return len(p), nil
+}
+
+// consume writes out a prefix of the pending data, and returns its
+// length, or 0 if more data is needed.
+func (f *webmFile) consume() (int, error) {
+	if f.skip > 0 {
+		n := len(f.pending)
+		if int64(n) > f.skip {
+			n = int(f.skip)
+		}
+		err := f.write(f.pending[:n])
+		f.skip -= int64(n)
+		f.pending = f.pending[n:]
+		return n, err
+	}
+
+	id, idLength, _ := readVint(f.pending, true)
+	if idLength <= 0 {
+		return f.passThrough(idLength)
+	}
+	size, sizeLength, unknown := readVint(f.pending[idLength:], false)
+	if sizeLength <= 0 {
+		return f.passThrough(sizeLength)
+	}
+	header := idLength + sizeLength
+	position := f.offset - f.segment
+
+	switch id {
+	case idSegment:
+		err := f.write(f.pending[:header])
+		if err != nil {
+			return 0, err
+		}
+		f.segment = f.offset
+		f.seekHead = 0
+		err = f.write(voidElement(seekHeadSpace))
+		f.pending = f.pending[header:]
+		return header, err
+	case idCluster:
+		if f.tap != nil {
+			f.tap.endHeader(f.duration)
+		}
+		f.cluster = position
+		f.clusterData = position + int64(header)
+		err := f.write(f.pending[:header])
+		f.pending = f.pending[header:]
+		return header, err
+	case idTimecode:
+		if size > 8 {
+			return f.passThrough(-1)
+		}
+		if len(f.pending) < header+int(size) {
+			return 0, nil
+		}
+		var tc uint64
+		for _, b := range f.pending[header : header+int(size)] {
+			tc = tc<<8 | uint64(b)
+		}
+		f.clusterTime = tc
+	case idSimpleBlock:
+		track, l, _ := readVint(f.pending[header:], false)
+		if l < 0 {
+			return f.passThrough(l)
+		}
+		if l == 0 || len(f.pending) < header+l+3 {
+			return 0, nil
+		}
+		b := f.pending[header+l:]
+		tm := int64(f.clusterTime) +
+			int64(int16(binary.BigEndian.Uint16(b)))
+		if tm > f.lastTime {
+			f.lastTime = tm
+		}
+		keyframe := (b[2] & 0x80) != 0
+		if keyframe {
+			f.addCue(track, tm, position)
+			if f.tap != nil && f.cueTracks[track] {
+				f.tap.keyframe(f.clusterTime)
+			}
+		}
+	case idInfo:
+		if unknown || size > 0x10000 {
+			return f.passThrough(-1)
+		}
+		length := header + int(size)
+		if len(f.pending) < length {
+			return 0, nil
+		}
+		f.info = position
+		info, duration := f.rewriteInfo(f.pending[header:length])
+		element := appendElement(nil, idInfo, info)
+		if duration >= 0 {
+			f.duration = f.offset + int64(len(element)-len(info)) +
+				int64(duration)
+		}
+		err := f.write(element)
+		f.pending = f.pending[length:]
+		return length, err
+	case idTracks:
+		f.tracks = position
+	}
+
+	if unknown {
+		// an unknown-sized element other than a Segment or
+		// a Cluster, give up parsing
+		return f.passThrough(-1)
+	}
+
+	err := f.write(f.pending[:header])
+	f.pending = f.pending[header:]
+	f.skip = int64(size)
+	return header, err
+}
+
+// passThrough is called when the data cannot be parsed.  If length is
+// 0, more data is needed; otherwise, all further data is written out
+// unparsed.
+func (f *webmFile) passThrough(length int) (int, error) {
+	if length == 0 {
+		return 0, nil
+	}
+	n := len(f.pending)
+	err := f.write(f.pending)
+	f.pending = nil
+	f.skip = 1 << 62
+	return n, err
+}
+
+// rewriteInfo adds a DateUTC element to the contents of the Info element
+// if there is none, and replaces any Duration element with one that can
+// be patched when the file is closed.  It returns the new contents and
+// the offset of the Duration's value, or -1 if the contents couldn't
+// be parsed.
+func (f *webmFile) rewriteInfo(data []byte) ([]byte, int) {
+	var info []byte
+	hasDate := false
+	for d := data; len(d) > 0; {
+		id, l1, _ := readVint(d, true)
+		if l1 <= 0 {
+			return data, -1
+		}
+		size, l2, unknown := readVint(d[l1:], false)
+		if l2 <= 0 || unknown || uint64(len(d)-l1-l2) < size {
+			return data, -1
+		}
+		length := l1 + l2 + int(size)
+		switch id {
+		case idDuration:
+			// replaced below
+		case idDateUTC:
+			hasDate = true
+			info = append(info, d[:length]...)
+		default:
+			info = append(info, d[:length]...)
+		}
+		d = d[length:]
+	}
+
+	if !hasDate {
+		// nanoseconds since the start of the millennium
+		epoch := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+		info = appendUint(
+			info, idDateUTC, uint64(f.date.Sub(epoch)), 8,
+		)
+	}
+	info = appendID(info, idDuration)
+	info = append(info, 0x88)
+	duration := len(info)
+	info = append(info, make([]byte, 8)...)
+	return info, duration
+}
+
+// addChapter adds a chapter, which is written out when the file is
+// closed.
+func (f *webmFile) addChapter(tm uint64, title string) {
+	f.chapterMu.Lock()
+	defer f.chapterMu.Unlock()
+	f.chapters = append(f.chapters, chapter{time: tm, title: title})
+}
+
+// addCue records a cue point for a keyframe at the given position.
+func (f *webmFile) addCue(track uint64, tm int64, position int64) {
+	if tm < 0 || f.cluster < 0 || !f.cueTracks[track] {
+		return
+	}
+	last, ok := f.lastCue[track]
+	if ok && uint64(tm) < last+cueInterval {
+		return
+	}
+	f.lastCue[track] = uint64(tm)
+	f.cues = append(f.cues, cuePoint{
+		time:     uint64(tm),
+		track:    track,
+		cluster:  f.cluster,
+		relative: position - f.clusterData,
+	})
+}
+
+// Close writes out the Cues and SeekHead, patches the Duration, closes
+// the file and removes any ".part" suffix from its name.
+func (f *webmFile) Close() error {
+	defer close(f.done)
+
+	// the live stream ends before the cues and chapters are written
+	if f.tap != nil {
+		f.tap.close()
+	}
+	name := f.file.Name()
+	err := f.finish()
+	err2 := f.file.Close()
+	if err == nil {
+		err = err2
+	}
+	if strings.HasSuffix(name, ".part") {
+		err2 = os.Rename(name, strings.TrimSuffix(name, ".part"))
+		if err == nil {
+			err = err2
+		}
+	}
+	delOpenFile(name)
+	return err
+}
+
+func (f *webmFile) finish() error {
+	if err := f.Err(); err != nil {
+		return err
+	}
+
+	if len(f.pending) > 0 {
+		err := f.write(f.pending)
+		f.pending = nil
+		if err != nil {
+			return err
+		}
+	}
+
+	// if not, we didn't manage to follow the structure of the file
+	structured := f.seekHead >= 0 && f.skip == 0
+
+	f.chapterMu.Lock()
+	chapters := f.chapters
+	f.chapterMu.Unlock()
+	chaptersPosition := int64(-1)
+	if structured && len(chapters) > 0 {
+		chaptersPosition = f.offset - f.segment
+		var atoms []byte
+		for i, c := range chapters {
+			var display []byte
+			display = appendElement(
+				display, idChapString, []byte(c.title),
+			)
+			display = appendElement(
+				display, idChapLanguage, []byte("eng"),
+			)
+			var atom []byte
+			atom = appendUint(atom, idChapterUID, uint64(i+1), 0)
+			atom = appendUint(
+				atom, idChapterTimeStart, c.time*1000000, 0,
+			)
+			atom = appendElement(atom, idChapterDisplay, display)
+			atoms = appendElement(atoms, idChapterAtom, atom)
+		}
+		err := f.write(appendElement(
+			nil, idChapters,
+			appendElement(nil, idEditionEntry, atoms),
+		))
+		if err != nil {
+			return err
+		}
+	}
+
+	cues := int64(-1)
+	if structured && len(f.cues) > 0 {
+		cues = f.offset - f.segment
+		var points []byte
+		for _, c := range f.cues {
+			var positions []byte
+			positions = appendUint(positions, idCueTrack, c.track, 0)
+			positions = appendUint(
+				positions, idCueClusterPosition,
+				uint64(c.cluster), 0,
+			)
+			positions = appendUint(
+				positions, idCueRelativePosition,
+				uint64(c.relative), 0,
+			)
+			var point []byte
+			point = appendUint(point, idCueTime, c.time, 0)
+			point = appendElement(
+				point, idCueTrackPositions, positions,
+			)
+			points = appendElement(points, idCuePoint, point)
+		}
+		err := f.write(appendElement(nil, idCues, points))
+		if err != nil {
+			return err
+		}
+	}
+
+	// the data must be on disk before we patch it
+	err := f.flush()
+	if err != nil {
+		return err
+	}
+
+	if f.duration > 0 {
+		var duration [8]byte
+		binary.BigEndian.PutUint64(
+			duration[:], math.Float64bits(float64(f.lastTime)),
+		)
+		_, err := f.file.WriteAt(duration[:], f.duration)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !structured {
+		return nil
+	}
+
+	var seeks []byte
+	for _, s := range []struct {
+		id       uint32
+		position int64
+	}{
+		{idInfo, f.info}, {idTracks, f.tracks},
+		{idChapters, chaptersPosition}, {idCues, cues},
+	} {
+		if s.position < 0 {
+			continue
+		}
+		var seek []byte
+		seek = appendElement(seek, idSeekID, appendID(nil, s.id))
+		seek = appendUint(
+			seek, idSeekPosition, uint64(s.position), 8,
+		)
+		seeks = appendElement(seeks, idSeek, seek)
+	}
+	seekHead := appendElement(nil, idSeekHead, seeks)
+	seekHead = append(seekHead, voidElement(seekHeadSpace-len(seekHead))...)
+	_, err = f.file.WriteAt(seekHead, f.segment+f.seekHead)
+	return err
+}
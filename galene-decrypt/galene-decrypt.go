@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jech/galene/diskwriter"
+)
+
+func main() {
+	var keyFile string
+	flag.StringVar(&keyFile, "key", "",
+		"read the hex-encoded encryption key from `file`")
+	flag.Parse()
+
+	if keyFile == "" || len(flag.Args()) == 0 {
+		fmt.Fprintf(
+			flag.CommandLine.Output(),
+			"Usage: %s -key file recording...\n",
+			os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	key, err := diskwriter.LoadEncryptionKey(keyFile)
+	if err != nil {
+		log.Fatalf("Load key: %v", err)
+	}
+
+	status := 0
+	for _, filename := range flag.Args() {
+		err := decrypt(filename, key)
+		if err != nil {
+			log.Printf("%v: %v", filename, err)
+			status = 1
+		}
+	}
+	os.Exit(status)
+}
+
+// decrypt decrypts filename.webm into filename.dec.webm, and similarly
+// for other extensions.
+func decrypt(filename string, key []byte) error {
+	in, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	ext := filepath.Ext(filename)
+	outname := strings.TrimSuffix(filename, ext) + ".dec" + ext
+	out, err := os.OpenFile(
+		outname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600,
+	)
+	if err != nil {
+		return err
+	}
+	err = diskwriter.DecryptRecording(out, in, key)
+	err2 := out.Close()
+	if err == nil {
+		err = err2
+	}
+	return err
+}
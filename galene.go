@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
@@ -18,6 +19,9 @@ import (
 
 func main() {
 	var cpuprofile, memprofile, mutexprofile, httpAddr, dataDir string
+	var noICEFallback bool
+	var iceCandidates string
+	var recordingKey, recordingsAllowed string
 
 	flag.StringVar(&httpAddr, "http", ":8443", "web server `address`")
 	flag.StringVar(&webserver.StaticRoot, "static", "./static/",
@@ -32,6 +36,89 @@ func main() {
 		"group description `directory`")
 	flag.StringVar(&diskwriter.Directory, "recordings", "./recordings/",
 		"recordings `directory`")
+	flag.Uint64Var(&diskwriter.MaxBitrate, "recording-max-bitrate", 0,
+		"maximum `bitrate` of the video layer recorded")
+	flag.StringVar(&recordingsAllowed, "recording-allowed", "",
+		"`list` of directories where groups may store recordings")
+	flag.StringVar(&diskwriter.VideoLabel, "recording-video-label", "",
+		"only record video tracks with the given `label`")
+	flag.StringVar(&diskwriter.Subdirectory, "recording-subdirectory", "",
+		"store recordings in one subdirectory per `user or connection`")
+	flag.StringVar(&diskwriter.FilenameTemplate, "recording-template", "",
+		"`template` for the names of recordings")
+	flag.BoolVar(&diskwriter.UTCFilenames, "recording-utc", false,
+		"use UTC rather than local time in the names of recordings")
+	flag.IntVar(&diskwriter.FilenameAttempts, "recording-filename-attempts",
+		100, "`number` of numbered names tried before using a random suffix")
+	flag.DurationVar(&diskwriter.KeyframeInterval,
+		"recording-keyframe-interval", 10*time.Second,
+		"keyframe request `interval` when recording")
+	flag.Int64Var(&diskwriter.MaxFileSize, "recording-max-size", 0,
+		"maximum `size` of recording files in bytes, 0 means unlimited")
+	flag.Uint64Var(&diskwriter.MinFreeSpace, "recording-min-free", 0,
+		"don't start recordings with less than `size` bytes of free disk")
+	flag.DurationVar(&diskwriter.SegmentDuration, "recording-segment", 0,
+		"split recordings into files of the given `duration`")
+	flag.IntVar(&diskwriter.AudioDepth, "recording-audio-depth", 16,
+		"`number` of packets buffered for reordering audio when recording")
+	flag.IntVar(&diskwriter.VideoDepth, "recording-video-depth", 128,
+		"`number` of packets buffered for reordering video when recording")
+	flag.BoolVar(&diskwriter.AlignStart, "recording-align-start", true,
+		"start recordings at the first video keyframe")
+	flag.DurationVar(&diskwriter.SyncInterval, "recording-sync", 0,
+		"flush recordings to disk every `interval`")
+	flag.IntVar(&diskwriter.BufferSize, "recording-buffer-size", 64*1024,
+		"`size` of the buffer used when writing recordings")
+	flag.DurationVar(&diskwriter.DTXThreshold,
+		"recording-dtx-threshold", 100*time.Millisecond,
+		"fill gaps in recorded audio longer than `duration` with silence")
+	flag.StringVar(&diskwriter.Username, "recording-username", "RECORDING",
+		"`username` of the recording client")
+	flag.IntVar(&diskwriter.MaxRecordings, "recording-max", 0,
+		"maximum `number` of connections recorded simultaneously")
+	flag.BoolVar(&diskwriter.SeparateTracks, "recording-separate-tracks",
+		false, "record each track in a separate file")
+	flag.BoolVar(&diskwriter.IVF, "recording-ivf", false,
+		"record VP8 and VP9 in IVF files, and audio in separate files")
+	flag.BoolVar(&diskwriter.Ogg, "recording-ogg", false,
+		"record Opus in Ogg files when it is alone in a file")
+	flag.BoolVar(&diskwriter.Manifest, "recording-manifest", false,
+		"write a JSON manifest next to each recording")
+	flag.BoolVar(&diskwriter.Thumbnails, "recording-thumbnails", false,
+		"write a JPEG thumbnail next to each VP8 recording")
+	flag.IntVar(&diskwriter.MaxDataMessageSize, "recording-data-max-size",
+		16*1024, "maximum `size` of recorded data channel messages")
+	flag.IntVar(&diskwriter.MaxDataRate, "recording-data-rate", 20,
+		"maximum `number` of data channel messages recorded per second")
+	flag.StringVar(&diskwriter.WebhookURL, "recording-webhook", "",
+		"post a description of each completed recording to `url`")
+	flag.StringVar(&diskwriter.WebhookSecret, "recording-webhook-secret", "",
+		"`secret` used to sign webhook requests")
+	flag.StringVar(&diskwriter.S3Endpoint, "recording-s3-endpoint", "",
+		"upload completed recordings to the S3 service at `url`")
+	flag.StringVar(&diskwriter.S3Bucket, "recording-s3-bucket", "",
+		"S3 `bucket` for recordings")
+	flag.StringVar(&diskwriter.S3Prefix, "recording-s3-prefix", "",
+		"`prefix` of the keys of uploaded recordings")
+	flag.StringVar(&diskwriter.S3Region, "recording-s3-region", "us-east-1",
+		"S3 `region`")
+	flag.BoolVar(&diskwriter.S3DeleteLocal, "recording-s3-delete", false,
+		"delete recordings from local disk once uploaded")
+	flag.StringVar(&recordingKey, "recording-key", "",
+		"encrypt recordings with the hex-encoded AES-256 key in `file`")
+	flag.DurationVar(&diskwriter.WarnInterval, "recording-warn-interval",
+		10*time.Second,
+		"minimum `interval` between identical recording warnings")
+	flag.StringVar(&diskwriter.BrokenRecordings, "recording-broken", "move",
+		"`action` for recordings without media found at startup: "+
+			"move, delete or none")
+	flag.Int64Var(&diskwriter.BrokenSize, "recording-broken-size", 1024,
+		"`size` in bytes below which a recording is considered broken")
+	flag.DurationVar(&diskwriter.RetentionPeriod, "recording-retention", 0,
+		"delete recordings older than `duration`, 0 means never")
+	flag.DurationVar(&diskwriter.RetentionInterval,
+		"recording-retention-interval", time.Hour,
+		"`interval` between scans for old recordings")
 	flag.StringVar(&cpuprofile, "cpuprofile", "",
 		"store CPU profile in `file`")
 	flag.StringVar(&memprofile, "memprofile", "",
@@ -41,8 +128,51 @@ func main() {
 	flag.BoolVar(&group.UseMDNS, "mdns", false, "gather mDNS addresses")
 	flag.BoolVar(&group.ICERelayOnly, "relay-only", false,
 		"require use of TURN relays for all media traffic")
+	flag.StringVar(&iceCandidates, "ice-candidates", "host,srflx,relay",
+		"comma-separated `types` of ICE candidates to use")
+	flag.IntVar(&group.ICEMaxServers, "ice-max-servers", 0,
+		"maximum `number` of ICE servers sent to clients, 0 means unlimited")
+	flag.BoolVar(&group.ICEFilePrecedence, "ice-file-precedence", false,
+		"prefer global ICE servers to a group's servers with the same URLs")
+	flag.BoolVar(&noICEFallback, "no-ice-fallback", false,
+		"don't use a public STUN server when no ICE servers are configured")
 	flag.Parse()
 
+	if noICEFallback {
+		group.ICEFallback = nil
+	}
+
+	policy, err := group.ParseICECandidatePolicy(iceCandidates)
+	if err != nil {
+		log.Fatalf("Parse -ice-candidates: %v", err)
+	}
+	group.ICECandidates = policy
+
+	if recordingKey != "" {
+		key, err := diskwriter.LoadEncryptionKey(recordingKey)
+		if err != nil {
+			log.Fatalf("Load recording key: %v", err)
+		}
+		diskwriter.EncryptionKey = key
+	}
+
+	if recordingsAllowed != "" {
+		diskwriter.AllowedDirectories =
+			filepath.SplitList(recordingsAllowed)
+	}
+
+	switch diskwriter.BrokenRecordings {
+	case "move", "delete":
+	case "none":
+		diskwriter.BrokenRecordings = ""
+	default:
+		log.Fatalf("Unknown value %v for -recording-broken",
+			diskwriter.BrokenRecordings)
+	}
+
+	diskwriter.S3AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	diskwriter.S3SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+
 	if cpuprofile != "" {
 		f, err := os.Create(cpuprofile)
 		if err != nil {
@@ -81,7 +211,10 @@ func main() {
 		}()
 	}
 
+	diskwriter.CleanBroken()
+
 	group.ICEFilename = filepath.Join(dataDir, "ice-servers.json")
+	group.WatchICEConfiguration()
 
 	go group.ReadPublicGroups()
 
@@ -97,15 +230,39 @@ func main() {
 	terminate := make(chan os.Signal, 1)
 	signal.Notify(terminate, syscall.SIGINT, syscall.SIGTERM)
 
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
 	ticker := time.NewTicker(15 * time.Minute)
 	defer ticker.Stop()
 
+	var recordingsTicker <-chan time.Time
+	if diskwriter.RetentionPeriod > 0 &&
+		diskwriter.RetentionInterval > 0 && diskwriter.Directory != "" {
+		t := time.NewTicker(diskwriter.RetentionInterval)
+		defer t.Stop()
+		recordingsTicker = t.C
+		go diskwriter.Expire()
+	}
+
 	for {
 		select {
 		case <-ticker.C:
 			go group.Expire()
+		case <-recordingsTicker:
+			go diskwriter.Expire()
+		case <-reload:
+			go group.ReloadICEConfiguration()
 		case <-terminate:
 			webserver.Shutdown()
+			ctx, cancel := context.WithTimeout(
+				context.Background(), 10*time.Second,
+			)
+			err := diskwriter.Shutdown(ctx)
+			cancel()
+			if err != nil {
+				log.Printf("Finalise recordings: %v", err)
+			}
 			return
 		case <-serverDone:
 			os.Exit(1)
@@ -4,10 +4,12 @@ go 1.13
 
 require (
 	github.com/at-wat/ebml-go v0.11.0
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/gorilla/websocket v1.4.2
 	github.com/pion/ice/v2 v2.0.14
 	github.com/pion/rtcp v1.2.6
 	github.com/pion/rtp v1.6.2
 	github.com/pion/webrtc/v3 v3.0.0
 	golang.org/x/crypto v0.0.0-20201217014255-9d1352758620
+	golang.org/x/image v0.0.0-20201208152932-35266b937fa6
 )
@@ -105,3 +105,21 @@ type Client interface {
 type Kickable interface {
 	Kick(id, user, message string) error
 }
+
+// ConnRequester is implemented by clients that can be asked to push their
+// connections to another client.
+type ConnRequester interface {
+	RequestConns(target Client, g *Group) error
+}
+
+// Recorder is implemented by clients that record the group.
+type Recorder interface {
+	// IsRecording returns true if some connections are being recorded
+	IsRecording() bool
+}
+
+// ChatReceiver is implemented by clients other than web clients that
+// receive the public chat messages of their group.
+type ChatReceiver interface {
+	PushChat(id, username string, time int64, kind string, value interface{}) error
+}
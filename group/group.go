@@ -14,6 +14,8 @@ import (
 
 	"github.com/pion/ice/v2"
 	"github.com/pion/webrtc/v3"
+
+	"github.com/jech/galene/conn"
 )
 
 var Directory string
@@ -116,11 +118,65 @@ func (g *Group) AllowRecording() bool {
 	return g.description.AllowRecording
 }
 
+func (g *Group) RecordAudioOnly() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.description.RecordAudioOnly
+}
+
+func (g *Group) SilentRecording() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.description.SilentRecording
+}
+
+func (g *Group) MaxRecordings() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.description.MaxRecordings
+}
+
+// RecordingQuota returns the maximum total size of the recordings of the
+// group in bytes, or 0 if unlimited.
+func (g *Group) RecordingQuota() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.description.RecordingQuota * 1024 * 1024
+}
+
+// RecordingDirectory returns the directory where the group's recordings
+// are stored, as specified in its description, or "" for the default.
+func (g *Group) RecordingDirectory() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.description.RecordingDirectory
+}
+
+func (g *Group) RecordChat() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.description.RecordChat
+}
+
+func (g *Group) RecordDataChannels() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.description.RecordDataChannels
+}
+
+func (g *Group) RelayOnlyAnonymous() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.description.RelayOnlyAnonymous
+}
+
 var groups struct {
 	mu     sync.Mutex
 	groups map[string]*Group
 }
 
+// API returns the API used by the connections that receive media from
+// the group's clients.
 func (g *Group) API() *webrtc.API {
 	return g.api
 }
@@ -195,7 +251,34 @@ func payloadType(codec webrtc.RTPCodecCapability) (webrtc.PayloadType, error) {
 	}
 }
 
+// APIFromCodecs returns an API for connections that send media to
+// clients.  These negotiate no RTP header extensions: forwarded packets
+// keep the header extensions of the sender, whose ids were negotiated
+// with the sender only, and are therefore ignored by receivers.
 func APIFromCodecs(codecs []webrtc.RTPCodecCapability) *webrtc.API {
+	return apiFromCodecs(codecs, false)
+}
+
+// registerHeaderExtension registers an RTP header extension for both audio
+// and video.
+func registerHeaderExtension(m *webrtc.MediaEngine, uri string) {
+	for _, tpe := range []webrtc.RTPCodecType{
+		webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo,
+	} {
+		err := m.RegisterHeaderExtension(
+			webrtc.RTPHeaderExtensionCapability{URI: uri}, tpe,
+		)
+		if err != nil {
+			log.Printf("%v", err)
+		}
+	}
+}
+
+// apiFromCodecs returns an API that negotiates the given codecs.  If up
+// is true, the API is meant for connections that receive media, and
+// negotiates the abs-capture-time header extension, which is used when
+// recording.
+func apiFromCodecs(codecs []webrtc.RTPCodecCapability, up bool) *webrtc.API {
 	s := webrtc.SettingEngine{}
 	s.SetSRTPReplayProtectionWindow(512)
 	if !UseMDNS {
@@ -240,6 +323,9 @@ func APIFromCodecs(codecs []webrtc.RTPCodecCapability) *webrtc.API {
 			tpe,
 		)
 	}
+	if up {
+		registerHeaderExtension(&m, conn.AbsCaptureTimeURI)
+	}
 	return webrtc.NewAPI(
 		webrtc.WithSettingEngine(s),
 		webrtc.WithMediaEngine(&m),
@@ -283,7 +369,7 @@ func Add(name string, desc *description) (*Group, error) {
 			codecs = append(codecs, codec)
 		}
 
-		api := APIFromCodecs(codecs)
+		api := apiFromCodecs(codecs, true)
 
 		g = &Group{
 			name:        name,
@@ -346,6 +432,37 @@ func GetNames() []string {
 	return names
 }
 
+// GetDescriptionNames returns the names of the groups that have
+// a description file, whether they are running or not.
+func GetDescriptionNames() ([]string, error) {
+	names := make([]string, 0)
+	if Directory == "" {
+		return names, nil
+	}
+
+	err := filepath.Walk(Directory,
+		func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				log.Printf("Group description %v: %v", path, err)
+				return nil
+			}
+			if fi.IsDir() || !strings.HasSuffix(path, ".json") {
+				return nil
+			}
+			filename, err := filepath.Rel(Directory, path)
+			if err != nil {
+				log.Printf("Group description %v: %v", path, err)
+				return nil
+			}
+			names = append(names, strings.TrimSuffix(
+				filepath.ToSlash(filename), ".json",
+			))
+			return nil
+		},
+	)
+	return names, err
+}
+
 type SubGroup struct {
 	Name    string
 	Clients int
@@ -434,10 +551,13 @@ func AddClient(group string, c Client) (*Group, error) {
 		return nil, err
 	}
 
+	// this may consult the group's configuration, which takes the lock
+	override := c.OverridePermissions(g)
+
 	g.mu.Lock()
 	defer g.mu.Unlock()
 
-	if !c.OverridePermissions(g) {
+	if !override {
 		perms, err := g.description.GetPermission(group, c)
 		if err != nil {
 			return nil, err
@@ -572,6 +692,53 @@ func (g *Group) WallOps(message string) {
 	}
 }
 
+// IsRecording returns true if the group is being recorded.
+func (g *Group) IsRecording() bool {
+	for _, c := range g.GetClients(nil) {
+		r, ok := c.(Recorder)
+		if ok && r.IsRecording() {
+			return true
+		}
+	}
+	return false
+}
+
+type statusChanger interface {
+	StatusChanged() error
+}
+
+// RecordingChanged notifies the clients that the group has started or
+// stopped being recorded.  It must not be called with a client's lock
+// held, since clients call IsRecording in response.
+func (g *Group) RecordingChanged() {
+	clients := g.GetClients(nil)
+	for _, c := range clients {
+		s, ok := c.(statusChanger)
+		if !ok {
+			continue
+		}
+		err := s.StatusChanged()
+		if err != nil {
+			log.Printf("RecordingChanged: %v", err)
+		}
+	}
+}
+
+// Wall sends a notice that is displayed to all clients in the group.
+func (g *Group) Wall(message string) {
+	clients := g.GetClients(nil)
+	for _, c := range clients {
+		w, ok := c.(warner)
+		if !ok {
+			continue
+		}
+		err := w.Warn(false, message)
+		if err != nil {
+			log.Printf("Wall: %v", err)
+		}
+	}
+}
+
 func FromJSTime(tm int64) time.Time {
 	if tm == 0 {
 		return time.Time{}
@@ -651,22 +818,32 @@ func matchClient(group string, c Challengeable, users []ClientCredentials) (bool
 }
 
 type description struct {
-	fileName       string              `json:"-"`
-	loadTime       time.Time           `json:"-"`
-	modTime        time.Time           `json:"-"`
-	fileSize       int64               `json:"-"`
-	Description    string              `json:"description,omitempty"`
-	Redirect       string              `json:"redirect,omitempty"`
-	Public         bool                `json:"public,omitempty"`
-	MaxClients     int                 `json:"max-clients,omitempty"`
-	MaxHistoryAge  int                 `json:"max-history-age,omitempty"`
-	AllowAnonymous bool                `json:"allow-anonymous,omitempty"`
-	AllowRecording bool                `json:"allow-recording,omitempty"`
-	AllowSubgroups bool                `json:"allow-subgroups,omitempty"`
-	Op             []ClientCredentials `json:"op,omitempty"`
-	Presenter      []ClientCredentials `json:"presenter,omitempty"`
-	Other          []ClientCredentials `json:"other,omitempty"`
-	Codecs         []string            `json:"codecs,omitempty"`
+	fileName           string              `json:"-"`
+	loadTime           time.Time           `json:"-"`
+	modTime            time.Time           `json:"-"`
+	fileSize           int64               `json:"-"`
+	Description        string              `json:"description,omitempty"`
+	Redirect           string              `json:"redirect,omitempty"`
+	Public             bool                `json:"public,omitempty"`
+	MaxClients         int                 `json:"max-clients,omitempty"`
+	MaxRecordings      int                 `json:"max-recordings,omitempty"`
+	MaxHistoryAge      int                 `json:"max-history-age,omitempty"`
+	AllowAnonymous     bool                `json:"allow-anonymous,omitempty"`
+	AllowRecording     bool                `json:"allow-recording,omitempty"`
+	RecordAudioOnly    bool                `json:"record-audio-only,omitempty"`
+	SilentRecording    bool                `json:"silent-recording,omitempty"`
+	RecordChat         bool                `json:"record-chat,omitempty"`
+	RecordDataChannels bool                `json:"record-data-channels,omitempty"`
+	RecordingQuota     int64               `json:"recording-quota,omitempty"`
+	RecordingDirectory string              `json:"recording-directory,omitempty"`
+	AllowSubgroups     bool                `json:"allow-subgroups,omitempty"`
+	Op                 []ClientCredentials `json:"op,omitempty"`
+	Presenter          []ClientCredentials `json:"presenter,omitempty"`
+	Other              []ClientCredentials `json:"other,omitempty"`
+	Codecs             []string            `json:"codecs,omitempty"`
+	ICEServers         []ICEServer         `json:"ice-servers,omitempty"`
+	ReplaceICEServers  bool                `json:"replace-ice-servers,omitempty"`
+	RelayOnlyAnonymous bool                `json:"relay-only-anonymous,omitempty"`
 }
 
 const DefaultMaxHistoryAge = 4 * time.Hour
@@ -751,6 +928,21 @@ func GetDescription(name string) (*description, error) {
 		}
 		desc.Public = false
 		desc.Description = ""
+		if desc.RecordingDirectory != "" {
+			// the recordings of a subgroup are stored below
+			// those of its parent
+			rel, err := filepath.Rel(Directory, fileName)
+			if err != nil {
+				return nil, err
+			}
+			parent := strings.TrimSuffix(filepath.ToSlash(rel), ".json")
+			desc.RecordingDirectory = path.Join(
+				desc.RecordingDirectory,
+				strings.TrimPrefix(
+					path.Clean("/"+name), "/"+parent+"/",
+				),
+			)
+		}
 	}
 
 	desc.fileName = fileName
@@ -2,7 +2,11 @@ package group
 
 import (
 	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"testing"
 	"time"
 )
@@ -56,3 +60,80 @@ func TestDescriptionJSON(t *testing.T) {
 		t.Errorf("Got %v, expected %v", dddd, dd)
 	}
 }
+
+func TestSubgroupRecordingDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galene-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := Directory
+	Directory = dir
+	defer func() {
+		Directory = saved
+	}()
+
+	err = ioutil.WriteFile(filepath.Join(dir, "parent.json"), []byte(`{
+    "allow-subgroups": true,
+    "recording-directory": "/secure/parent"
+}`), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	tests := map[string]string{
+		"parent":     "/secure/parent",
+		"parent/a":   "/secure/parent/a",
+		"parent/a/b": "/secure/parent/a/b",
+	}
+	for name, expected := range tests {
+		desc, err := GetDescription(name)
+		if err != nil {
+			t.Errorf("GetDescription(%q): %v", name, err)
+			continue
+		}
+		if desc.RecordingDirectory != expected {
+			t.Errorf("%q: got %q, expected %q",
+				name, desc.RecordingDirectory, expected)
+		}
+	}
+}
+
+func TestGetDescriptionNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galene-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := Directory
+	Directory = dir
+	defer func() {
+		Directory = saved
+	}()
+
+	err = os.MkdirAll(filepath.Join(dir, "a"), 0700)
+	if err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	for _, name := range []string{"a.json", "a/b.json", "a/c.txt"} {
+		err := ioutil.WriteFile(
+			filepath.Join(dir, filepath.FromSlash(name)),
+			[]byte("{}"), 0600,
+		)
+		if err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	names, err := GetDescriptionNames()
+	if err != nil {
+		t.Fatalf("GetDescriptionNames: %v", err)
+	}
+	sort.Strings(names)
+	expected := []string{"a", "a/b"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Got %v, expected %v", names, expected)
+	}
+}
@@ -2,11 +2,22 @@ package group
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/pion/webrtc/v3"
 )
 
@@ -23,68 +34,806 @@ type RTCConfiguration struct {
 }
 
 var ICEFilename string
+
+// ICERelayOnly is a shortcut for an ICECandidates that allows relay
+// candidates only.
 var ICERelayOnly bool
 
+// ICECandidatePolicy determines the types of ICE candidates that are
+// used, which is finer-grained than the transport policy of WebRTC.
+// Relay candidates are always used.
+type ICECandidatePolicy struct {
+	// host candidates, which are only useful on a local network
+	Host bool
+	// server and peer reflexive candidates, which reveal the public
+	// addresses of the peers
+	Srflx bool
+}
+
+// ICECandidates is the global candidate policy.
+var ICECandidates = ICECandidatePolicy{Host: true, Srflx: true}
+
+// ParseICECandidatePolicy parses a comma-separated list of the candidate
+// types "host", "srflx" and "relay", such as "host,relay".
+func ParseICECandidatePolicy(s string) (ICECandidatePolicy, error) {
+	var p ICECandidatePolicy
+	for _, t := range strings.Split(s, ",") {
+		switch strings.TrimSpace(t) {
+		case "host":
+			p.Host = true
+		case "srflx":
+			p.Srflx = true
+		case "relay":
+		default:
+			return ICECandidatePolicy{},
+				errors.New("unknown candidate type " + t)
+		}
+	}
+	return p, nil
+}
+
+// iceCandidatePolicy returns the global candidate policy, taking
+// ICERelayOnly into account.
+func iceCandidatePolicy() ICECandidatePolicy {
+	if ICERelayOnly {
+		return ICECandidatePolicy{}
+	}
+	return ICECandidates
+}
+
+// transportPolicy returns the WebRTC transport policy closest to p; it
+// is "relay" if only relay candidates are allowed, and empty otherwise,
+// in which case other candidates must be filtered by AllowICECandidate.
+func (p ICECandidatePolicy) transportPolicy() string {
+	if !p.Host && !p.Srflx {
+		return "relay"
+	}
+	return ""
+}
+
+// candidateType returns the type of the ICE candidate described by the
+// SDP attribute s, or the empty string if it cannot be determined.
+func candidateType(s string) string {
+	fields := strings.Fields(s)
+	for i := 0; i < len(fields)-1; i++ {
+		if fields[i] == "typ" {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
+
+// AllowICECandidate returns true if the ICE candidate described by the
+// SDP attribute candidate may be used by a connection with the given
+// transport policy, as returned by ICEConfiguration.  The empty
+// candidate, which marks the end of candidates, is always allowed.
+func AllowICECandidate(policy string, candidate string) bool {
+	if candidate == "" {
+		return true
+	}
+	typ := candidateType(candidate)
+	if policy == "relay" {
+		return typ == "relay"
+	}
+	p := iceCandidatePolicy()
+	switch typ {
+	case "host":
+		return p.Host
+	case "srflx", "prflx":
+		return p.Srflx
+	default:
+		return true
+	}
+}
+
+// ICEMaxServers is the maximum number of ICE servers loaded from
+// ICEFilename, 0 for no limit.
+var ICEMaxServers int
+
+// ICEFilePrecedence, if true, causes the servers loaded from ICEFilename
+// to take precedence over the servers of a group with the same URLs.
+// By default, the group's servers take precedence.
+var ICEFilePrecedence bool
+
+// ICEFallback is the list of ICE servers used when no ICE configuration
+// is available at all.
+var ICEFallback = []ICEServer{
+	{URLs: []string{"stun:stun.l.google.com:19302"}},
+}
+
 type iceConf struct {
-	conf      RTCConfiguration
-	timestamp time.Time
+	conf        RTCConfiguration
+	timestamp   time.Time
+	lastSuccess time.Time
+	failures    int
+	fallback    bool
+	fileName    string
+	fileSize    int64
+	modTime     time.Time
 }
 
 var iceConfiguration atomic.Value
 
-func updateICEConfiguration() *iceConf {
-	now := time.Now()
-	var conf RTCConfiguration
+// iceUpdating is non-zero while an asynchronous update is in progress.
+var iceUpdating int32
+
+// iceLoadTimeout is the time we are willing to wait for the very first
+// load of the ICE configuration before using a fallback.
+var iceLoadTimeout = 2 * time.Second
+
+// iceBackoff is the schedule for retrying after a failure to load the
+// ICE configuration.  The last value is used once the schedule is
+// exhausted.
+var iceBackoff = []time.Duration{
+	10 * time.Second, 30 * time.Second, 2 * time.Minute,
+}
+
+func loadICEConfiguration(filename string) ([]ICEServer, os.FileInfo, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
 
-	if ICEFilename != "" {
-		file, err := os.Open(ICEFilename)
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	// comments are allowed, so that servers can be documented
+	var servers []ICEServer
+	stripped, err := stripJSONComments(data)
+	if err == nil {
+		err = json.Unmarshal(stripped, &servers)
+	}
+	if err != nil {
+		return nil, nil, jsonError(filename, data, err)
+	}
+	n := validateICEServers(servers)
+	return selectICEServers(servers[:n], ICEMaxServers), fi, nil
+}
+
+// commentError is returned by stripJSONComments when a comment is not
+// terminated.
+type commentError struct {
+	offset int64
+}
+
+func (err commentError) Error() string {
+	return "unterminated comment"
+}
+
+// stripJSONComments replaces the comments in data, which may be either
+// "//" comments that extend to the end of the line or "/* */" comments,
+// with spaces, so that the offsets in the result are those in data.
+func stripJSONComments(data []byte) ([]byte, error) {
+	result := make([]byte, len(data))
+	copy(result, data)
+	inString := false
+	for i := 0; i < len(result); i++ {
+		c := result[i]
+		if inString {
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+		if c == '"' {
+			inString = true
+			continue
+		}
+		if c != '/' || i+1 >= len(result) {
+			continue
+		}
+		switch result[i+1] {
+		case '/':
+			for i < len(result) && result[i] != '\n' {
+				result[i] = ' '
+				i++
+			}
+		case '*':
+			start := i
+			for {
+				if i+1 >= len(result) {
+					return nil, commentError{int64(start)}
+				}
+				if result[i] == '*' && result[i+1] == '/' {
+					break
+				}
+				if result[i] != '\n' {
+					result[i] = ' '
+				}
+				i++
+			}
+			result[i] = ' '
+			result[i+1] = ' '
+			i++
+		}
+	}
+	return result, nil
+}
+
+// jsonError adds the line number at which err, which was returned when
+// decoding data read from filename, occurred.
+func jsonError(filename string, data []byte, err error) error {
+	var offset int64
+	switch e := err.(type) {
+	case commentError:
+		offset = e.offset
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+	default:
+		return err
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	line := 1 + strings.Count(string(data[:offset]), "\n")
+	return fmt.Errorf("%v:%v: %w", filename, line, err)
+}
+
+// iceFileChanged returns true if filename may have changed since conf
+// was loaded from it.
+func iceFileChanged(filename string, conf *iceConf) bool {
+	if filename != conf.fileName {
+		return true
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return true
+	}
+	return fi.Size() != conf.fileSize || !fi.ModTime().Equal(conf.modTime)
+}
+
+// checkICEURL checks that u is a STUN or TURN URL, such as
+// "turns:turn.example.org:443?transport=tcp".  The port is optional, and
+// defaults to 3478 for stun and turn and 5349 for stuns, except in turns
+// URLs, since TURN over TLS usually runs on port 443 and a wrong default
+// fails silently.
+func checkICEURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	switch parsed.Scheme {
+	case "stun", "stuns":
+		if parsed.RawQuery != "" {
+			return errors.New("unexpected query in STUN URL")
+		}
+	case "turn", "turns":
+		query, err := url.ParseQuery(parsed.RawQuery)
+		if err != nil {
+			return err
+		}
+		for k, v := range query {
+			if k != "transport" {
+				return errors.New("unknown parameter " + k)
+			}
+			if len(v) != 1 || (v[0] != "udp" && v[0] != "tcp") {
+				return errors.New("bad transport")
+			}
+		}
+	case "":
+		return errors.New("missing scheme")
+	default:
+		return errors.New("unknown scheme " + parsed.Scheme)
+	}
+
+	// "stun://host" parses with an empty Opaque
+	host := parsed.Opaque
+	h, port, err := net.SplitHostPort(host)
+	if err == nil {
+		host = h
+		_, err := strconv.ParseUint(port, 10, 16)
 		if err != nil {
-			log.Printf("Open %v: %v", ICEFilename, err)
-		} else {
-			defer file.Close()
-			d := json.NewDecoder(file)
-			err = d.Decode(&conf.ICEServers)
+			return errors.New("bad port " + port)
+		}
+	}
+	if host == "" {
+		return errors.New("missing host")
+	}
+	if port == "" && parsed.Scheme == "turns" {
+		return errors.New("missing port in TURNS URL")
+	}
+	return nil
+}
+
+// validateICEServers removes invalid URLs from servers, and moves the
+// servers that still have URLs to the front.  It logs the entries that
+// it drops, and returns the number of servers accepted.
+func validateICEServers(servers []ICEServer) int {
+	n := 0
+	for _, s := range servers {
+		var urls []string
+		for _, u := range s.URLs {
+			err := checkICEURL(u)
 			if err != nil {
-				log.Printf("Get ICE configuration: %v", err)
+				log.Printf("ICE server %v: %v, ignored", u, err)
+				continue
 			}
+			urls = append(urls, u)
 		}
+		if len(urls) == 0 {
+			log.Printf("ICE server with no valid URLs ignored")
+			continue
+		}
+		s.URLs = urls
+		servers[n] = s
+		n++
 	}
+	return n
+}
 
-	if ICERelayOnly {
-		conf.ICETransportPolicy = "relay"
+// iceServerKind returns 0 if s has a TURNS URL, 1 if it has a TURN URL,
+// and 2 otherwise, together with the hostname of its preferred URL.
+func iceServerKind(s ICEServer) (int, string) {
+	kind, host := 3, ""
+	for _, u := range s.URLs {
+		k := 2
+		lower := strings.ToLower(u)
+		if strings.HasPrefix(lower, "turns:") {
+			k = 0
+		} else if strings.HasPrefix(lower, "turn:") {
+			k = 1
+		}
+		if k < kind {
+			kind, host = k, iceURLHost(u)
+		}
 	}
+	return kind, host
+}
+
+// iceURLHost returns the hostname of a STUN or TURN URL.
+func iceURLHost(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	host := parsed.Opaque
+	h, _, err := net.SplitHostPort(host)
+	if err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// selectICEServers removes the servers with the same URLs as an earlier
+// server and, if max is positive, keeps at most max servers.  Servers
+// with TURNS URLs are preferred, then servers with TURN URLs, then STUN
+// servers; among servers of the same kind, a server whose hostname was
+// not yet selected is preferred, and otherwise the earlier server.  The
+// selected servers keep their order.
+func selectICEServers(servers []ICEServer, max int) []ICEServer {
+	var unique []ICEServer
+outer:
+	for _, s := range servers {
+		for _, u := range unique {
+			if sameURLs(s.URLs, u.URLs) {
+				continue outer
+			}
+		}
+		unique = append(unique, s)
+	}
+	if max <= 0 || len(unique) <= max {
+		return unique
+	}
+
+	type candidate struct {
+		index, kind, repeat int
+	}
+	candidates := make([]candidate, len(unique))
+	seen := make(map[string]int)
+	for i, s := range unique {
+		kind, host := iceServerKind(s)
+		key := strconv.Itoa(kind) + " " + host
+		candidates[i] = candidate{i, kind, seen[key]}
+		seen[key]++
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].kind != candidates[j].kind {
+			return candidates[i].kind < candidates[j].kind
+		}
+		return candidates[i].repeat < candidates[j].repeat
+	})
+	candidates = candidates[:max]
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].index < candidates[j].index
+	})
+
+	result := make([]ICEServer, 0, max)
+	for _, c := range candidates {
+		result = append(result, unique[c.index])
+	}
+	return result
+}
+
+// updateICEConfiguration reloads the ICE configuration.  Unless force is
+// set, the file is only parsed again if its size or modification time
+// changed.
+func updateICEConfiguration(force bool) *iceConf {
+	now := time.Now()
+	old, _ := iceConfiguration.Load().(*iceConf)
 
 	iceConf := iceConf{
-		conf:      conf,
-		timestamp: now,
+		timestamp:   now,
+		lastSuccess: now,
+	}
+
+	if ICEFilename != "" && !force && old != nil && old.failures == 0 &&
+		!iceFileChanged(ICEFilename, old) {
+		iceConf.conf.ICEServers = old.conf.ICEServers
+		iceConf.fileName = old.fileName
+		iceConf.fileSize = old.fileSize
+		iceConf.modTime = old.modTime
+	} else if ICEFilename != "" {
+		servers, fi, err := loadICEConfiguration(ICEFilename)
+		if err == nil {
+			iceConf.fileName = ICEFilename
+			iceConf.fileSize = fi.Size()
+			iceConf.modTime = fi.ModTime()
+		} else if os.IsNotExist(err) {
+			iceConf.fallback = true
+		} else if err != nil {
+			log.Printf("Get ICE configuration: %v", err)
+			if old != nil && !old.fallback {
+				// keep serving the last good configuration
+				servers = old.conf.ICEServers
+				iceConf.lastSuccess = old.lastSuccess
+			} else {
+				iceConf.lastSuccess = time.Time{}
+				iceConf.fallback = true
+			}
+			if old != nil {
+				iceConf.failures = old.failures
+			}
+			iceConf.failures++
+		}
+		iceConf.conf.ICEServers = servers
+	} else {
+		iceConf.fallback = true
 	}
+
+	if iceConf.fallback {
+		iceConf.conf.ICEServers = ICEFallback
+		if old == nil || !old.fallback {
+			log.Printf("No ICE configuration, using %v",
+				fallbackDescription())
+		}
+	}
+
+	iceConf.conf.ICETransportPolicy = iceCandidatePolicy().transportPolicy()
+
 	iceConfiguration.Store(&iceConf)
 	return &iceConf
 }
 
+func fallbackDescription() string {
+	if len(ICEFallback) == 0 {
+		return "no ICE servers"
+	}
+	return "fallback ICE servers"
+}
+
+// refreshInterval returns the time after which conf should be reloaded.
+func (conf *iceConf) refreshInterval() time.Duration {
+	if conf.failures == 0 {
+		return 2 * time.Minute
+	}
+	i := conf.failures - 1
+	if i >= len(iceBackoff) {
+		i = len(iceBackoff) - 1
+	}
+	return iceBackoff[i]
+}
+
+// ICEStats contains statistics about the ICE configuration.  A non-zero
+// number of failures means that the configuration returned by
+// ICEConfiguration may be stale.
+type ICEStats struct {
+	LastLoad    time.Time
+	LastSuccess time.Time
+	NextRefresh time.Time
+	Failures    int
+	Servers     int
+	Fallback    bool
+}
+
+// GetICEStats returns statistics about the current ICE configuration.
+func GetICEStats() ICEStats {
+	conf, ok := iceConfiguration.Load().(*iceConf)
+	if !ok {
+		return ICEStats{}
+	}
+	return ICEStats{
+		LastLoad:    conf.timestamp,
+		LastSuccess: conf.lastSuccess,
+		NextRefresh: conf.timestamp.Add(conf.refreshInterval()),
+		Failures:    conf.failures,
+		Servers:     len(conf.conf.ICEServers),
+		Fallback:    conf.fallback,
+	}
+}
+
+// watchICEConfiguration reloads the ICE configuration whenever filename
+// changes.  We watch the directory rather than the file itself, so that
+// we notice when an editor replaces the file by renaming a new one.
+func watchICEConfiguration(filename string) (io.Closer, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	err = watcher.Add(filepath.Dir(filename))
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	go func() {
+		for {
+			select {
+			case e, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(e.Name) != filepath.Clean(filename) {
+					continue
+				}
+				if (e.Op & (fsnotify.Create | fsnotify.Write |
+					fsnotify.Rename | fsnotify.Remove)) != 0 {
+					updateICEConfiguration(true)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Watch %v: %v", filename, err)
+			}
+		}
+	}()
+	return watcher, nil
+}
+
+// WatchICEConfiguration causes the ICE configuration to be reloaded as
+// soon as ICEFilename changes.  If the file cannot be watched, it is only
+// reloaded periodically.
+func WatchICEConfiguration() {
+	if ICEFilename == "" {
+		return
+	}
+	_, err := watchICEConfiguration(ICEFilename)
+	if err != nil {
+		log.Printf("Watch %v: %v, reloading periodically",
+			ICEFilename, err)
+	}
+}
+
+// ReloadICEConfiguration reloads the ICE configuration immediately, even
+// if the file appears not to have changed.
+func ReloadICEConfiguration() {
+	conf := updateICEConfiguration(true)
+	log.Printf("Reloaded ICE configuration, %v servers",
+		len(conf.conf.ICEServers))
+}
+
+// firstICEConfiguration loads the ICE configuration when none is
+// available yet.  If this takes too long, it returns the fallback
+// configuration, and the load continues in the background.
+func firstICEConfiguration() *iceConf {
+	done := make(chan *iceConf, 1)
+	go func() {
+		done <- updateICEConfiguration(false)
+	}()
+
+	timer := time.NewTimer(iceLoadTimeout)
+	defer timer.Stop()
+	select {
+	case conf := <-done:
+		return conf
+	case <-timer.C:
+		log.Printf("Timeout loading ICE configuration, using %v",
+			fallbackDescription())
+		conf := iceConf{fallback: true}
+		conf.conf.ICEServers = ICEFallback
+		conf.conf.ICETransportPolicy =
+			iceCandidatePolicy().transportPolicy()
+		return &conf
+	}
+}
+
+// ICEConfiguration returns the global ICE configuration.  It never
+// waits for a refresh: if the configuration is out of date, it is
+// returned anyway and reloaded in the background.
 func ICEConfiguration() *RTCConfiguration {
 	conf, ok := iceConfiguration.Load().(*iceConf)
-	if !ok || time.Since(conf.timestamp) > 5*time.Minute {
-		conf = updateICEConfiguration()
-	} else if time.Since(conf.timestamp) > 2*time.Minute {
-		go updateICEConfiguration()
+	if !ok {
+		return &firstICEConfiguration().conf
+	}
+
+	if time.Since(conf.timestamp) > conf.refreshInterval() &&
+		atomic.CompareAndSwapInt32(&iceUpdating, 0, 1) {
+		go func() {
+			defer atomic.StoreInt32(&iceUpdating, 0)
+			updateICEConfiguration(false)
+		}()
 	}
 
 	return &conf.conf
 }
 
+// sameURLs returns true if a and b contain the same URLs, in any order.
+func sameURLs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	aa := append([]string(nil), a...)
+	bb := append([]string(nil), b...)
+	sort.Strings(aa)
+	sort.Strings(bb)
+	for i := range aa {
+		if aa[i] != bb[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ICEConfiguration returns the ICE configuration for the group.  This is
+// the global configuration with the group's own servers added or, if the
+// group sets replace-ice-servers, with its servers replaced.  When both
+// lists have a server with the same URLs, only the group's is kept, or
+// the global one if ICEFilePrecedence is set; the merged list is sorted.
+// If policy is not empty, it overrides the global transport policy; this
+// allows requiring relays for some clients only.
+func (g *Group) ICEConfiguration(policy string) *RTCConfiguration {
+	g.mu.Lock()
+	servers := g.description.ICEServers
+	replace := g.description.ReplaceICEServers
+	g.mu.Unlock()
+
+	return groupICEConfiguration(servers, replace, policy)
+}
+
+// ICEConfiguration returns the ICE configuration for a group described by
+// desc, as above.  This allows getting the configuration of a group that
+// is not running without creating it.
+func (desc *description) ICEConfiguration(policy string) *RTCConfiguration {
+	return groupICEConfiguration(
+		desc.ICEServers, desc.ReplaceICEServers, policy,
+	)
+}
+
+func groupICEConfiguration(servers []ICEServer, replace bool, policy string) *RTCConfiguration {
+	conf := ICEConfiguration()
+
+	if policy == "" {
+		policy = conf.ICETransportPolicy
+	}
+
+	c := RTCConfiguration{
+		ICETransportPolicy: policy,
+	}
+	if len(servers) == 0 && !replace {
+		if policy == conf.ICETransportPolicy && policy != "relay" {
+			return conf
+		}
+		c.ICEServers = conf.ICEServers
+	} else if replace {
+		c.ICEServers = append(c.ICEServers, servers...)
+	} else if ICEFilePrecedence {
+		c.ICEServers = mergeICEServers(conf.ICEServers, servers)
+	} else {
+		c.ICEServers = mergeICEServers(servers, conf.ICEServers)
+	}
+
+	if policy == "relay" {
+		c.ICEServers = relayServers(c.ICEServers)
+	}
+	return &c
+}
+
+// mergeICEServers returns the servers in first, together with those in
+// second that don't have the same URLs as a server in first, sorted by
+// their URLs so that the result doesn't depend on the order of the lists.
+func mergeICEServers(first, second []ICEServer) []ICEServer {
+	result := append([]ICEServer(nil), first...)
+outer:
+	for _, s := range second {
+		for _, f := range first {
+			if sameURLs(s.URLs, f.URLs) {
+				continue outer
+			}
+		}
+		result = append(result, s)
+	}
+
+	key := func(s ICEServer) string {
+		urls := append([]string(nil), s.URLs...)
+		sort.Strings(urls)
+		return strings.Join(urls, " ")
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return key(result[i]) < key(result[j])
+	})
+	return result
+}
+
+// relayServers returns the servers that can act as relays.  STUN URLs are
+// removed, and servers that have only STUN URLs are dropped, since they
+// are useless when the transport policy is relay.
+func relayServers(servers []ICEServer) []ICEServer {
+	var result []ICEServer
+	for _, s := range servers {
+		var urls []string
+		for _, u := range s.URLs {
+			// this matches both turn: and turns:
+			if strings.HasPrefix(strings.ToLower(u), "turn") {
+				urls = append(urls, u)
+			}
+		}
+		if len(urls) == 0 {
+			continue
+		}
+		s.URLs = urls
+		result = append(result, s)
+	}
+	return result
+}
+
+// oauthCredential converts an OAuth credential, as parsed from JSON, to
+// the form expected by pion.  Credentials that are not objects are
+// returned unchanged.
+func oauthCredential(credential interface{}) (interface{}, error) {
+	m, ok := credential.(map[string]interface{})
+	if !ok {
+		return credential, nil
+	}
+	macKey, ok := m["macKey"].(string)
+	if !ok {
+		return nil, errors.New("missing or bad macKey")
+	}
+	accessToken, ok := m["accessToken"].(string)
+	if !ok {
+		return nil, errors.New("missing or bad accessToken")
+	}
+	return webrtc.OAuthCredential{
+		MACKey:      macKey,
+		AccessToken: accessToken,
+	}, nil
+}
+
 func ToConfiguration(conf *RTCConfiguration) webrtc.Configuration {
+	servers := conf.ICEServers
+	if conf.ICETransportPolicy == "relay" {
+		servers = relayServers(servers)
+	}
+
 	var iceServers []webrtc.ICEServer
-	for _, s := range conf.ICEServers {
+	for _, s := range servers {
 		tpe := webrtc.ICECredentialTypePassword
+		credential := s.Credential
 		if s.CredentialType == "oauth" {
 			tpe = webrtc.ICECredentialTypeOauth
+			var err error
+			credential, err = oauthCredential(s.Credential)
+			if err != nil {
+				log.Printf("ICE server %v: %v, ignored",
+					s.URLs, err)
+				continue
+			}
 		}
 		iceServers = append(iceServers,
 			webrtc.ICEServer{
 				URLs:           s.URLs,
 				Username:       s.Username,
-				Credential:     s.Credential,
+				Credential:     credential,
 				CredentialType: tpe,
 			},
 		)
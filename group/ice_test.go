@@ -0,0 +1,659 @@
+package group
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestWatchICEConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galene-ice")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := ICEFilename
+	ICEFilename = filepath.Join(dir, "ice-servers.json")
+	defer func() {
+		ICEFilename = saved
+	}()
+
+	write := func(url string) {
+		// write a new file and rename it, like many editors do
+		tmp := filepath.Join(dir, "ice-servers.json~")
+		err := ioutil.WriteFile(tmp,
+			[]byte(`[{"urls": ["`+url+`"]}]`), 0600,
+		)
+		if err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		err = os.Rename(tmp, ICEFilename)
+		if err != nil {
+			t.Fatalf("Rename: %v", err)
+		}
+	}
+
+	wait := func(url string) {
+		for i := 0; i < 100; i++ {
+			conf, ok := iceConfiguration.Load().(*iceConf)
+			if ok && len(conf.conf.ICEServers) == 1 &&
+				conf.conf.ICEServers[0].URLs[0] == url {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Errorf("Configuration was not reloaded with %v", url)
+	}
+
+	write("stun:stun1.example.org")
+	updateICEConfiguration(true)
+
+	watcher, err := watchICEConfiguration(ICEFilename)
+	if err != nil {
+		t.Skipf("Watch: %v", err)
+	}
+	defer watcher.Close()
+
+	write("stun:stun2.example.org")
+	wait("stun:stun2.example.org")
+
+	write("stun:stun3.example.org")
+	wait("stun:stun3.example.org")
+}
+
+func TestICEConfigurationFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galene-ice")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := ICEFilename
+	ICEFilename = filepath.Join(dir, "ice-servers.json")
+	defer func() {
+		ICEFilename = saved
+	}()
+
+	err = ioutil.WriteFile(ICEFilename,
+		[]byte(`[{"urls": ["stun:stun.example.org"]}]`), 0600,
+	)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	conf := updateICEConfiguration(true)
+	if conf.failures != 0 || len(conf.conf.ICEServers) != 1 {
+		t.Fatalf("Unexpected configuration %v", conf)
+	}
+	success := conf.lastSuccess
+
+	err = ioutil.WriteFile(ICEFilename, []byte(`[{"urls": `), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	for i := 1; i <= 3; i++ {
+		conf = updateICEConfiguration(true)
+		if conf.failures != i {
+			t.Errorf("Expected %v failures, got %v", i, conf.failures)
+		}
+		if len(conf.conf.ICEServers) != 1 ||
+			conf.conf.ICEServers[0].URLs[0] != "stun:stun.example.org" {
+			t.Errorf("Stale configuration was not kept: %v",
+				conf.conf.ICEServers)
+		}
+	}
+	stats := GetICEStats()
+	if stats.Failures != 3 || !stats.LastSuccess.Equal(success) ||
+		!stats.LastLoad.Equal(conf.timestamp) || stats.Servers != 1 ||
+		!stats.NextRefresh.Equal(conf.timestamp.Add(2*time.Minute)) {
+		t.Errorf("Unexpected stats %v", stats)
+	}
+
+	// a missing file is not an error, it causes the fallback to be used
+	err = os.Remove(ICEFilename)
+	if err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	conf = updateICEConfiguration(true)
+	if conf.failures != 0 || !conf.fallback ||
+		len(conf.conf.ICEServers) != len(ICEFallback) {
+		t.Errorf("Unexpected configuration %v", conf)
+	}
+
+	savedFallback := ICEFallback
+	ICEFallback = nil
+	defer func() {
+		ICEFallback = savedFallback
+	}()
+	conf = updateICEConfiguration(true)
+	if conf.failures != 0 || len(conf.conf.ICEServers) != 0 {
+		t.Errorf("Unexpected configuration %v", conf)
+	}
+}
+
+func TestGroupICEConfiguration(t *testing.T) {
+	saved := ICEFilename
+	ICEFilename = ""
+	defer func() {
+		ICEFilename = saved
+	}()
+	global := updateICEConfiguration(true)
+	global.conf.ICEServers = []ICEServer{
+		{URLs: []string{"stun:global.example.org"}},
+	}
+
+	urls := func(conf *RTCConfiguration) []string {
+		var u []string
+		for _, s := range conf.ICEServers {
+			u = append(u, s.URLs...)
+		}
+		return u
+	}
+
+	g := &Group{description: &description{}}
+	u := urls(g.ICEConfiguration(""))
+	if len(u) != 1 || u[0] != "stun:global.example.org" {
+		t.Errorf("Expected global configuration, got %v", u)
+	}
+
+	g.description.ICEServers = []ICEServer{
+		{URLs: []string{"turn:group.example.org"}},
+	}
+	u = urls(g.ICEConfiguration(""))
+	if len(u) != 2 || u[0] != "stun:global.example.org" ||
+		u[1] != "turn:group.example.org" {
+		t.Errorf("Expected overlaid configuration, got %v", u)
+	}
+
+	// a group server with the same URLs as a global one replaces it,
+	// unless ICEFilePrecedence is set
+	g.description.ICEServers = append(g.description.ICEServers,
+		ICEServer{
+			URLs:     []string{"stun:global.example.org"},
+			Username: "group",
+		},
+	)
+	for _, precedence := range []bool{false, true} {
+		ICEFilePrecedence = precedence
+		conf := g.ICEConfiguration("")
+		u = urls(conf)
+		if len(u) != 2 || u[0] != "stun:global.example.org" ||
+			u[1] != "turn:group.example.org" {
+			t.Errorf("Expected deduplicated configuration, got %v",
+				u)
+		} else if (conf.ICEServers[0].Username == "group") ==
+			precedence {
+			t.Errorf("Precedence %v: wrong server kept",
+				precedence)
+		}
+	}
+	ICEFilePrecedence = false
+	g.description.ICEServers = g.description.ICEServers[:1]
+
+	g.description.ReplaceICEServers = true
+	u = urls(g.ICEConfiguration(""))
+	if len(u) != 1 || u[0] != "turn:group.example.org" {
+		t.Errorf("Expected replaced configuration, got %v", u)
+	}
+
+	conf := g.ICEConfiguration("relay")
+	if conf.ICETransportPolicy != "relay" || len(conf.ICEServers) != 1 {
+		t.Errorf("Policy was not overridden: %v", conf)
+	}
+
+	g.description.ICEServers = nil
+	g.description.ReplaceICEServers = false
+	conf = g.ICEConfiguration("relay")
+	if conf.ICETransportPolicy != "relay" {
+		t.Errorf("Policy was not overridden: %v", conf)
+	}
+	// the global server is STUN-only, which is useless with relay
+	if len(conf.ICEServers) != 0 {
+		t.Errorf("STUN server was not filtered: %v", conf)
+	}
+
+	if len(global.conf.ICEServers) != 1 ||
+		global.conf.ICETransportPolicy != "" {
+		t.Errorf("Global configuration was modified")
+	}
+}
+
+func TestCheckICEURL(t *testing.T) {
+	good := []string{
+		"stun:stun.example.org",
+		"stun:stun.example.org:3478",
+		"stuns:stun.example.org:5349",
+		"turn:turn.example.org:443?transport=tcp",
+		"turns:turn.example.org:443?transport=tcp",
+		"turns:turn.example.org:5349?transport=udp",
+		"turn:192.0.2.1:3478",
+		"turn:[2001:db8::1]:3478",
+	}
+	bad := []string{
+		"",
+		"stun.example.org",
+		"stun://stun.example.org",
+		"http:stun.example.org",
+		"turn:",
+		"turn::3478",
+		"turn:turn.example.org:abc",
+		"turn:turn.example.org:99999",
+		"stun:stun.example.org?transport=tcp",
+		"turns:turn.example.org:443?transport=sctp",
+		"turns:turn.example.org:443?transport=tcp&transport=udp",
+		"turn:turn.example.org?proto=tcp",
+		"turns:turn.example.org",
+		"turns:turn.example.org?transport=tcp",
+	}
+
+	for _, u := range good {
+		err := checkICEURL(u)
+		if err != nil {
+			t.Errorf("%v: %v", u, err)
+		}
+	}
+	for _, u := range bad {
+		err := checkICEURL(u)
+		if err == nil {
+			t.Errorf("%v: no error", u)
+		}
+	}
+}
+
+func TestValidateICEServers(t *testing.T) {
+	servers := []ICEServer{
+		{URLs: []string{"stun://bad.example.org"}},
+		{URLs: []string{
+			"turn:turn.example.org", "turn.example.org",
+		}},
+		{},
+		{URLs: []string{"stun:stun.example.org"}},
+	}
+	n := validateICEServers(servers)
+	if n != 2 {
+		t.Fatalf("Expected 2, got %v", n)
+	}
+	if len(servers[0].URLs) != 1 ||
+		servers[0].URLs[0] != "turn:turn.example.org" {
+		t.Errorf("Unexpected first server %v", servers[0])
+	}
+	if len(servers[1].URLs) != 1 ||
+		servers[1].URLs[0] != "stun:stun.example.org" {
+		t.Errorf("Unexpected second server %v", servers[1])
+	}
+}
+
+func TestICEConfigurationUnchanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galene-ice")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := ICEFilename
+	ICEFilename = filepath.Join(dir, "ice-servers.json")
+	defer func() {
+		ICEFilename = saved
+	}()
+
+	err = ioutil.WriteFile(ICEFilename,
+		[]byte(`[{"urls": ["stun:stun.example.org"]}]`), 0600,
+	)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	conf1 := updateICEConfiguration(true)
+	conf2 := updateICEConfiguration(false)
+	if len(conf2.conf.ICEServers) != 1 ||
+		&conf2.conf.ICEServers[0] != &conf1.conf.ICEServers[0] {
+		t.Errorf("Unchanged file was parsed again")
+	}
+	if conf2.timestamp.Before(conf1.timestamp) {
+		t.Errorf("Timestamp was not refreshed")
+	}
+
+	conf3 := updateICEConfiguration(true)
+	if len(conf3.conf.ICEServers) != 1 ||
+		&conf3.conf.ICEServers[0] == &conf1.conf.ICEServers[0] {
+		t.Errorf("File was not parsed again")
+	}
+
+	err = ioutil.WriteFile(ICEFilename,
+		[]byte(`[{"urls": ["stun:stun2.example.org"]}]`), 0600,
+	)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	conf4 := updateICEConfiguration(false)
+	if len(conf4.conf.ICEServers) != 1 ||
+		conf4.conf.ICEServers[0].URLs[0] != "stun:stun2.example.org" {
+		t.Errorf("Changed file was not parsed again")
+	}
+}
+
+func TestICEConfigurationAsync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galene-ice")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := ICEFilename
+	ICEFilename = filepath.Join(dir, "ice-servers.json")
+	defer func() {
+		ICEFilename = saved
+	}()
+
+	err = ioutil.WriteFile(ICEFilename,
+		[]byte(`[{"urls": ["stun:stun.example.org"]}]`), 0600,
+	)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	old := updateICEConfiguration(true)
+	old.timestamp = time.Now().Add(-time.Hour)
+
+	// a stale configuration is returned immediately
+	conf := ICEConfiguration()
+	if conf != &old.conf {
+		t.Errorf("Stale configuration was not returned")
+	}
+
+	for i := 0; i < 100; i++ {
+		c, _ := iceConfiguration.Load().(*iceConf)
+		if c != old {
+			if len(c.conf.ICEServers) != 1 {
+				t.Errorf("Unexpected configuration %v", c.conf)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Configuration was not refreshed")
+}
+
+func TestOAuthCredential(t *testing.T) {
+	var servers []ICEServer
+	err := json.Unmarshal([]byte(`[
+            {"urls": ["turn:a.example.org"],
+             "username": "u", "credential": "password"},
+            {"urls": ["turn:b.example.org"],
+             "username": "u", "credentialType": "oauth",
+             "credential": {"macKey": "key", "accessToken": "token"}},
+            {"urls": ["turn:c.example.org"],
+             "username": "u", "credentialType": "oauth",
+             "credential": {"macKey": "key"}}
+        ]`), &servers)
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	conf := ToConfiguration(&RTCConfiguration{ICEServers: servers})
+	if len(conf.ICEServers) != 2 {
+		t.Fatalf("Expected 2 servers, got %v", len(conf.ICEServers))
+	}
+
+	s := conf.ICEServers[0]
+	if s.CredentialType != webrtc.ICECredentialTypePassword ||
+		s.Credential != "password" {
+		t.Errorf("Unexpected password server %v", s)
+	}
+
+	s = conf.ICEServers[1]
+	expected := webrtc.OAuthCredential{MACKey: "key", AccessToken: "token"}
+	if s.CredentialType != webrtc.ICECredentialTypeOauth ||
+		s.Credential != expected {
+		t.Errorf("Unexpected OAuth server %v", s)
+	}
+}
+
+func TestICETransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galene-ice")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "ice-servers.json")
+	err = ioutil.WriteFile(filename, []byte(`[{
+            "urls": [
+                "turn:turn.example.org:443?transport=tcp",
+                "turns:turn.example.org:443?transport=tcp",
+                "turns:turn.example.org:5349"
+            ],
+            "username": "u", "credential": "p"
+        }]`), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	servers, _, err := loadICEConfiguration(filename)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	conf := ToConfiguration(&RTCConfiguration{ICEServers: servers})
+	if len(conf.ICEServers) != 1 {
+		t.Fatalf("Expected 1 server, got %v", len(conf.ICEServers))
+	}
+	urls := conf.ICEServers[0].URLs
+	if len(urls) != 3 ||
+		urls[0] != "turn:turn.example.org:443?transport=tcp" ||
+		urls[1] != "turns:turn.example.org:443?transport=tcp" ||
+		urls[2] != "turns:turn.example.org:5349" {
+		t.Errorf("Unexpected URLs %v", urls)
+	}
+}
+
+func TestRelayServers(t *testing.T) {
+	servers := []ICEServer{
+		{URLs: []string{"stun:stun.example.org"}},
+		{URLs: []string{
+			"stun:a.example.org", "turn:a.example.org",
+			"turns:a.example.org:443?transport=tcp",
+		}},
+		{URLs: []string{"stuns:stun.example.org"}},
+		{URLs: []string{"TURN:b.example.org"}},
+	}
+
+	conf := ToConfiguration(&RTCConfiguration{
+		ICEServers:         servers,
+		ICETransportPolicy: "relay",
+	})
+	if len(conf.ICEServers) != 2 {
+		t.Fatalf("Expected 2 servers, got %v", conf.ICEServers)
+	}
+	urls := conf.ICEServers[0].URLs
+	if len(urls) != 2 || urls[0] != "turn:a.example.org" ||
+		urls[1] != "turns:a.example.org:443?transport=tcp" {
+		t.Errorf("Unexpected URLs %v", urls)
+	}
+	if len(servers[1].URLs) != 3 {
+		t.Errorf("Original servers were modified")
+	}
+
+	conf = ToConfiguration(&RTCConfiguration{ICEServers: servers})
+	if len(conf.ICEServers) != 4 {
+		t.Errorf("Expected 4 servers, got %v", conf.ICEServers)
+	}
+}
+
+func TestReloadICEConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galene-ice")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := ICEFilename
+	ICEFilename = filepath.Join(dir, "ice-servers.json")
+	defer func() {
+		ICEFilename = saved
+	}()
+
+	write := func(url string) {
+		err := ioutil.WriteFile(ICEFilename,
+			[]byte(`[{"urls": ["`+url+`"]}]`), 0600,
+		)
+		if err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	write("stun:stun1.example.org")
+	conf := updateICEConfiguration(true)
+
+	// same size and modification time, so the change goes unnoticed
+	write("stun:stun2.example.org")
+	err = os.Chtimes(ICEFilename, conf.modTime, conf.modTime)
+	if err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+	conf = updateICEConfiguration(false)
+	if conf.conf.ICEServers[0].URLs[0] != "stun:stun1.example.org" {
+		t.Errorf("Expected stun1, got %v", conf.conf.ICEServers)
+	}
+
+	ReloadICEConfiguration()
+	conf = iceConfiguration.Load().(*iceConf)
+	if conf.conf.ICEServers[0].URLs[0] != "stun:stun2.example.org" {
+		t.Errorf("Expected stun2, got %v", conf.conf.ICEServers)
+	}
+}
+
+func TestICECandidatePolicy(t *testing.T) {
+	p, err := ParseICECandidatePolicy("host, relay")
+	if err != nil || !p.Host || p.Srflx {
+		t.Errorf("Parse: got %v %v", p, err)
+	}
+	if p.transportPolicy() != "" {
+		t.Errorf("Expected policy all, got %v", p.transportPolicy())
+	}
+	_, err = ParseICECandidatePolicy("host,mdns")
+	if err == nil {
+		t.Errorf("Parsed an unknown type")
+	}
+
+	saved := ICECandidates
+	defer func() {
+		ICECandidates = saved
+	}()
+	ICECandidates = p
+
+	host := "candidate:1 1 udp 2130706431 192.168.1.2 40000 typ host"
+	srflx := "candidate:2 1 udp 1694498815 203.0.113.5 40000 typ srflx " +
+		"raddr 192.168.1.2 rport 40000"
+	relay := "candidate:3 1 udp 16777215 198.51.100.7 50000 typ relay " +
+		"raddr 203.0.113.5 rport 40000"
+	tests := []struct {
+		policy, candidate string
+		allowed           bool
+	}{
+		{"", host, true},
+		{"", srflx, false},
+		{"", relay, true},
+		{"", "", true},
+		{"relay", host, false},
+		{"relay", relay, true},
+	}
+	for _, test := range tests {
+		allowed := AllowICECandidate(test.policy, test.candidate)
+		if allowed != test.allowed {
+			t.Errorf("%v %v: got %v, expected %v",
+				test.policy, test.candidate, allowed, test.allowed)
+		}
+	}
+
+	ICERelayOnly = true
+	defer func() {
+		ICERelayOnly = false
+	}()
+	if AllowICECandidate("", host) {
+		t.Errorf("Host candidate allowed with ICERelayOnly")
+	}
+	if iceCandidatePolicy().transportPolicy() != "relay" {
+		t.Errorf("Expected relay policy")
+	}
+}
+
+func TestSelectICEServers(t *testing.T) {
+	servers := []ICEServer{
+		{URLs: []string{"stun:a.example.org"}},
+		{URLs: []string{"turn:a.example.org?transport=udp"}},
+		{URLs: []string{"turn:a.example.org:3478?transport=tcp"}},
+		{URLs: []string{"turn:b.example.org"}},
+		{URLs: []string{"turns:a.example.org:443"}},
+		{URLs: []string{"stun:a.example.org"}},
+	}
+
+	selected := selectICEServers(servers, 0)
+	if len(selected) != 5 {
+		t.Errorf("Expected 5 unique servers, got %v", selected)
+	}
+
+	selected = selectICEServers(servers, 3)
+	var urls []string
+	for _, s := range selected {
+		urls = append(urls, s.URLs[0])
+	}
+	expected := []string{
+		"turn:a.example.org?transport=udp",
+		"turn:b.example.org",
+		"turns:a.example.org:443",
+	}
+	if !sameURLs(urls, expected) || urls[0] != expected[0] {
+		t.Errorf("Got %v, expected %v", urls, expected)
+	}
+}
+
+func TestICEComments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galene-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "ice-servers.json")
+
+	err = ioutil.WriteFile(filename, []byte(`[
+    // our own server
+    {"urls": ["turn:turn.example.org"], /* shared secret */
+     "username": "user", "credential": "a//b/*c*/"}
+]`), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	servers, _, err := loadICEConfiguration(filename)
+	if err != nil {
+		t.Fatalf("loadICEConfiguration: %v", err)
+	}
+	if len(servers) != 1 || servers[0].Credential != "a//b/*c*/" {
+		t.Errorf("Got %v", servers)
+	}
+
+	err = ioutil.WriteFile(filename, []byte(`[
+    // our own server
+    {"urls": ["turn:turn.example.org"],}
+]`), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	_, _, err = loadICEConfiguration(filename)
+	if err == nil || !strings.Contains(err.Error(), "ice-servers.json:3:") {
+		t.Errorf("Expected an error on line 3, got %v", err)
+	}
+
+	err = ioutil.WriteFile(filename, []byte("[\n/* unterminated\n]"), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	_, _, err = loadICEConfiguration(filename)
+	if err == nil || !strings.Contains(err.Error(), "ice-servers.json:2:") {
+		t.Errorf("Expected an error on line 2, got %v", err)
+	}
+}
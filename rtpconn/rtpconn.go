@@ -136,10 +136,21 @@ type rtpDownConnection struct {
 	iceCandidates  []*webrtc.ICECandidateInit
 }
 
+// iceTransportPolicy returns the ICE transport policy to use for c, or
+// the empty string if the global policy applies.
+func iceTransportPolicy(c group.Client) string {
+	if c.Username() == "" && c.Group().RelayOnlyAnonymous() {
+		return "relay"
+	}
+	return ""
+}
+
 func newDownConn(c group.Client, id string, remote conn.Up) (*rtpDownConnection, error) {
 	api := group.APIFromCodecs(remote.Codecs())
 	pc, err := api.NewPeerConnection(
-		group.ToConfiguration(group.ICEConfiguration()),
+		group.ToConfiguration(
+			c.Group().ICEConfiguration(iceTransportPolicy(c)),
+		),
 	)
 	if err != nil {
 		return nil, err
@@ -223,6 +234,9 @@ type rtpUpTrack struct {
 	atomics *upTrackAtomics
 	cname   atomic.Value
 
+	// the ids of the negotiated header extensions, indexed by URI
+	extensions map[string]uint8
+
 	localCh    chan localTrackAction
 	readerDone chan struct{}
 
@@ -294,6 +308,15 @@ func (up *rtpUpTrack) Label() string {
 	return up.label
 }
 
+func (up *rtpUpTrack) HeaderExtensionID(uri string) uint8 {
+	return up.extensions[uri]
+}
+
+func (up *rtpUpTrack) Bitrate() uint64 {
+	rate, _ := up.rate.Estimate()
+	return uint64(rate) * 8
+}
+
 func (up *rtpUpTrack) Codec() webrtc.RTPCodecCapability {
 	return up.track.Codec().RTPCodecCapability
 }
@@ -310,6 +333,8 @@ func (up *rtpUpTrack) hasRtcpFb(tpe, parameter string) bool {
 type rtpUpConnection struct {
 	id            string
 	label         string
+	userId        string
+	username      string
 	pc            *webrtc.PeerConnection
 	labels        map[string]string
 	iceCandidates []*webrtc.ICECandidateInit
@@ -336,6 +361,10 @@ func (up *rtpUpConnection) Label() string {
 	return up.label
 }
 
+func (up *rtpUpConnection) User() (string, string) {
+	return up.userId, up.username
+}
+
 func (up *rtpUpConnection) Codecs() []webrtc.RTPCodecCapability {
 	up.mu.Lock()
 	defer up.mu.Unlock()
@@ -460,7 +489,9 @@ func pushConn(up *rtpUpConnection, g *group.Group, cs []group.Client) {
 
 func newUpConn(c group.Client, id string, labels map[string]string) (*rtpUpConnection, error) {
 	pc, err := c.Group().API().NewPeerConnection(
-		group.ToConfiguration(group.ICEConfiguration()),
+		group.ToConfiguration(
+			c.Group().ICEConfiguration(iceTransportPolicy(c)),
+		),
 	)
 	if err != nil {
 		return nil, err
@@ -486,7 +517,13 @@ func newUpConn(c group.Client, id string, labels map[string]string) (*rtpUpConne
 		return nil, err
 	}
 
-	up := &rtpUpConnection{id: id, pc: pc, labels: labels}
+	up := &rtpUpConnection{
+		id:       id,
+		userId:   c.Id(),
+		username: c.Username(),
+		pc:       pc,
+		labels:   labels,
+	}
 
 	pc.OnTrack(func(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
 		up.mu.Lock()
@@ -508,6 +545,11 @@ func newUpConn(c group.Client, id string, labels map[string]string) (*rtpUpConne
 			}
 		}
 
+		extensions := make(map[string]uint8)
+		for _, e := range receiver.GetParameters().HeaderExtensions {
+			extensions[e.URI] = uint8(e.ID)
+		}
+
 		track := &rtpUpTrack{
 			track:      remote,
 			label:      label,
@@ -515,6 +557,7 @@ func newUpConn(c group.Client, id string, labels map[string]string) (*rtpUpConne
 			rate:       estimator.New(time.Second),
 			jitter:     jitter.New(remote.Codec().ClockRate),
 			atomics:    &upTrackAtomics{},
+			extensions: extensions,
 			localCh:    make(chan localTrackAction, 2),
 			readerDone: make(chan struct{}),
 		}
@@ -530,6 +573,18 @@ func newUpConn(c group.Client, id string, labels map[string]string) (*rtpUpConne
 		pushConn(up, c.Group(), c.Group().GetClients(c))
 	})
 
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		label := dc.Label()
+		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+			for _, l := range up.getLocal() {
+				d, ok := l.(conn.DataDown)
+				if ok {
+					d.WriteData(label, msg.Data, msg.IsString)
+				}
+			}
+		})
+	})
+
 	pushConn(up, c.Group(), c.Group().GetClients(c))
 	go rtcpUpSender(up)
 
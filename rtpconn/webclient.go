@@ -178,6 +178,7 @@ type clientMessage struct {
 	Labels           map[string]string          `json:"labels,omitempty"`
 	Request          rateMap                    `json:"request,omitempty"`
 	RTCConfiguration *group.RTCConfiguration    `json:"rtcConfiguration,omitempty"`
+	Recording        bool                       `json:"recording,omitempty"`
 }
 
 type closeMessage struct {
@@ -468,6 +469,9 @@ func sendICE(c *webClient, id string, candidate *webrtc.ICECandidate) error {
 		return nil
 	}
 	cand := candidate.ToJSON()
+	if !group.AllowICECandidate(iceTransportPolicy(c), cand.Candidate) {
+		return nil
+	}
 	return c.write(clientMessage{
 		Type:      "ice",
 		Id:        id,
@@ -571,6 +575,9 @@ func gotICE(c *webClient, candidate *webrtc.ICECandidateInit, id string) error {
 	if conn == nil {
 		return errors.New("unknown id in ICE")
 	}
+	if !group.AllowICECandidate(iceTransportPolicy(c), candidate.Candidate) {
+		return nil
+	}
 	return conn.addICECandidate(candidate)
 }
 
@@ -600,11 +607,15 @@ func pushConns(c group.Client, g *group.Group) {
 	for _, cc := range clients {
 		ccc, ok := cc.(*webClient)
 		if ok {
-			ccc.action(pushConnsAction{g, c})
+			ccc.RequestConns(c, g)
 		}
 	}
 }
 
+func (c *webClient) RequestConns(target group.Client, g *group.Group) error {
+	return c.action(pushConnsAction{g, target})
+}
+
 func (c *webClient) isRequested(label string) bool {
 	return c.requested[label] != 0
 }
@@ -738,6 +749,8 @@ type connectionFailedAction struct {
 
 type permissionsChangedAction struct{}
 
+type statusChangedAction struct{}
+
 type kickAction struct {
 	id       string
 	username string
@@ -872,12 +885,14 @@ func clientLoop(c *webClient, ws *websocket.Conn) error {
 					return errors.New("Permissions changed in no group")
 				}
 				perms := c.permissions
+				conf := g.ICEConfiguration(iceTransportPolicy(c))
 				c.write(clientMessage{
 					Type:             "joined",
 					Kind:             "change",
 					Group:            g.Name(),
 					Permissions:      &perms,
-					RTCConfiguration: group.ICEConfiguration(),
+					RTCConfiguration: conf,
+					Recording:        g.IsRecording(),
 				})
 				if !c.permissions.Present {
 					up := getUpConns(c)
@@ -891,6 +906,22 @@ func clientLoop(c *webClient, ws *websocket.Conn) error {
 						}
 					}
 				}
+			case statusChangedAction:
+				g := c.Group()
+				if g != nil {
+					perms := c.permissions
+					conf := g.ICEConfiguration(
+						iceTransportPolicy(c),
+					)
+					c.write(clientMessage{
+						Type:             "joined",
+						Kind:             "change",
+						Group:            g.Name(),
+						Permissions:      &perms,
+						RTCConfiguration: conf,
+						Recording:        g.IsRecording(),
+					})
+				}
 			case kickAction:
 				return group.KickError{
 					a.id, a.username, a.message,
@@ -1079,12 +1110,14 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 		}
 		c.group = g
 		perms := c.permissions
+		conf := g.ICEConfiguration(iceTransportPolicy(c))
 		err = c.write(clientMessage{
 			Type:             "joined",
 			Kind:             "join",
 			Group:            m.Group,
 			Permissions:      &perms,
-			RTCConfiguration: group.ICEConfiguration(),
+			RTCConfiguration: conf,
+			Recording:        g.IsRecording(),
 		})
 		if err != nil {
 			return err
@@ -1206,6 +1239,17 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 				ccc, ok := cc.(*webClient)
 				if ok {
 					ccc.write(mm)
+					continue
+				}
+				cr, ok := cc.(group.ChatReceiver)
+				if ok && m.Type == "chat" {
+					err := cr.PushChat(
+						m.Id, m.Username, tm,
+						m.Kind, m.Value,
+					)
+					if err != nil {
+						log.Printf("PushChat: %v", err)
+					}
 				}
 			}
 		} else {
@@ -1255,30 +1299,15 @@ func handleClientMessage(c *webClient, m clientMessage) error {
 			if !c.permissions.Record {
 				return c.error(group.UserError("not authorised"))
 			}
-			for _, cc := range g.GetClients(c) {
-				_, ok := cc.(*diskwriter.Client)
-				if ok {
-					return c.error(group.UserError("already recording"))
-				}
-			}
-			disk := diskwriter.New(g)
-			_, err := group.AddClient(g.Name(), disk)
+			_, err := diskwriter.Start(g)
 			if err != nil {
-				disk.Close()
 				return c.error(err)
 			}
-			go pushConns(disk, c.group)
 		case "unrecord":
 			if !c.permissions.Record {
 				return c.error(group.UserError("not authorised"))
 			}
-			for _, cc := range g.GetClients(c) {
-				disk, ok := cc.(*diskwriter.Client)
-				if ok {
-					disk.Close()
-					group.DelClient(disk)
-				}
-			}
+			diskwriter.Stop(g, "")
 		case "subgroups":
 			if !c.permissions.Op {
 				return c.error(group.UserError("not authorised"))
@@ -1409,6 +1438,12 @@ func clientWriter(conn *websocket.Conn, ch <-chan interface{}, done chan<- struc
 	}
 }
 
+// StatusChanged is called when the status of the group, such as whether
+// it is being recorded, has changed.
+func (c *webClient) StatusChanged() error {
+	return c.action(statusChangedAction{})
+}
+
 func (c *webClient) Warn(oponly bool, message string) error {
 	if oponly && !c.permissions.Op {
 		return nil
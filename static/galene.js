@@ -1480,6 +1480,8 @@ function displayUsername() {
         text = 'operator';
     else if(serverConnection.permissions.present)
         text = 'presenter';
+    if(serverConnection.recording)
+        text = (text ? text + ' ' : '') + '(recording)';
     document.getElementById('permspan').textContent = text;
 }
 
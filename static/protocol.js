@@ -88,6 +88,13 @@ function ServerConnection() {
      * @type {RTCConfiguration}
      */
     this.rtcConfiguration = null;
+    /**
+     * True if the group is being recorded.  This is updated before
+     * onjoined is called.
+     *
+     * @type {boolean}
+     */
+    this.recording = false;
     /**
      * The permissions granted to this connection.
      *
@@ -286,6 +293,7 @@ ServerConnection.prototype.connect = async function(url) {
                 }
                 sc.permissions = m.permissions || [];
                 sc.rtcConfiguration = m.rtcConfiguration || null;
+                sc.recording = !!m.recording;
                 if(sc.onjoined)
                     sc.onjoined.call(sc, m.kind, m.group,
                                      m.permissions || {},
@@ -15,6 +15,7 @@ import (
 	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -49,6 +50,14 @@ func Serve(address string, dataDir string) error {
 	http.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
 		statsHandler(w, r, dataDir)
 	})
+	http.HandleFunc("/ice-configuration.json",
+		func(w http.ResponseWriter, r *http.Request) {
+			iceHandler(w, r, dataDir)
+		})
+	http.HandleFunc("/recording-check.json",
+		func(w http.ResponseWriter, r *http.Request) {
+			recordingCheckHandler(w, r, dataDir)
+		})
 
 	s := &http.Server{
 		Addr:              address,
@@ -339,17 +348,26 @@ func failAuthentication(w http.ResponseWriter, realm string) {
 	http.Error(w, "Haha!", http.StatusUnauthorized)
 }
 
-func statsHandler(w http.ResponseWriter, r *http.Request, dataDir string) {
+// checkAdmin checks that the request carries the administrator's
+// credentials, and fails the request if it doesn't.
+func checkAdmin(w http.ResponseWriter, r *http.Request, dataDir, realm string) bool {
 	u, p, err := getPassword(dataDir)
 	if err != nil {
 		log.Printf("Passwd: %v", err)
-		failAuthentication(w, "stats")
-		return
+		failAuthentication(w, realm)
+		return false
 	}
 
 	username, password, ok := r.BasicAuth()
 	if !ok || username != u || password != p {
-		failAuthentication(w, "stats")
+		failAuthentication(w, realm)
+		return false
+	}
+	return true
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request, dataDir string) {
+	if !checkAdmin(w, r, dataDir, "stats") {
 		return
 	}
 
@@ -366,6 +384,24 @@ func statsHandler(w http.ResponseWriter, r *http.Request, dataDir string) {
 	fmt.Fprintf(w, "<link rel=\"stylesheet\" type=\"text/css\" href=\"/common.css\"/>")
 	fmt.Fprintf(w, "<head><body>\n")
 
+	ice := group.GetICEStats()
+	if !ice.LastLoad.IsZero() {
+		fmt.Fprintf(w, "<p>ICE servers: %v, loaded %v ago",
+			ice.Servers, time.Since(ice.LastLoad).Round(time.Second))
+		if ice.Fallback {
+			fmt.Fprintf(w, " (fallback)")
+		}
+		if ice.Failures > 0 {
+			fmt.Fprintf(w, ", %v consecutive failures", ice.Failures)
+			if !ice.LastSuccess.IsZero() {
+				since := time.Since(ice.LastSuccess)
+				fmt.Fprintf(w, ", last success %v ago",
+					since.Round(time.Second))
+			}
+		}
+		fmt.Fprintf(w, "</p>\n")
+	}
+
 	printBitrate := func(w io.Writer, rate, maxRate uint64) error {
 		var err error
 		if maxRate != 0 && maxRate != ^uint64(0) {
@@ -395,8 +431,24 @@ func statsHandler(w http.ResponseWriter, r *http.Request, dataDir string) {
 		fmt.Fprintf(w, "</tr>")
 	}
 
+	fmt.Fprintf(w, "<p>Recordings: %v", diskwriter.Recordings())
+	if diskwriter.MaxRecordings > 0 {
+		fmt.Fprintf(w, "/%v", diskwriter.MaxRecordings)
+	}
+	fmt.Fprintf(w, "</p>\n")
+
 	for _, gs := range ss {
-		fmt.Fprintf(w, "<p>%v</p>\n", html.EscapeString(gs.Name))
+		fmt.Fprintf(w, "<p>%v", html.EscapeString(gs.Name))
+		g := group.Get(gs.Name)
+		if g != nil && g.RecordingQuota() > 0 {
+			usage, err := diskwriter.Usage(gs.Name)
+			if err == nil {
+				fmt.Fprintf(w, " (recordings: %vMiB/%vMiB)",
+					usage/(1024*1024),
+					g.RecordingQuota()/(1024*1024))
+			}
+		}
+		fmt.Fprintf(w, "</p>\n")
 		fmt.Fprintf(w, "<table>")
 		for _, cs := range gs.Clients {
 			fmt.Fprintf(w, "<tr><td>%v</td></tr>\n", cs.Id)
@@ -430,6 +482,106 @@ func statsHandler(w http.ResponseWriter, r *http.Request, dataDir string) {
 	fmt.Fprintf(w, "</body></html>\n")
 }
 
+type iceResponse struct {
+	Configuration *group.RTCConfiguration `json:"configuration"`
+	Loaded        time.Time               `json:"loaded"`
+	NextRefresh   time.Time               `json:"nextRefresh"`
+	Failures      int                     `json:"failures,omitempty"`
+}
+
+// iceHandler returns the ICE configuration that is sent to clients,
+// either the global one or the one of the group given in the query.
+// Credentials are redacted unless the query contains credentials=true.
+func iceHandler(w http.ResponseWriter, r *http.Request, dataDir string) {
+	if !checkAdmin(w, r, dataDir, "ice") {
+		return
+	}
+
+	query := r.URL.Query()
+	conf := group.ICEConfiguration()
+	if name := query.Get("group"); name != "" {
+		// don't create the group if it is not running
+		if g := group.Get(name); g != nil {
+			conf = g.ICEConfiguration("")
+		} else {
+			desc, err := group.GetDescription(name)
+			if err != nil {
+				httpError(w, err)
+				return
+			}
+			conf = desc.ICEConfiguration("")
+		}
+	}
+
+	credentials, _ := strconv.ParseBool(query.Get("credentials"))
+	if !credentials {
+		c := *conf
+		c.ICEServers = make([]group.ICEServer, len(conf.ICEServers))
+		copy(c.ICEServers, conf.ICEServers)
+		for i := range c.ICEServers {
+			if c.ICEServers[i].Credential != nil {
+				c.ICEServers[i].Credential = "(redacted)"
+			}
+		}
+		conf = &c
+	}
+
+	stats := group.GetICEStats()
+
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("cache-control", "no-cache")
+	if r.Method == "HEAD" {
+		return
+	}
+
+	e := json.NewEncoder(w)
+	e.Encode(iceResponse{
+		Configuration: conf,
+		Loaded:        stats.LastLoad,
+		NextRefresh:   stats.NextRefresh,
+		Failures:      stats.Failures,
+	})
+}
+
+type recordingCheckResponse struct {
+	Group     string   `json:"group"`
+	Directory string   `json:"directory,omitempty"`
+	OK        bool     `json:"ok"`
+	Problems  []string `json:"problems,omitempty"`
+}
+
+// recordingCheckHandler checks that the recordings of the group given in
+// the query can be written, without recording anything.
+func recordingCheckHandler(w http.ResponseWriter, r *http.Request, dataDir string) {
+	if !checkAdmin(w, r, dataDir, "recording-check") {
+		return
+	}
+
+	name := r.URL.Query().Get("group")
+	if name == "" {
+		http.Error(w, "no group provided", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("cache-control", "no-cache")
+	if r.Method == "HEAD" {
+		return
+	}
+
+	directory, problems := diskwriter.Check(name)
+	response := recordingCheckResponse{
+		Group:     name,
+		Directory: directory,
+		OK:        len(problems) == 0,
+	}
+	for _, p := range problems {
+		response.Problems = append(response.Problems, p.Error())
+	}
+	e := json.NewEncoder(w)
+	e.Encode(response)
+}
+
 var upgrader websocket.Upgrader
 
 func wsHandler(w http.ResponseWriter, r *http.Request) {
@@ -472,7 +624,7 @@ func recordingsHandler(w http.ResponseWriter, r *http.Request) {
 
 	p = path.Clean(p)
 
-	f, err := os.Open(filepath.Join(diskwriter.Directory, p))
+	f, group, rel, err := openRecording(p)
 	if err != nil {
 		httpError(w, err)
 		return
@@ -485,14 +637,12 @@ func recordingsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	group := path.Dir(p[1:])
 	if fi.IsDir() {
 		u := r.URL.Path
 		if u[len(u)-1] != '/' {
 			http.Redirect(w, r, u+"/", http.StatusPermanentRedirect)
 			return
 		}
-		group = p[1:]
 	}
 
 	ok := checkGroupPermissions(w, r, group)
@@ -503,9 +653,11 @@ func recordingsHandler(w http.ResponseWriter, r *http.Request) {
 
 	if fi.IsDir() {
 		if r.Method == "POST" {
-			handleGroupAction(w, r, group)
+			handleGroupAction(w, r, group, rel)
+		} else if r.URL.Query().Get("q") == "live" {
+			serveLive(w, r, group, r.URL.Query().Get("id"))
 		} else {
-			serveGroupRecordings(w, r, f, group)
+			serveGroupRecordings(w, r, f, group, rel)
 		}
 		return
 	}
@@ -516,7 +668,41 @@ func recordingsHandler(w http.ResponseWriter, r *http.Request) {
 	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
 }
 
-func handleGroupAction(w http.ResponseWriter, r *http.Request, group string) {
+// openRecording opens the directory or the file designated by p, which is
+// of the form /group followed by a path within the group's directory,
+// such as a file or a subdirectory of recordings.  Since group names may
+// contain slashes, the group is the longest prefix of p that names an
+// existing group whose directory exists.  It returns the name of the
+// group and the path relative to its directory.
+func openRecording(p string) (*os.File, string, string, error) {
+	components := strings.Split(p[1:], "/")
+	for i := len(components); i > 0; i-- {
+		name := strings.Join(components[:i], "/")
+		_, err := group.GetDescription(name)
+		if err != nil {
+			continue
+		}
+		dir, err := diskwriter.GroupDirectory(name)
+		if err != nil {
+			continue
+		}
+		fi, err := os.Stat(dir)
+		if err != nil || !fi.IsDir() {
+			continue
+		}
+		rel := strings.Join(components[i:], "/")
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(rel)))
+		if err != nil {
+			return nil, "", "", err
+		}
+		return f, name, rel, nil
+	}
+	return nil, "", "", os.ErrNotExist
+}
+
+// handleGroupAction handles a POST request to the directory rel of the
+// recordings of a group.
+func handleGroupAction(w http.ResponseWriter, r *http.Request, group, rel string) {
 	if r.Method != "POST" {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -544,25 +730,116 @@ func handleGroupAction(w http.ResponseWriter, r *http.Request, group string) {
 				http.StatusBadRequest)
 			return
 		}
-		err := os.Remove(
-			filepath.Join(diskwriter.Directory,
-				filepath.Join(group,
-					path.Clean("/"+filename),
-				),
-			),
-		)
+		dir, err := diskwriter.GroupDirectory(group)
+		if err == nil {
+			err = os.Remove(filepath.Join(
+				dir, filepath.FromSlash(rel),
+				path.Clean("/"+filename),
+			))
+		}
 		if err != nil {
 			httpError(w, err)
 			return
 		}
-		http.Redirect(w, r, "/recordings/"+group+"/",
+		http.Redirect(w, r, path.Join("/recordings", group, rel)+"/",
 			http.StatusSeeOther)
 		return
+	case "start":
+		err := startRecording(group, r.Form)
+		if err != nil {
+			if isUserError(err) {
+				http.Error(w, err.Error(), http.StatusConflict)
+			} else {
+				httpError(w, err)
+			}
+			return
+		}
+		w.Header().Set("content-type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "Recording started\n")
+		return
+	case "pause", "resume":
+		err := pauseRecording(group, q == "pause")
+		if err != nil {
+			if isUserError(err) {
+				http.Error(w, err.Error(), http.StatusConflict)
+			} else {
+				httpError(w, err)
+			}
+			return
+		}
+		w.Header().Set("content-type", "text/plain; charset=utf-8")
+		if q == "pause" {
+			fmt.Fprintf(w, "Recording paused\n")
+		} else {
+			fmt.Fprintf(w, "Recording resumed\n")
+		}
+		return
+	case "stop":
+		n := stopRecording(group, r.Form.Get("recorder"))
+		w.Header().Set("content-type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "Recording stopped, %v connections flushed\n", n)
+		return
 	default:
 		http.Error(w, "unknown query", http.StatusBadRequest)
 	}
 }
 
+func isUserError(err error) bool {
+	_, ok := err.(group.UserError)
+	return ok
+}
+
+// startRecording starts a recorder in the named group.  If the form
+// contains a recorder name, a recorder is started with the given
+// settings in addition to any other recorders of the group.
+func startRecording(name string, form url.Values) error {
+	g, err := group.Add(name, nil)
+	if err != nil {
+		return err
+	}
+	recorder := form.Get("recorder")
+	if recorder == "" {
+		_, err = diskwriter.Start(g)
+		return err
+	}
+
+	options := diskwriter.Options{
+		Name:       recorder,
+		MaxBitrate: diskwriter.MaxBitrate,
+		AudioOnly:  g.RecordAudioOnly(),
+	}
+	if v := form.Get("max-bitrate"); v != "" {
+		options.MaxBitrate, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return group.UserError("bad max-bitrate")
+		}
+	}
+	if v := form.Get("audio-only"); v != "" {
+		options.AudioOnly, err = strconv.ParseBool(v)
+		if err != nil {
+			return group.UserError("bad audio-only")
+		}
+	}
+	_, err = diskwriter.StartRecorder(g, options)
+	return err
+}
+
+func pauseRecording(name string, paused bool) error {
+	g := group.Get(name)
+	if g == nil {
+		return group.UserError("not recording")
+	}
+	return diskwriter.SetPaused(g, paused)
+}
+
+func stopRecording(name, recorder string) int {
+	g := group.Get(name)
+	if g == nil {
+		return 0
+	}
+	return diskwriter.Stop(g, recorder)
+}
+
 type httpClient struct {
 	username string
 	password string
@@ -606,7 +883,9 @@ func checkGroupPermissions(w http.ResponseWriter, r *http.Request, groupname str
 	return true
 }
 
-func serveGroupRecordings(w http.ResponseWriter, r *http.Request, f *os.File, group string) {
+// serveGroupRecordings lists the recordings in the directory rel of the
+// recordings of a group, and its subdirectories.
+func serveGroupRecordings(w http.ResponseWriter, r *http.Request, f *os.File, groupname, rel string) {
 	fis, err := f.Readdir(-1)
 	if err != nil {
 		http.Error(w, "server error", http.StatusInternalServerError)
@@ -625,13 +904,24 @@ func serveGroupRecordings(w http.ResponseWriter, r *http.Request, f *os.File, gr
 	}
 
 	fmt.Fprintf(w, "<!DOCTYPE html>\n<html><head>\n")
-	fmt.Fprintf(w, "<title>Recordings for group %v</title>\n", group)
+	fmt.Fprintf(w, "<title>Recordings for group %v</title>\n", groupname)
 	fmt.Fprintf(w, "<link rel=\"stylesheet\" type=\"text/css\" href=\"/common.css\"/>")
 	fmt.Fprintf(w, "</head><body>\n")
 
+	action := (&url.URL{
+		Path: path.Join("/recordings", groupname, rel) + "/",
+	}).EscapedPath()
+
 	fmt.Fprintf(w, "<table>\n")
 	for _, fi := range fis {
 		if fi.IsDir() {
+			if !strings.HasPrefix(fi.Name(), ".") {
+				fmt.Fprintf(w,
+					"<tr><td><a href=\"./%v/\">%v/</a></td></tr>\n",
+					url.PathEscape(fi.Name()),
+					html.EscapeString(fi.Name()),
+				)
+			}
 			continue
 		}
 		fmt.Fprintf(w, "<tr><td><a href=\"./%v\">%v</a></td><td>%d</td>",
@@ -640,16 +930,89 @@ func serveGroupRecordings(w http.ResponseWriter, r *http.Request, f *os.File, gr
 			fi.Size(),
 		)
 		fmt.Fprintf(w,
-			"<td><form action=\"/recordings/%v/\" method=\"post\">"+
+			"<td><form action=\"%v\" method=\"post\">"+
 				"<input type=\"hidden\" name=\"filename\" value=\"%v\">"+
 				"<button type=\"submit\" name=\"q\" value=\"delete\">Delete</button>"+
 				"</form></td></tr>\n",
-			url.PathEscape(group), fi.Name())
+			html.EscapeString(action), fi.Name())
 	}
 	fmt.Fprintf(w, "</table>\n")
+
+	if g := group.Get(groupname); g != nil && rel == "" {
+		conns := diskwriter.LiveConns(g)
+		if len(conns) > 0 {
+			fmt.Fprintf(w, "<p>Live:</p>\n<ul>\n")
+			for _, c := range conns {
+				name := c.Label
+				if c.Username != "" {
+					name = c.Username + " " + name
+				}
+				fmt.Fprintf(w,
+					"<li><a href=\"./?q=live&amp;id=%v\">%v</a></li>\n",
+					url.QueryEscape(c.Id),
+					html.EscapeString(name))
+			}
+			fmt.Fprintf(w, "</ul>\n")
+		}
+	}
 	fmt.Fprintf(w, "</body></html>\n")
 }
 
+// liveResponse writes the headers of a live stream before its first
+// data, and flushes the response after each write, so that the data is
+// sent as soon as it is available.
+type liveResponse struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	started bool
+}
+
+func (lr *liveResponse) Write(p []byte) (int, error) {
+	if !lr.started {
+		lr.w.Header().Set("content-type", "video/webm")
+		lr.w.Header().Set("cache-control", "no-store")
+		lr.started = true
+	}
+	n, err := lr.w.Write(p)
+	if lr.flusher != nil {
+		lr.flusher.Flush()
+	}
+	return n, err
+}
+
+// serveLive serves the recording of the connection with the given id as
+// a webm stream that can be played by a <video> element.
+func serveLive(w http.ResponseWriter, r *http.Request, groupname, id string) {
+	g := group.Get(groupname)
+	if g == nil || id == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed",
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	// the response is only started once there is data, so that
+	// a missing recording can be reported
+	lr := &liveResponse{w: w, flusher: flusher}
+	err := diskwriter.Live(r.Context(), g, id, lr)
+	if !lr.started {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+		} else {
+			// the stream ended before it started
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+	if err != nil && err != context.Canceled {
+		log.Printf("Live stream: %v", err)
+	}
+}
+
 func Shutdown() {
 	v := server.Load()
 	if v == nil {
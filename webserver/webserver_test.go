@@ -0,0 +1,155 @@
+package webserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jech/galene/diskwriter"
+	"github.com/jech/galene/group"
+)
+
+func TestSubdirectoryRecording(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galene-webserver")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	savedGroups, savedRecordings := group.Directory, diskwriter.Directory
+	group.Directory = filepath.Join(dir, "groups")
+	diskwriter.Directory = filepath.Join(dir, "recordings")
+	defer func() {
+		group.Directory = savedGroups
+		diskwriter.Directory = savedRecordings
+	}()
+
+	err = os.MkdirAll(group.Directory, 0700)
+	if err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	err = ioutil.WriteFile(
+		filepath.Join(group.Directory, "test.json"),
+		[]byte(`{"allow-recording": true,
+                         "op": [{"username": "admin", "password": "pw"}]}`),
+		0600,
+	)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	// a recording stored in a per-user subdirectory
+	sub := filepath.Join(diskwriter.Directory, "test", "bob")
+	err = os.MkdirAll(sub, 0700)
+	if err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	err = ioutil.WriteFile(
+		filepath.Join(sub, "rec.webm"), []byte("recording"), 0600,
+	)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	get := func(p string, auth bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", p, nil)
+		if auth {
+			r.SetBasicAuth("admin", "pw")
+		}
+		w := httptest.NewRecorder()
+		recordingsHandler(w, r)
+		return w
+	}
+
+	w := get("/recordings/test/bob/rec.webm", true)
+	if w.Code != http.StatusOK || w.Body.String() != "recording" {
+		t.Errorf("Expected the recording, got %v %q",
+			w.Code, w.Body.String())
+	}
+
+	w = get("/recordings/test/bob/rec.webm", false)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected %v, got %v",
+			http.StatusUnauthorized, w.Code)
+	}
+
+	w = get("/recordings/test/bob/", true)
+	if w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), "rec.webm") {
+		t.Errorf("Expected a listing, got %v %q",
+			w.Code, w.Body.String())
+	}
+
+	w = get("/recordings/test/", true)
+	if w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), "./bob/") {
+		t.Errorf("Expected a link to the subdirectory, got %v %q",
+			w.Code, w.Body.String())
+	}
+
+	w = get("/recordings/unknown/bob/rec.webm", true)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected %v, got %v", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestICEHandlerGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galene-webserver")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := group.Directory
+	group.Directory = dir
+	defer func() {
+		group.Directory = saved
+	}()
+
+	err = ioutil.WriteFile(
+		filepath.Join(dir, "passwd"), []byte("admin:pw\n"), 0600,
+	)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	err = ioutil.WriteFile(
+		filepath.Join(dir, "ice.json"),
+		[]byte(`{"ice-servers": [{"urls": ["turn:ice.example.org"],
+                                     "username": "u",
+                                     "credential": "c"}]}`),
+		0600,
+	)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	get := func(p string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", p, nil)
+		r.SetBasicAuth("admin", "pw")
+		w := httptest.NewRecorder()
+		iceHandler(w, r, dir)
+		return w
+	}
+
+	w := get("/ice-configuration.json?group=ice")
+	if w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), "turn:ice.example.org") {
+		t.Errorf("Expected the group's configuration, got %v %q",
+			w.Code, w.Body.String())
+	}
+	if group.Get("ice") != nil {
+		t.Errorf("Group was created")
+	}
+
+	w = get("/ice-configuration.json?group=unknown")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected %v, got %v", http.StatusNotFound, w.Code)
+	}
+	if group.Get("unknown") != nil {
+		t.Errorf("Group was created")
+	}
+}